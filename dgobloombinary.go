@@ -0,0 +1,490 @@
+package dgobloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+/*
+The binary format written by MarshalBinary is, with all integers big-endian:
+
+	magic     [4]byte  "DGB2"
+	version   uint16
+	flags     uint16
+	capacity  uint32
+	elements  uint32
+	bits      uint64
+	fpr       float64  configured false positive rate, as IEEE 754 bits
+	salts     uint32   number of salts
+	saltBytes uint32   length of the salt section
+	tagBytes  uint32   length of the tag
+	salt section       for each salt, a uint32 length followed by the salt bytes
+	tag                the tag set with SetTag
+	bit vector         (bits+31)/32 uint32 words
+	checksum  uint32   CRC-32C of everything before it
+
+The fixed-size prefix up to the salt section is HeaderSize bytes long and can be read on its own with ReadHeader.
+
+Version 2, written before tags were added, is the same without tagBytes and the tag, so its header is 40 bytes long.
+It is still read, as a Filter with no tag; MarshalBinary always writes the current version.
+
+The encoding is canonical: fields are written in a fixed order with fixed widths, salts in Filter order, and nothing is
+taken from maps or the environment.  Filters with the same contents therefore encode to identical bytes, however and
+wherever they were built, and a hash of the bytes can serve as a content ID.  Unserialized state, such as the key of a
+keyed Filter or the pepper of a peppered one, an observer or a HyperLogLog sketch, does not take part.
+*/
+
+// HeaderSize is the length in bytes of the fixed-size header of the current version of the binary format.
+// It was 40 before version 3 added the tag length; ReadHeader reads either.
+const HeaderSize = 44
+
+const binaryVersion = 3
+
+// headerSizeV2 is the length of a version 2 header, which has no tag
+const headerSizeV2 = 40
+
+// checksumSize is the length of the trailing checksum of the binary format
+const checksumSize = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var binaryMagic = [4]byte{'D', 'G', 'B', '2'}
+
+// header flags
+const (
+	flagMix = 1 << iota
+	flagKeyed
+	flagWide
+	flagStrict
+	flagLittleEndian
+	flagPartitioned
+	flagPeppered
+
+	// knownFlags are the flags this version can decode; any other bit is a layout it would misread
+	knownFlags = flagMix | flagKeyed | flagWide | flagStrict | flagLittleEndian | flagPartitioned | flagPeppered
+)
+
+// ErrBadFormat is returned when decoding data that is not in the binary format.
+var ErrBadFormat = errors.New("dgobloom: not a serialized bloom filter")
+
+// ErrCorruptData is returned when decoding data in the binary format whose checksum does not match.
+var ErrCorruptData = errors.New("dgobloom: checksum mismatch; serialized filter is corrupt")
+
+// Header holds the metadata of a bloom Filter stored in the binary format.
+type Header struct {
+	Version   uint16
+	Flags     uint16
+	Capacity  uint32
+	Elements  uint32
+	Bits      uint64
+	FPR       float64 // configured false positive rate
+	Salts     uint32  // number of salts
+	SaltBytes uint32  // length of the salt section following the header
+	TagBytes  uint32  // length of the tag following the salt section
+}
+
+// checkFlags rejects flags this version does not know, rather than decoding a later layout with the wrong indices
+func (hdr *Header) checkFlags() error {
+	if unknown := hdr.Flags &^ knownFlags; unknown != 0 {
+		return fmt.Errorf("%w: unknown flags %#04x", ErrBadFormat, unknown)
+	}
+	return nil
+}
+
+// size returns the length of the fixed-size header in the version of hdr
+func (hdr *Header) size() int {
+	if hdr.Version == 2 {
+		return headerSizeV2
+	}
+	return HeaderSize
+}
+
+// words returns the number of words in the bit vector described by the header
+func (hdr *Header) words() uint64 { return (hdr.Bits + 31) / 32 }
+
+func (hdr *Header) put(p []byte) {
+	copy(p, binaryMagic[:])
+	binary.BigEndian.PutUint16(p[4:], hdr.Version)
+	binary.BigEndian.PutUint16(p[6:], hdr.Flags)
+	binary.BigEndian.PutUint32(p[8:], hdr.Capacity)
+	binary.BigEndian.PutUint32(p[12:], hdr.Elements)
+	binary.BigEndian.PutUint64(p[16:], hdr.Bits)
+	binary.BigEndian.PutUint64(p[24:], math.Float64bits(hdr.FPR))
+	binary.BigEndian.PutUint32(p[32:], hdr.Salts)
+	binary.BigEndian.PutUint32(p[36:], hdr.SaltBytes)
+	binary.BigEndian.PutUint32(p[40:], hdr.TagBytes)
+}
+
+func parseHeader(p []byte) (Header, error) {
+	var hdr Header
+
+	if len(p) < headerSizeV2 || string(p[:4]) != string(binaryMagic[:]) {
+		return hdr, ErrBadFormat
+	}
+
+	hdr.Version = binary.BigEndian.Uint16(p[4:])
+	hdr.Flags = binary.BigEndian.Uint16(p[6:])
+	hdr.Capacity = binary.BigEndian.Uint32(p[8:])
+	hdr.Elements = binary.BigEndian.Uint32(p[12:])
+	hdr.Bits = binary.BigEndian.Uint64(p[16:])
+	hdr.FPR = math.Float64frombits(binary.BigEndian.Uint64(p[24:]))
+	hdr.Salts = binary.BigEndian.Uint32(p[32:])
+	hdr.SaltBytes = binary.BigEndian.Uint32(p[36:])
+
+	switch hdr.Version {
+	case binaryVersion:
+		if len(p) < HeaderSize {
+			return hdr, ErrBadFormat
+		}
+		hdr.TagBytes = binary.BigEndian.Uint32(p[40:])
+	case 2:
+	default:
+		return hdr, fmt.Errorf("%w: unsupported version %d", ErrBadFormat, hdr.Version)
+	}
+
+	return hdr, nil
+}
+
+// ReadHeader reads only the fixed-size header of a bloom Filter in the binary format from r, without reading the salts or bit vector.
+// It reads HeaderSize bytes, or 40 for version 2.  Flags this version does not know are reported as ErrBadFormat, as UnmarshalBinary reports them.
+func ReadHeader(r io.Reader) (Header, error) {
+	var p [HeaderSize]byte
+
+	if _, err := io.ReadFull(r, p[:headerSizeV2]); err != nil {
+		return Header{}, err
+	}
+
+	n := HeaderSize
+	if binary.BigEndian.Uint16(p[4:]) == 2 {
+		n = headerSizeV2
+	} else if _, err := io.ReadFull(r, p[headerSizeV2:]); err != nil {
+		return Header{}, err
+	}
+
+	hdr, err := parseHeader(p[:n])
+	if err == nil {
+		err = hdr.checkFlags()
+	}
+
+	return hdr, err
+}
+
+// header returns the binary format header describing bf
+func (bf *bloomFilter2) header() Header {
+	hdr := Header{
+		Version:  binaryVersion,
+		Capacity: bf.Capacity,
+		Elements: bf.Elements,
+		Bits:     bf.Bits,
+		FPR:      bf.FalsePositiveRate,
+		Salts:    uint32(len(bf.Salts)),
+		TagBytes: uint32(len(bf.DatasetTag)),
+	}
+
+	if bf.Mix {
+		hdr.Flags |= flagMix
+	}
+	if bf.Keyed {
+		hdr.Flags |= flagKeyed
+	}
+	if bf.Wide {
+		hdr.Flags |= flagWide
+	}
+	if bf.Strict {
+		hdr.Flags |= flagStrict
+	}
+	if bf.LittleEndian {
+		hdr.Flags |= flagLittleEndian
+	}
+	if bf.Partitioned {
+		hdr.Flags |= flagPartitioned
+	}
+	if bf.Peppered {
+		hdr.Flags |= flagPeppered
+	}
+
+	for _, s := range bf.Salts {
+		hdr.SaltBytes += 4 + uint32(len(s))
+	}
+
+	return hdr
+}
+
+// MarshalBinary encodes the bloom Filter in the binary format.  The output is deterministic: equal Filters encode to equal bytes.  PendingInserts starts again from 0.
+func (bf *bloomFilter2) MarshalBinary() ([]byte, error) {
+
+	hdr := bf.header()
+	data := make([]byte, HeaderSize+int(hdr.SaltBytes)+int(hdr.TagBytes)+4*len(bf.Filter)+checksumSize)
+	hdr.put(data)
+
+	p := data[HeaderSize:]
+	for _, s := range bf.Salts {
+		binary.BigEndian.PutUint32(p, uint32(len(s)))
+		p = p[4+copy(p[4:], s):]
+	}
+	p = p[copy(p, bf.DatasetTag):]
+
+	for _, w := range bf.Filter {
+		binary.BigEndian.PutUint32(p, w)
+		p = p[4:]
+	}
+
+	binary.BigEndian.PutUint32(p, crc32.Checksum(data[:len(data)-checksumSize], castagnoli))
+	bf.pending = 0
+
+	return data, nil
+}
+
+// DumpHead writes a labeled dump of the binary format header of the bloom Filter, its salts and the first words of the bit vector to w, for debugging format mismatches.
+// The words are shown as MarshalBinary writes them, eight to a line, each line led by the index of its first word.  words is capped at the length of the bit vector.
+func (bf *bloomFilter2) DumpHead(w io.Writer, words int) error {
+
+	hdr := bf.header()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "version   %d\n", hdr.Version)
+	fmt.Fprintf(&buf, "flags     %#04x\n", hdr.Flags)
+	fmt.Fprintf(&buf, "capacity  %d\n", hdr.Capacity)
+	fmt.Fprintf(&buf, "elements  %d\n", hdr.Elements)
+	fmt.Fprintf(&buf, "bits      %d\n", hdr.Bits)
+	fmt.Fprintf(&buf, "fpr       %v\n", hdr.FPR)
+	fmt.Fprintf(&buf, "salts     %d\n", hdr.Salts)
+	fmt.Fprintf(&buf, "saltBytes %d\n", hdr.SaltBytes)
+	fmt.Fprintf(&buf, "tagBytes  %d\n", hdr.TagBytes)
+	for i, s := range bf.Salts {
+		fmt.Fprintf(&buf, "salt %-4d %x\n", i, s)
+	}
+
+	if words > len(bf.Filter) {
+		words = len(bf.Filter)
+	}
+	for i := 0; i < words; i += 8 {
+		fmt.Fprintf(&buf, "%08x ", i)
+		for j := i; j < i+8 && j < words; j++ {
+			fmt.Fprintf(&buf, " %08x", bf.Filter[j])
+		}
+		fmt.Fprintf(&buf, "\n")
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// splitBinary checks data in the binary format and splits it into its header, salts, tag and bit vector, without copying.
+// The sizes in the header are checked against the input before anything is allocated from them.
+func splitBinary(data []byte) (hdr Header, salts [][]byte, tag []byte, words []byte, err error) {
+
+	hdr, err = parseHeader(data)
+	if err != nil {
+		return hdr, nil, nil, nil, err
+	}
+
+	n := len(data) - checksumSize
+	if n < hdr.size() {
+		return hdr, nil, nil, nil, fmt.Errorf("%w: missing checksum", ErrBadFormat)
+	}
+	if crc32.Checksum(data[:n], castagnoli) != binary.BigEndian.Uint32(data[n:]) {
+		return hdr, nil, nil, nil, ErrCorruptData
+	}
+	if err := hdr.checkFlags(); err != nil {
+		return hdr, nil, nil, nil, err
+	}
+
+	p := data[hdr.size():n]
+
+	if hdr.Bits == 0 || hdr.Bits&(hdr.Bits-1) != 0 {
+		return hdr, nil, nil, nil, fmt.Errorf("%w: Bits is %d, which is not a power of two", ErrBadFormat, hdr.Bits)
+	}
+	if hdr.words() > uint64(len(p))/4 {
+		return hdr, nil, nil, nil, fmt.Errorf("%w: %d bits do not fit in %d bytes", ErrBadFormat, hdr.Bits, len(p))
+	}
+	if want := uint64(hdr.SaltBytes) + uint64(hdr.TagBytes) + 4*hdr.words(); uint64(len(p)) != want {
+		return hdr, nil, nil, nil, fmt.Errorf("%w: %d bytes of salts, tag and bits, want %d", ErrBadFormat, len(p), want)
+	}
+	if hdr.Salts > hdr.SaltBytes/4 {
+		return hdr, nil, nil, nil, fmt.Errorf("%w: %d salts do not fit in %d bytes", ErrBadFormat, hdr.Salts, hdr.SaltBytes)
+	}
+
+	salts = make([][]byte, hdr.Salts)
+	section := p[:hdr.SaltBytes]
+	for i := range salts {
+		if len(section) < 4 || uint64(len(section)-4) < uint64(binary.BigEndian.Uint32(section)) {
+			return hdr, nil, nil, nil, fmt.Errorf("%w: truncated salt %d", ErrBadFormat, i)
+		}
+		n := binary.BigEndian.Uint32(section)
+		salts[i] = section[4 : 4+n]
+		section = section[4+n:]
+	}
+	if len(section) != 0 {
+		return hdr, nil, nil, nil, fmt.Errorf("%w: %d bytes left after salts", ErrBadFormat, len(section))
+	}
+
+	p = p[hdr.SaltBytes:]
+
+	return hdr, salts, p[:hdr.TagBytes], p[hdr.TagBytes:], nil
+}
+
+// setFlags sets the hashing options of bf from the header flags
+func (hdr *Header) setFlags(bf *bloomFilter2) {
+	bf.Mix = hdr.Flags&flagMix != 0
+	bf.Keyed = hdr.Flags&flagKeyed != 0
+	bf.Wide = hdr.Flags&flagWide != 0
+	bf.Strict = hdr.Flags&flagStrict != 0
+	bf.LittleEndian = hdr.Flags&flagLittleEndian != 0
+	bf.Partitioned = hdr.Flags&flagPartitioned != 0
+	bf.Peppered = hdr.Flags&flagPeppered != 0
+}
+
+// UnmarshalBinary decodes a bloom Filter in the binary format, replacing the contents of bf.
+// ErrCorruptData is returned, and bf left unchanged, if the checksum does not match, and ErrBadFormat if the decoded Filter would not pass Validate.
+func (bf *bloomFilter2) UnmarshalBinary(data []byte) error {
+
+	if bf.readOnly {
+		return ErrReadOnly
+	}
+
+	hdr, salts, tag, words, err := splitBinary(data)
+	if err != nil {
+		return err
+	}
+
+	for i, s := range salts {
+		salts[i] = append([]byte(nil), s...)
+	}
+
+	filter := newBitvector2(int(hdr.words()))
+	for i := range filter {
+		filter[i] = binary.BigEndian.Uint32(words[4*i:])
+	}
+
+	decoded := bloomFilter2{
+		Capacity:          hdr.Capacity,
+		Elements:          hdr.Elements,
+		Bits:              hdr.Bits,
+		FalsePositiveRate: hdr.FPR,
+		Filter:            filter,
+		Salts:             salts,
+		DatasetTag:        string(tag),
+	}
+	if err := decoded.validateLayout(); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadFormat, err)
+	}
+
+	bf.Capacity = decoded.Capacity
+	bf.Elements = decoded.Elements
+	bf.Bits = decoded.Bits
+	bf.FalsePositiveRate = decoded.FalsePositiveRate
+	bf.Filter = decoded.Filter
+	bf.Salts = decoded.Salts
+	bf.DatasetTag = decoded.DatasetTag
+	hdr.setFlags(bf)
+
+	return nil
+}
+
+// MergeBytes merges a bloom Filter in the binary format, such as one received from a peer, into the current one without decoding it into a second Filter.
+// The header and salts are checked for compatibility as Merge checks them, and the bit vector is then ORed straight from data.
+// As with Merge, ErrIncompatible is returned, and the Filter left unchanged, if they do not match; keyed and peppered Filters cannot be merged this way, since the key or pepper is not serialized.
+func (bf *bloomFilter2) MergeBytes(data []byte) error {
+
+	if bf.readOnly {
+		return ErrReadOnly
+	}
+
+	hdr, salts, _, words, err := splitBinary(data)
+	if err != nil {
+		return err
+	}
+
+	// the view shares the receiver's bit vector only so that the length check passes; Bits is compared on its own
+	other := &bloomFilter2{Elements: hdr.Elements, Bits: hdr.Bits, Filter: bf.Filter, Salts: salts, FalsePositiveRate: hdr.FPR}
+	hdr.setFlags(other)
+	if err := bf.compatible(other); err != nil {
+		return err
+	}
+
+	for i := range bf.Filter {
+		bf.Filter[i] |= binary.BigEndian.Uint32(words[4*i:])
+	}
+
+	bf.mergeMetadata(other)
+
+	return nil
+}
+
+// archiveMagic begins an archive written by SerializeArchive
+var archiveMagic = [4]byte{'D', 'G', 'B', 'A'}
+
+// SerializeArchive writes the bloom Filters to w as one archive: the magic "DGBA", a big-endian uint32 count,
+// and each Filter in the binary format of MarshalBinary preceded by its length as a big-endian uint64.
+// The Filters may have any dimensions, and there may be none.  As with MarshalBinary, the keys of keyed Filters are not written.
+func SerializeArchive(w io.Writer, filters ...BloomFilter2) error {
+
+	var p [8]byte
+
+	copy(p[:], archiveMagic[:])
+	binary.BigEndian.PutUint32(p[4:], uint32(len(filters)))
+	if _, err := w.Write(p[:]); err != nil {
+		return err
+	}
+
+	for i, bf := range filters {
+		data, err := bf.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("filter %d: %w", i, err)
+		}
+
+		binary.BigEndian.PutUint64(p[:], uint64(len(data)))
+		if _, err := w.Write(p[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeserializeArchive reads the bloom Filters of an archive written by SerializeArchive from r, in order.
+// Each entry is checked as UnmarshalBinary checks it; a truncated archive is ErrBadFormat.
+func DeserializeArchive(r io.Reader) ([]BloomFilter2, error) {
+
+	var p [8]byte
+
+	if _, err := io.ReadFull(r, p[:]); err != nil || string(p[:4]) != string(archiveMagic[:]) {
+		return nil, fmt.Errorf("%w: missing archive header", ErrBadFormat)
+	}
+	n := binary.BigEndian.Uint32(p[4:])
+
+	// the count and lengths are not trusted to size allocations; entries grow only as data arrives
+	var filters []BloomFilter2
+	for i := uint32(0); i < n; i++ {
+
+		if _, err := io.ReadFull(r, p[:]); err != nil {
+			return nil, fmt.Errorf("%w: archive truncated at filter %d of %d", ErrBadFormat, i, n)
+		}
+		size := binary.BigEndian.Uint64(p[:])
+
+		data, err := io.ReadAll(io.LimitReader(r, int64(size&math.MaxInt64)))
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(data)) != size {
+			return nil, fmt.Errorf("%w: archive truncated in filter %d of %d", ErrBadFormat, i, n)
+		}
+
+		bf := new(bloomFilter2)
+		if err := bf.UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("filter %d: %w", i, err)
+		}
+		filters = append(filters, bf)
+	}
+
+	return filters, nil
+}
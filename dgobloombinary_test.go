@@ -0,0 +1,628 @@
+package dgobloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += n
+	return n, err
+}
+
+func TestMarshalBinary(t *testing.T) {
+
+	b := NewMixedBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	for i := 0; i < 100; i++ {
+		b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+
+	b2 := NewBloomFilter2(1, ERRPCT, nil)
+	if err := b2.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %v", err)
+	}
+
+	if b2.Len() != 100 || !b2.(*bloomFilter2).Mix {
+		t.Errorf("decoded Len=%d Mix=%v, want 100 and true", b2.Len(), b2.(*bloomFilter2).Mix)
+	}
+	if err := b2.Validate(); err != nil {
+		t.Errorf("decoded filter is invalid: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if !b2.Exists([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("decoded filter lost element %d", i)
+		}
+	}
+
+	if err := b2.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Error("UnmarshalBinary accepted truncated data")
+	}
+	if err := b2.UnmarshalBinary([]byte("garbage")); err == nil {
+		t.Error("UnmarshalBinary accepted garbage")
+	}
+}
+
+func TestBinaryChecksum(t *testing.T) {
+
+	b := NewBloomFilter2(1000, ERRPCT, []uint32{1, 2, 3})
+	for i := 0; i < 100; i++ {
+		b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	data, _ := b.MarshalBinary()
+
+	var c bloomFilter2
+	for i := range data {
+		damaged := append([]byte(nil), data...)
+		damaged[i] ^= 0x10
+		err := c.UnmarshalBinary(damaged)
+		if err == nil {
+			t.Fatalf("flipping byte %d was not detected", i)
+		}
+		// past the magic and version every flip is caught by the checksum
+		if i >= 6 && !errors.Is(err, ErrCorruptData) {
+			t.Errorf("flipping byte %d: got %v, want ErrCorruptData", i, err)
+		}
+	}
+
+	// rewriting the version cannot skip the checksum
+	v1 := append([]byte(nil), data[:len(data)-checksumSize]...)
+	binary.BigEndian.PutUint16(v1[4:], 1)
+	if err := c.UnmarshalBinary(v1); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("version 1 data: got %v, want ErrBadFormat", err)
+	}
+
+	// UnSerialization reads the binary format too, and notices damage on disk
+	file := filepath.Join(t.TempDir(), "filter.bin")
+	os.WriteFile(file, data, 0644)
+	if b2, err := UnSerialization(file); err != nil || !b.Equal(b2) {
+		t.Errorf("UnSerialization of binary file: %v", err)
+	}
+
+	data[len(data)/2] ^= 1
+	os.WriteFile(file, data, 0644)
+	if _, err := UnSerialization(file); !errors.Is(err, ErrCorruptData) {
+		t.Errorf("UnSerialization of damaged file: got %v, want ErrCorruptData", err)
+	}
+}
+
+// withChecksum returns p followed by its CRC-32C, as MarshalBinary writes it
+func withChecksum(p []byte) []byte {
+	return binary.BigEndian.AppendUint32(p, crc32.Checksum(p, castagnoli))
+}
+
+func TestUnmarshalBinaryMalformed(t *testing.T) {
+
+	b := NewBloomFilter2(100, ERRPCT, []uint32{1, 2, 3})
+	valid, _ := b.MarshalBinary()
+	body := valid[:len(valid)-checksumSize]
+
+	// mutate rewrites the header of a valid encoding and fixes up the checksum
+	mutate := func(f func(hdr *Header)) []byte {
+		hdr, err := parseHeader(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f(&hdr)
+		data := append([]byte(nil), body...)
+		hdr.put(data)
+		return withChecksum(data)
+	}
+
+	// a single word of bits with no salts, or with one empty salt: the sizes agree but the Filter is unusable
+	noSalts := make([]byte, HeaderSize+4)
+	(&Header{Version: binaryVersion, Bits: 32}).put(noSalts)
+	emptySalt := make([]byte, HeaderSize+4+4)
+	(&Header{Version: binaryVersion, Bits: 32, Salts: 1, SaltBytes: 4}).put(emptySalt)
+
+	cases := map[string][]byte{
+		"salt count":  mutate(func(hdr *Header) { hdr.Salts = math.MaxUint32 }),
+		"zero bits":   mutate(func(hdr *Header) { hdr.Bits = 0 }),
+		"huge bits":   mutate(func(hdr *Header) { hdr.Bits = 1 << 63 }),
+		"odd bits":    mutate(func(hdr *Header) { hdr.Bits-- }),
+		"short bits":  mutate(func(hdr *Header) { hdr.Bits /= 2 }),
+		"no salts":    withChecksum(noSalts),
+		"empty salt":  withChecksum(emptySalt),
+		"header only": withChecksum(mutate(func(hdr *Header) {})[:HeaderSize]),
+	}
+
+	for name, data := range cases {
+		if err := b.UnmarshalBinary(data); !errors.Is(err, ErrBadFormat) {
+			t.Errorf("%s: got %v, want ErrBadFormat", name, err)
+		}
+	}
+
+	if err := b.Validate(); err != nil || !bytes.Equal(mustMarshal(t, b), valid) {
+		t.Errorf("rejected input changed the filter: %v", err)
+	}
+}
+
+func mustMarshal(t *testing.T, b BloomFilter2) []byte {
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestMarshalBinaryDeterministic(t *testing.T) {
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	// built independently, inserting in different orders and through different paths
+	a := NewMixedBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	for _, k := range keys {
+		a.Insert(k)
+	}
+
+	b := NewMixedBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	half := EmptyLike(b)
+	for i := len(keys) - 1; i >= len(keys)/2; i-- {
+		b.Insert(keys[i])
+	}
+	for _, k := range keys[:len(keys)/2] {
+		half.Insert(k)
+	}
+	b.Merge(half)
+
+	da, _ := a.MarshalBinary()
+	db, _ := b.MarshalBinary()
+	if !bytes.Equal(da, db) {
+		t.Fatal("identical filters encode to different bytes")
+	}
+
+	// decoding and encoding again is stable, and unserialized state does not leak in
+	var c bloomFilter2
+	c.UnmarshalBinary(da)
+	c.OnInsert(func([]byte, bool) {})
+	c.SetReadOnly(true)
+	if dc, _ := c.MarshalBinary(); !bytes.Equal(da, dc) {
+		t.Error("re-encoding a decoded filter changed its bytes")
+	}
+
+	// and the bytes do change with the contents
+	a.Insert([]byte("one more"))
+	if da2, _ := a.MarshalBinary(); bytes.Equal(da, da2) {
+		t.Error("different filters encode to the same bytes")
+	}
+}
+
+func TestTag(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3})
+	b.Insert([]byte("key"))
+	if b.Tag() != "" {
+		t.Errorf("new filter has tag %q", b.Tag())
+	}
+	b.SetTag("dataset-2026-10-14")
+
+	data, _ := b.MarshalBinary()
+	var c bloomFilter2
+	if err := c.UnmarshalBinary(data); err != nil || c.Tag() != "dataset-2026-10-14" || !c.Exists([]byte("key")) {
+		t.Errorf("binary round trip: tag %q, err %v", c.Tag(), err)
+	}
+	if hdr, _ := ReadHeader(bytes.NewReader(data)); hdr.TagBytes != uint32(len(b.Tag())) {
+		t.Errorf("header TagBytes=%d, want %d", hdr.TagBytes, len(b.Tag()))
+	}
+
+	var buf bytes.Buffer
+	b.WriteTo(&buf)
+	if g, err := ReadFrom(&buf); err != nil || g.Tag() != b.Tag() {
+		t.Errorf("gob round trip lost the tag: %v", err)
+	}
+
+	// a tag longer than the input is rejected
+	hdr, _ := parseHeader(data)
+	hdr.TagBytes = math.MaxUint32
+	damaged := append([]byte(nil), data[:len(data)-checksumSize]...)
+	hdr.put(damaged)
+	if err := c.UnmarshalBinary(withChecksum(damaged)); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("oversized tag: got %v, want ErrBadFormat", err)
+	}
+}
+
+// binaryV2Fixture is MarshalBinary of NewBloomFilter2(20, 0.01, []uint32{1, 2, 3}) holding alpha, beta and gamma, as written by version 2
+const binaryV2Fixture = "4447423200020000000000140000000300000000000004003f847ae147ae147b000000030000001800000004000000010000000400000002" +
+	"0000000400000003000000000000000002000000000000000000000000000000000000000000000000000200000000010000800000010000" +
+	"0000000000000000000000004000000000000000000000000000000000000000000000000000000000000000000000000000000000000000" +
+	"000000000000000004000000400000000000000000002000abe86219"
+
+func TestUnmarshalBinaryV2(t *testing.T) {
+
+	data, err := hex.DecodeString(binaryV2Fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, err := ReadHeader(bytes.NewReader(data))
+	if err != nil || hdr.Version != 2 || hdr.Capacity != 20 || hdr.Elements != 3 || hdr.Salts != 3 || hdr.TagBytes != 0 {
+		t.Fatalf("ReadHeader of version 2 data: %+v, %v", hdr, err)
+	}
+	cr := &countingReader{r: bytes.NewReader(data)}
+	ReadHeader(cr)
+	if cr.n != 40 {
+		t.Errorf("ReadHeader read %d bytes of a version 2 header, want 40", cr.n)
+	}
+
+	b := NewBloomFilter2(1, ERRPCT, nil)
+	if err := b.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary of version 2 data: %v", err)
+	}
+	for _, k := range []string{"alpha", "beta", "gamma"} {
+		if !b.Exists([]byte(k)) {
+			t.Errorf("%s lost reading version 2", k)
+		}
+	}
+	if b.Tag() != "" || b.Len() != 3 || b.Cap() != 20 {
+		t.Errorf("version 2 filter decoded with tag %q, Len %d, Cap %d", b.Tag(), b.Len(), b.Cap())
+	}
+
+	// the same Filter built now, and the fixture rewritten, are the current version
+	want := NewBloomFilter2(20, 0.01, []uint32{1, 2, 3})
+	for _, k := range []string{"alpha", "beta", "gamma"} {
+		want.Insert([]byte(k))
+	}
+	if !b.Equal(want) {
+		t.Error("version 2 filter differs from one built now")
+	}
+	again, _ := b.MarshalBinary()
+	if v := binary.BigEndian.Uint16(again[4:]); v != binaryVersion || len(again) != len(data)+HeaderSize-40 {
+		t.Errorf("rewritten as version %d in %d bytes", v, len(again))
+	}
+
+	// a current header relabelled as version 2 no longer lines up, and the checksum catches it
+	relabelled := append([]byte(nil), again...)
+	binary.BigEndian.PutUint16(relabelled[4:], 2)
+	if err := b.UnmarshalBinary(relabelled); err == nil {
+		t.Error("version 3 data relabelled as version 2 was accepted")
+	}
+}
+
+func TestUnmarshalBinaryUnknownFlags(t *testing.T) {
+
+	b := NewPartitionedBloomFilter(CAPACITY, ERRPCT, []uint32{1, 2, 3})
+	b.Insert([]byte("key"))
+	data, _ := b.MarshalBinary()
+
+	for bit := uint(0); bit < 16; bit++ {
+		mask := uint16(1) << bit
+		if mask&knownFlags != 0 {
+			continue
+		}
+
+		// a Filter written with a layout flag from a later version, checksummed as that version would
+		future := append([]byte(nil), data...)
+		binary.BigEndian.PutUint16(future[6:], binary.BigEndian.Uint16(future[6:])|mask)
+		n := len(future) - checksumSize
+		binary.BigEndian.PutUint32(future[n:], crc32.Checksum(future[:n], castagnoli))
+
+		var c bloomFilter2
+		if err := c.UnmarshalBinary(future); !errors.Is(err, ErrBadFormat) {
+			t.Errorf("flag %#04x: UnmarshalBinary got %v, want ErrBadFormat", mask, err)
+		}
+		if _, err := ReadHeader(bytes.NewReader(future)); !errors.Is(err, ErrBadFormat) {
+			t.Errorf("flag %#04x: ReadHeader got %v, want ErrBadFormat", mask, err)
+		}
+		if err := b.MergeBytes(future); !errors.Is(err, ErrBadFormat) {
+			t.Errorf("flag %#04x: MergeBytes got %v, want ErrBadFormat", mask, err)
+		}
+	}
+
+	var c bloomFilter2
+	if err := c.UnmarshalBinary(data); err != nil || !c.Partitioned {
+		t.Errorf("known flags: %v, partitioned %v", err, c.Partitioned)
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	for i := 0; i < 100; i++ {
+		b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	data, _ := b.MarshalBinary()
+	cr := &countingReader{r: bytes.NewReader(data)}
+
+	hdr, err := ReadHeader(cr)
+	if err != nil {
+		t.Fatalf("ReadHeader failed: %v", err)
+	}
+
+	if cr.n != HeaderSize {
+		t.Errorf("ReadHeader read %d bytes, want %d", cr.n, HeaderSize)
+	}
+
+	b2 := NewBloomFilter2(1, ERRPCT, nil).(*bloomFilter2)
+	b2.UnmarshalBinary(data)
+
+	if hdr.Capacity != b2.Capacity || hdr.Elements != b2.Elements || hdr.Bits != b2.Bits || int(hdr.Salts) != len(b2.Salts) {
+		t.Errorf("header %+v does not match decoded filter", hdr)
+	}
+}
+
+func TestNewBloomFilterForFileSize(t *testing.T) {
+
+	last := 1.0
+	for _, budget := range []int{1 << 10, 10000, 1 << 16, 1 << 20} {
+		b, fpr, err := NewBloomFilterForFileSize(budget, CAPACITY)
+		if err != nil {
+			t.Fatalf("NewBloomFilterForFileSize(%d) failed: %v", budget, err)
+		}
+
+		for i := 0; i < CAPACITY; i++ {
+			b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+		}
+
+		data, _ := b.MarshalBinary()
+		t.Logf("budget %d: %d bytes, %d salts, false positive rate %g", budget, len(data), len(b.(*bloomFilter2).Salts), fpr)
+
+		if len(data) > budget {
+			t.Errorf("budget %d: serialized to %d bytes", budget, len(data))
+		}
+		if len(data) <= budget/2 {
+			t.Errorf("budget %d: only used %d bytes", budget, len(data))
+		}
+		if fpr >= last {
+			t.Errorf("budget %d: false positive rate %g did not improve on %g", budget, fpr, last)
+		}
+		last = fpr
+	}
+
+	if _, _, err := NewBloomFilterForFileSize(HeaderSize, CAPACITY); err == nil {
+		t.Error("a budget below the header size succeeded")
+	}
+}
+
+func TestParetoSuggest(t *testing.T) {
+
+	budgets := []uint64{16, 1 << 10, 10000, 1 << 14, 1 << 16, 1 << 20}
+	points := ParetoSuggest(CAPACITY, budgets)
+	if len(points) != len(budgets) {
+		t.Fatalf("ParetoSuggest returned %d points for %d budgets", len(points), len(budgets))
+	}
+
+	if points[0].FPR != 1 || points[0].Bits != 0 {
+		t.Errorf("a 16 byte budget suggested %+v", points[0])
+	}
+
+	for i, p := range points[1:] {
+		prev := points[i]
+		t.Logf("%d bytes: %d bits, %d salts, false positive rate %g", p.Bytes, p.Bits, p.Salts, p.FPR)
+
+		if p.Bytes != budgets[i+1] {
+			t.Errorf("point %d is for %d bytes, want %d", i+1, p.Bytes, budgets[i+1])
+		}
+		if p.FPR > prev.FPR || (p.Bits > prev.Bits && p.FPR == prev.FPR) {
+			t.Errorf("%d bytes: false positive rate %g did not improve on %g at %d bytes", p.Bytes, p.FPR, prev.FPR, prev.Bytes)
+		}
+
+		// the suggestion is what NewBloomFilterForFileSize builds
+		b, fpr, err := NewBloomFilterForFileSize(int(p.Bytes), CAPACITY)
+		if err != nil {
+			t.Fatalf("NewBloomFilterForFileSize(%d) failed: %v", p.Bytes, err)
+		}
+		if fpr != p.FPR || b.(*bloomFilter2).Bits != p.Bits || len(b.(*bloomFilter2).Salts) != p.Salts {
+			t.Errorf("%d bytes: suggested %+v, NewBloomFilterForFileSize built %d bits, %d salts at %g", p.Bytes, p, b.(*bloomFilter2).Bits, len(b.(*bloomFilter2).Salts), fpr)
+		}
+	}
+
+	if p := ParetoSuggest(CAPACITY, []uint64{math.MaxUint64}); len(p) != 1 || p[0].Bytes != math.MaxUint64 {
+		t.Errorf("ParetoSuggest of the largest budget returned %+v", p)
+	}
+}
+
+func TestSerializeDiff(t *testing.T) {
+
+	live := NewTestBloomFilter(CAPACITY, ERRPCT)
+	for i := 0; i < 1000; i++ {
+		live.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	// a full backup at the checkpoint
+	data, _ := live.MarshalBinary()
+	backup := NewBloomFilter2(1, ERRPCT, nil)
+	backup.UnmarshalBinary(data)
+	live.Checkpoint()
+
+	for i := 1000; i < 1100; i++ {
+		live.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	var diff bytes.Buffer
+	if err := live.SerializeDiff(&diff); err != nil {
+		t.Fatalf("SerializeDiff failed: %v", err)
+	}
+
+	if diff.Len() >= len(data)/2 {
+		t.Errorf("diff is %d bytes, full backup is %d", diff.Len(), len(data))
+	}
+
+	if err := backup.ApplyDiff(&diff); err != nil {
+		t.Fatalf("ApplyDiff failed: %v", err)
+	}
+	if !backup.Equal(live) {
+		t.Error("applying the diff did not reproduce the live filter")
+	}
+
+	// without a checkpoint the diff holds everything
+	fresh := NewTestBloomFilter(CAPACITY, ERRPCT)
+	diff.Reset()
+	live2 := NewTestBloomFilter(CAPACITY, ERRPCT)
+	live2.Insert([]byte("x"))
+	live2.SerializeDiff(&diff)
+	fresh.ApplyDiff(&diff)
+	if !fresh.Equal(live2) {
+		t.Error("diff without a checkpoint did not reproduce the filter")
+	}
+
+	diff.Reset()
+	live.SerializeDiff(&diff)
+	if err := NewTestBloomFilter(CAPACITY*4, ERRPCT).ApplyDiff(&diff); err == nil {
+		t.Error("ApplyDiff to a filter of a different size succeeded")
+	}
+
+	// a change count larger than the filter is rejected before it is read
+	huge := append([]byte(nil), diff.Bytes()[:16]...)
+	binary.BigEndian.PutUint32(huge[12:], math.MaxUint32)
+	if err := live.ApplyDiff(bytes.NewReader(huge)); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("ApplyDiff with %d changes: got %v, want ErrBadFormat", uint32(math.MaxUint32), err)
+	}
+}
+
+func TestMergeBytes(t *testing.T) {
+
+	a := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3})
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3})
+	for i := 0; i < 100; i++ {
+		a.Insert([]byte(fmt.Sprintf("a%d", i)))
+		b.Insert([]byte(fmt.Sprintf("b%d", i)))
+	}
+	data := mustMarshal(t, b)
+
+	want := new(bloomFilter2)
+	if err := want.UnmarshalBinary(mustMarshal(t, a)); err != nil {
+		t.Fatal(err)
+	}
+	if err := want.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.MergeBytes(data); err != nil {
+		t.Fatal(err)
+	}
+	if !a.Equal(want) || a.Len() != want.Len() {
+		t.Errorf("MergeBytes differs from Merge: %d elements, want %d", a.Len(), want.Len())
+	}
+
+	other := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{4, 5, 6})
+	before := mustMarshal(t, other)
+	if err := other.MergeBytes(data); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("different salts: got %v, want ErrIncompatible", err)
+	}
+	if !bytes.Equal(mustMarshal(t, other), before) {
+		t.Errorf("failed MergeBytes changed the filter")
+	}
+
+	damaged := append([]byte(nil), data...)
+	damaged[HeaderSize+20] ^= 1
+	if err := other.MergeBytes(damaged); !errors.Is(err, ErrCorruptData) {
+		t.Errorf("damaged data: got %v, want ErrCorruptData", err)
+	}
+	if err := other.MergeBytes(data[:HeaderSize]); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("truncated data: got %v, want ErrBadFormat", err)
+	}
+}
+
+func TestDumpHead(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3})
+	bf := b.(*bloomFilter2)
+	bf.Filter.set(32*3 + 4) // word 3 is 0x00000010
+
+	var buf bytes.Buffer
+	if err := b.DumpHead(&buf, 16); err != nil {
+		t.Fatal(err)
+	}
+	dump := buf.String()
+
+	for _, want := range []string{
+		fmt.Sprintf("capacity  %d\n", CAPACITY),
+		"salt 2    00000003\n",
+		"00000000  00000000 00000000 00000000 00000010 00000000 00000000 00000000 00000000\n",
+		"00000008  00000000",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("dump lacks %q:\n%s", want, dump)
+		}
+	}
+	if n := strings.Count(dump, "\n"); n != 9+3+2 {
+		t.Errorf("dump of 16 words has %d lines:\n%s", n, dump)
+	}
+
+	buf.Reset()
+	b.DumpHead(&buf, 1<<30)
+	if n := strings.Count(buf.String(), "\n"); n != 9+3+len(bf.Filter)/8 {
+		t.Errorf("dump of more words than the filter has %d lines", n)
+	}
+}
+
+func TestArchive(t *testing.T) {
+
+	a := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3})
+	b := NewWideBloomFilter(CAPACITY*4, 0.001, []uint32{4, 5, 6, 7})
+	c := NewPartitionedBloomFilter(100, 0.1, []uint32{8, 9})
+	for i, f := range []BloomFilter2{a, b, c} {
+		for j := 0; j < 50; j++ {
+			f.Insert([]byte(fmt.Sprintf("filter%d-%d", i, j)))
+		}
+	}
+	c.SetTag("shard-c")
+
+	var buf bytes.Buffer
+	if err := SerializeArchive(&buf, a, b, c); err != nil {
+		t.Fatal(err)
+	}
+	archive := append([]byte(nil), buf.Bytes()...)
+
+	got, err := DeserializeArchive(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("archive of 3 filters read back %d", len(got))
+	}
+	for i, want := range []BloomFilter2{a, b, c} {
+		if !got[i].Equal(want) || got[i].Tag() != want.Tag() {
+			t.Errorf("filter %d differs after the round trip", i)
+		}
+	}
+
+	buf.Reset()
+	if err := SerializeArchive(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := DeserializeArchive(&buf); err != nil || len(got) != 0 {
+		t.Errorf("empty archive read back %d filters (%v)", len(got), err)
+	}
+
+	if _, err := DeserializeArchive(bytes.NewReader(archive[:len(archive)-10])); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("truncated archive: got %v, want ErrBadFormat", err)
+	}
+	if _, err := DeserializeArchive(bytes.NewReader(archive[:8])); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("archive missing its filters: got %v, want ErrBadFormat", err)
+	}
+	if _, err := DeserializeArchive(strings.NewReader("DGB2....")); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("a single filter is not an archive: got %v", err)
+	}
+
+	damaged := append([]byte(nil), archive...)
+	damaged[len(damaged)-100] ^= 1
+	if _, err := DeserializeArchive(bytes.NewReader(damaged)); !errors.Is(err, ErrCorruptData) {
+		t.Errorf("damaged archive: got %v, want ErrCorruptData", err)
+	}
+}
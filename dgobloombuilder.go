@@ -0,0 +1,193 @@
+package dgobloom
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// maxBuilderSegments limits the number of spill files a Builder keeps open
+const maxBuilderSegments = 1024
+
+// builderBufferSize is the write buffer of each spill file
+const builderBufferSize = 4 << 10
+
+// Builder builds a bloom Filter over a stream of keys too large, or a Filter too large, to hold in memory.
+// The Filter is sized from the estimated Capacity up front.  If its bit vector fits in maxBytes the keys are inserted directly;
+// otherwise the bit vector is divided into segments of at most maxBytes, the bit indices of each key are appended to a spill file per segment,
+// and Finish builds the segments one at a time, so memory use stays near maxBytes plus a small buffer per segment.
+// The output of Finish is the binary format of MarshalBinary, identical to that of a Filter built in memory from the same keys.
+type Builder struct {
+	bf *bloomFilter2 // dimensions and salts; its bit vector is only allocated when the Filter fits in memory
+
+	segWords int // words per segment when spilling
+	files    []*os.File
+	spill    []*bufio.Writer
+}
+
+// NewBuilder returns a Builder for a bloom Filter of Capacity Elements at falsePositiveRate, salted with Salts as NewBloomFilter2 would be.
+// Spill files, if any are needed, are created in dir, or the default temporary directory if dir is empty; maxBytes of 0 or less never spills.
+func NewBuilder(Capacity uint32, falsePositiveRate float64, Salts []uint32, maxBytes int, dir string) (*Builder, error) {
+
+	bf := &bloomFilter2{
+		Capacity:          Capacity,
+		FalsePositiveRate: falsePositiveRate,
+		Bits:              FilterBits2(Capacity, falsePositiveRate),
+		Salts:             make([][]byte, len(Salts)),
+	}
+	for i, s := range Salts {
+		bf.Salts[i] = uint32ToByteArray2(s)
+	}
+
+	words := int(bf.Bits+31) / 32
+	b := &Builder{bf: bf}
+
+	if maxBytes <= 0 || 4*words <= maxBytes {
+		bf.Filter = newBitvector2(words)
+		return b, nil
+	}
+
+	// segment offsets are spilled as uint32 bit indices
+	b.segWords = maxBytes / 4
+	if b.segWords > 1<<27 {
+		b.segWords = 1 << 27
+	}
+	if b.segWords < 1 {
+		b.segWords = 1
+	}
+
+	segments := (words + b.segWords - 1) / b.segWords
+	if segments > maxBuilderSegments {
+		return nil, fmt.Errorf("dgobloom: a %d byte filter needs %d segments of %d bytes; at most %d are supported", 4*words, segments, maxBytes, maxBuilderSegments)
+	}
+
+	for i := 0; i < segments; i++ {
+		fp, err := os.CreateTemp(dir, "dgobloom-segment*")
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.files = append(b.files, fp)
+		b.spill = append(b.spill, bufio.NewWriterSize(fp, builderBufferSize))
+	}
+
+	return b, nil
+}
+
+// Add inserts key into the Filter being built.  Errors come from writing the spill files.
+func (b *Builder) Add(key []byte) error {
+
+	if b.bf.Filter != nil {
+		b.bf.Insert(key)
+		return nil
+	}
+
+	b.bf.Elements++
+
+	var buf [4]byte
+	segBits := uint64(b.segWords) * 32
+	for _, x := range b.bf.Indices(key) {
+		binary.BigEndian.PutUint32(buf[:], uint32(x%segBits))
+		if _, err := b.spill[x/segBits].Write(buf[:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Len returns the number of keys added.
+func (b *Builder) Len() uint32 { return b.bf.Elements }
+
+// Finish writes the bloom Filter to w in the binary format and removes the spill files.  The Builder cannot be used afterwards.
+func (b *Builder) Finish(w io.Writer) error {
+
+	defer b.Close()
+
+	if b.bf.Filter != nil {
+		data, err := b.bf.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
+	crc := crc32.New(castagnoli)
+	out := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	hdr := b.bf.header()
+	var p [HeaderSize]byte
+	hdr.put(p[:])
+	out.Write(p[:])
+
+	for _, s := range b.bf.Salts {
+		binary.BigEndian.PutUint32(p[:4], uint32(len(s)))
+		out.Write(p[:4])
+		out.Write(s)
+	}
+
+	words := int(hdr.words())
+	segment := newBitvector2(b.segWords)
+	for i, fp := range b.files {
+
+		if err := b.spill[i].Flush(); err != nil {
+			return err
+		}
+		if _, err := fp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		for j := range segment {
+			segment[j] = 0
+		}
+
+		r := bufio.NewReaderSize(fp, builderBufferSize)
+		for {
+			if _, err := io.ReadFull(r, p[:4]); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			segment.set(uint64(binary.BigEndian.Uint32(p[:4])))
+		}
+
+		n := words - i*b.segWords
+		if n > b.segWords {
+			n = b.segWords
+		}
+		for _, v := range segment[:n] {
+			binary.BigEndian.PutUint32(p[:4], v)
+			out.Write(p[:4])
+		}
+	}
+
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	binary.BigEndian.PutUint32(p[:4], crc.Sum32())
+	_, err := w.Write(p[:4])
+
+	return err
+}
+
+// Close removes the spill files of a Builder that will not be finished.
+func (b *Builder) Close() error {
+
+	var err error
+	for _, fp := range b.files {
+		if cerr := fp.Close(); err == nil {
+			err = cerr
+		}
+		if rerr := os.Remove(fp.Name()); err == nil {
+			err = rerr
+		}
+	}
+	b.files, b.spill = nil, nil
+
+	return err
+}
@@ -0,0 +1,67 @@
+package dgobloom
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+
+	const keys = 200000
+	salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+
+	reference := NewBloomFilter2(keys, ERRPCT, salts)
+	for i := 0; i < keys; i++ {
+		reference.Insert([]byte(fmt.Sprintf("stream-%d", i)))
+	}
+	want, _ := reference.MarshalBinary()
+
+	// unlimited memory, and segments of 16K against a filter of about 256K
+	for _, maxBytes := range []int{0, 16 << 10} {
+		dir := t.TempDir()
+		b, err := NewBuilder(keys, ERRPCT, salts, maxBytes, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if maxBytes > 0 && len(b.files) < 2 {
+			t.Fatalf("maxBytes %d: %d spill files", maxBytes, len(b.files))
+		}
+
+		for i := 0; i < keys; i++ {
+			if err := b.Add([]byte(fmt.Sprintf("stream-%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if b.Len() != keys {
+			t.Errorf("maxBytes %d: Len %d, want %d", maxBytes, b.Len(), keys)
+		}
+
+		var buf bytes.Buffer
+		if err := b.Finish(&buf); err != nil {
+			t.Fatalf("maxBytes %d: Finish: %v", maxBytes, err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("maxBytes %d: built filter differs from one built in memory", maxBytes)
+		}
+
+		var bf bloomFilter2
+		if err := bf.UnmarshalBinary(buf.Bytes()); err != nil {
+			t.Fatalf("maxBytes %d: %v", maxBytes, err)
+		}
+		for i := 0; i < keys; i += 997 {
+			if !bf.Exists([]byte(fmt.Sprintf("stream-%d", i))) {
+				t.Fatalf("maxBytes %d: stream-%d missing", maxBytes, i)
+			}
+		}
+
+		if left, _ := os.ReadDir(dir); len(left) != 0 {
+			t.Errorf("maxBytes %d: %d spill files left behind", maxBytes, len(left))
+		}
+	}
+
+	if _, err := NewBuilder(keys, ERRPCT, salts, 4, t.TempDir()); err == nil {
+		t.Error("a builder needing too many segments was created")
+	}
+}
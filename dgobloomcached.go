@@ -0,0 +1,248 @@
+package dgobloom
+
+import (
+	"container/list"
+	"io"
+	"sync"
+)
+
+// CachedBloomFilter wraps a bloom Filter with a small LRU cache of recent negative lookups, so repeated queries for the same absent keys skip hashing.
+// Only negatives are cached: a key that tests absent stays absent until it, or something else, is written, and every write through the wrapper invalidates what it might have made present.
+// Writes made to the inner Filter directly bypass the cache and can leave stale negatives; write only through the wrapper.
+// The cache has its own lock, so concurrent Exists calls are as safe as they are on the inner Filter.
+// Writes are not: the inner Filter is not safe for concurrent use, and a lookup that reads it before a write can store its negative after the write has invalidated the cache,
+// so writes concurrent with lookups need a lock around both, held by the caller.
+type CachedBloomFilter struct {
+	BloomFilter2
+
+	mu      sync.Mutex
+	size    int
+	order   *list.List               // most recently used first
+	entries map[string]*list.Element // values are the keys, as strings
+}
+
+// NewCachedBloomFilter returns inner wrapped with a cache of up to lruSize negative lookups.
+func NewCachedBloomFilter(inner BloomFilter2, lruSize int) *CachedBloomFilter {
+	return &CachedBloomFilter{
+		BloomFilter2: inner,
+		size:         lruSize,
+		order:        list.New(),
+		entries:      make(map[string]*list.Element, lruSize),
+	}
+}
+
+// Exists checks the cache and then the inner Filter for the byte array b, caching a negative result.
+func (c *CachedBloomFilter) Exists(b []byte) bool {
+
+	c.mu.Lock()
+	if e, ok := c.entries[string(b)]; ok {
+		c.order.MoveToFront(e)
+		c.mu.Unlock()
+		return false
+	}
+	c.mu.Unlock()
+
+	if c.BloomFilter2.Exists(b) {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[string(b)]; ok || c.size < 1 {
+		return false
+	}
+
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		delete(c.entries, oldest.Value.(string))
+		c.order.Remove(oldest)
+	}
+
+	key := string(b)
+	c.entries[key] = c.order.PushFront(key)
+
+	return false
+}
+
+// Query is Exists, answered through the cache.
+func (c *CachedBloomFilter) Query(b []byte) Membership { return membership(c.Exists(b)) }
+
+// unwrapCached returns the inner Filter of a CachedBloomFilter, and any other Filter unchanged
+func unwrapCached(f BloomFilter2) BloomFilter2 {
+	if c, ok := f.(*CachedBloomFilter); ok {
+		return c.BloomFilter2
+	}
+	return f
+}
+
+// forget removes the cached negative for b, if any
+func (c *CachedBloomFilter) forget(b []byte) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[string(b)]; ok {
+		delete(c.entries, string(b))
+		c.order.Remove(e)
+	}
+}
+
+// Purge empties the cache.
+func (c *CachedBloomFilter) Purge() {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.entries = make(map[string]*list.Element, c.size)
+}
+
+// CacheLen returns the number of negatives currently cached.
+func (c *CachedBloomFilter) CacheLen() int {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// Insert inserts b into the inner Filter and then drops its cached negative.
+func (c *CachedBloomFilter) Insert(b []byte) bool {
+	defer c.forget(b)
+	return c.BloomFilter2.Insert(b)
+}
+
+// InsertNew inserts b into the inner Filter and then drops its cached negative.
+func (c *CachedBloomFilter) InsertNew(b []byte) bool {
+	defer c.forget(b)
+	return c.BloomFilter2.InsertNew(b)
+}
+
+// InsertStrict inserts b into the inner Filter and then drops its cached negative.
+func (c *CachedBloomFilter) InsertStrict(b []byte) (bool, error) {
+	defer c.forget(b)
+	return c.BloomFilter2.InsertStrict(b)
+}
+
+// TouchAndMaybeInsert is TouchAndMaybeInsert of the inner Filter, dropping the cached negative for b since it may be inserted.
+func (c *CachedBloomFilter) TouchAndMaybeInsert(b []byte, p float64) bool {
+	defer c.forget(b)
+	return c.BloomFilter2.TouchAndMaybeInsert(b, p)
+}
+
+// The writes below can set bits for any key, so they empty the whole cache once the write is done.
+
+// InsertString inserts s into the inner Filter and then drops its cached negative.
+func (c *CachedBloomFilter) InsertString(s string) bool { return c.Insert([]byte(s)) }
+
+// ExistsString is Exists, answered through the cache.
+func (c *CachedBloomFilter) ExistsString(s string) bool { return c.Exists([]byte(s)) }
+
+// InsertAllParallel inserts into the inner Filter and then empties the cache.
+func (c *CachedBloomFilter) InsertAllParallel(items [][]byte, workers int) int {
+	defer c.Purge()
+	return c.BloomFilter2.InsertAllParallel(items, workers)
+}
+
+// InsertHash inserts into the inner Filter and empties the cache.
+func (c *CachedBloomFilter) InsertHash(h uint64) bool {
+	defer c.Purge()
+	return c.BloomFilter2.InsertHash(h)
+}
+
+// InsertUint64 inserts into the inner Filter and empties the cache.
+func (c *CachedBloomFilter) InsertUint64(x uint64) bool {
+	defer c.Purge()
+	return c.BloomFilter2.InsertUint64(x)
+}
+
+// Merge merges into the inner Filter and empties the cache.
+func (c *CachedBloomFilter) Merge(other BloomFilter2) error {
+	defer c.Purge()
+	return c.BloomFilter2.Merge(other)
+}
+
+// MergeFrom merges into the inner Filter and empties the cache.
+func (c *CachedBloomFilter) MergeFrom(r io.Reader) error {
+	defer c.Purge()
+	return c.BloomFilter2.MergeFrom(r)
+}
+
+// UnionWithOverlap merges into the inner Filter and empties the cache.
+func (c *CachedBloomFilter) UnionWithOverlap(other BloomFilter2, overlapEstimate uint32) error {
+	defer c.Purge()
+	return c.BloomFilter2.UnionWithOverlap(other, overlapEstimate)
+}
+
+// MergeBytes merges into the inner Filter and empties the cache.
+func (c *CachedBloomFilter) MergeBytes(data []byte) error {
+	defer c.Purge()
+	return c.BloomFilter2.MergeBytes(data)
+}
+
+// MergeParallel merges into the inner Filter and empties the cache.
+func (c *CachedBloomFilter) MergeParallel(other BloomFilter2, workers int) error {
+	defer c.Purge()
+	return c.BloomFilter2.MergeParallel(other, workers)
+}
+
+// Compress compresses the inner Filter and empties the cache.
+func (c *CachedBloomFilter) Compress() error {
+	defer c.Purge()
+	return c.BloomFilter2.Compress()
+}
+
+// CompressBy compresses the inner Filter and empties the cache.
+func (c *CachedBloomFilter) CompressBy(n int) error {
+	defer c.Purge()
+	return c.BloomFilter2.CompressBy(n)
+}
+
+// Clear empties the inner Filter and the cache.
+func (c *CachedBloomFilter) Clear() error {
+	defer c.Purge()
+	return c.BloomFilter2.Clear()
+}
+
+// Rotate rotates the inner Filter and empties the cache.
+func (c *CachedBloomFilter) Rotate(Salts []uint32) error {
+	defer c.Purge()
+	return c.BloomFilter2.Rotate(Salts)
+}
+
+// Repair repairs the inner Filter and empties the cache.
+func (c *CachedBloomFilter) Repair() error {
+	defer c.Purge()
+	return c.BloomFilter2.Repair()
+}
+
+// SetKey rekeys the inner Filter and empties the cache.
+func (c *CachedBloomFilter) SetKey(key []byte) error {
+	defer c.Purge()
+	return c.BloomFilter2.SetKey(key)
+}
+
+// SetPepper changes the pepper of the inner Filter and empties the cache.
+func (c *CachedBloomFilter) SetPepper(pepper []byte) error {
+	defer c.Purge()
+	return c.BloomFilter2.SetPepper(pepper)
+}
+
+// UnmarshalBinary decodes into the inner Filter and empties the cache.
+func (c *CachedBloomFilter) UnmarshalBinary(data []byte) error {
+	defer c.Purge()
+	return c.BloomFilter2.UnmarshalBinary(data)
+}
+
+// ApplyDiff applies a diff to the inner Filter and empties the cache.
+func (c *CachedBloomFilter) ApplyDiff(r io.Reader) error {
+	defer c.Purge()
+	return c.BloomFilter2.ApplyDiff(r)
+}
+
+// AppendSalt adds a salt to the inner Filter and empties the cache.
+func (c *CachedBloomFilter) AppendSalt(salt uint32) error {
+	defer c.Purge()
+	return c.BloomFilter2.AppendSalt(salt)
+}
@@ -0,0 +1,135 @@
+package dgobloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+// countingFilter counts the lookups that reach the wrapped Filter
+type countingFilter struct {
+	BloomFilter2
+	lookups int
+}
+
+func (cf *countingFilter) Exists(b []byte) bool {
+	cf.lookups++
+	return cf.BloomFilter2.Exists(b)
+}
+
+func TestCachedBloomFilter(t *testing.T) {
+
+	inner := &countingFilter{BloomFilter2: NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})}
+	c := NewCachedBloomFilter(inner, 10)
+
+	for i := 0; i < 100; i++ {
+		c.Insert([]byte(fmt.Sprintf("member-%d", i)))
+	}
+
+	// repeated negatives are answered from the cache
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 10; i++ {
+			if c.Exists([]byte(fmt.Sprintf("absent-%d", i))) {
+				t.Fatalf("absent-%d present", i)
+			}
+		}
+	}
+	if inner.lookups != 10 {
+		t.Errorf("%d lookups reached the filter, want 10", inner.lookups)
+	}
+
+	// positives are never cached
+	inner.lookups = 0
+	for round := 0; round < 3; round++ {
+		if !c.Exists([]byte("member-0")) {
+			t.Fatal("member-0 missing")
+		}
+	}
+	if inner.lookups != 3 || c.CacheLen() != 10 {
+		t.Errorf("%d lookups for a present key and %d cached, want 3 and 10", inner.lookups, c.CacheLen())
+	}
+
+	// an insert invalidates its key
+	c.Insert([]byte("absent-3"))
+	if !c.Exists([]byte("absent-3")) {
+		t.Error("inserted key still cached as absent")
+	}
+
+	// the least recently used entry is evicted
+	inner.lookups = 0
+	c.Exists([]byte("absent-10"))
+	c.Exists([]byte("absent-11"))
+	c.Exists([]byte("absent-0"))
+	if inner.lookups != 3 || c.CacheLen() != 10 {
+		t.Errorf("%d lookups and %d cached after eviction, want 3 and 10", inner.lookups, c.CacheLen())
+	}
+
+	// bulk writes empty the cache
+	other := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	other.Insert([]byte("absent-5"))
+	if err := c.Merge(other); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if c.CacheLen() != 0 || !c.Exists([]byte("absent-5")) {
+		t.Error("Merge did not invalidate the cache")
+	}
+
+	// the string helpers go through the cache too
+	if c.ExistsString("absent-6") {
+		t.Fatal("absent-6 present")
+	}
+	c.InsertString("absent-6")
+	if !c.ExistsString("absent-6") {
+		t.Error("key inserted with InsertString still cached as absent")
+	}
+
+	// a cached Filter can be merged into a plain one
+	if err := other.Merge(NewCachedBloomFilter(NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7}), 1)); err != nil {
+		t.Errorf("merging a cached filter: %v", err)
+	}
+}
+
+// racingFilter runs a lookup through the cache in the middle of each Insert, as a concurrent reader could
+type racingFilter struct {
+	BloomFilter2
+	cache *CachedBloomFilter
+}
+
+func (rf *racingFilter) Insert(b []byte) bool {
+	rf.cache.Exists(b)
+	return rf.BloomFilter2.Insert(b)
+}
+
+func TestCachedBloomFilterInsertRace(t *testing.T) {
+
+	inner := &racingFilter{BloomFilter2: NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3})}
+	c := NewCachedBloomFilter(inner, 10)
+	inner.cache = c
+
+	c.Insert([]byte("key"))
+	if !c.Exists([]byte("key")) {
+		t.Error("a lookup during Insert left a stale negative")
+	}
+}
+
+func TestCachedBloomFilterUnwrap(t *testing.T) {
+
+	inner := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3})
+	inner.Insert([]byte("key"))
+	c := NewCachedBloomFilter(inner, 10)
+
+	if !inner.Equal(c) || !c.Equal(inner) {
+		t.Error("a cached filter is not equal to its inner filter")
+	}
+	if diffs := inner.Compatibility(c); len(diffs) != 0 {
+		t.Errorf("a cached filter is incompatible with its inner filter: %v", diffs)
+	}
+
+	empty := EmptyLike(c)
+	if empty == nil || empty.Len() != 0 || empty.Exists([]byte("key")) || len(inner.Compatibility(empty)) != 0 {
+		t.Error("EmptyLike of a cached filter is not an empty copy of the inner filter")
+	}
+
+	if EmptyLike(&countingFilter{BloomFilter2: inner}) != nil {
+		t.Error("EmptyLike of a foreign filter type did not return nil")
+	}
+}
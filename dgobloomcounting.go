@@ -0,0 +1,520 @@
+package dgobloom
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// CountingBloomFilter is a bloom Filter that supports deletion by keeping a small counter in place of each bit.
+// Counters saturate at 255, or 15 after ReducePrecision; a saturated counter is never decremented, so deletes cannot cause false negatives.
+// Its methods are safe for concurrent use, so that StartDecay can age the counters while others insert.
+type CountingBloomFilter struct {
+	mu       sync.Mutex // guards the counters and element count
+	capacity uint32
+	fpr      float64 // configured false positive rate
+	buckets  uint64  // number of counters
+	counters []uint8 // one counter per bucket, or two per byte once nibbles is set
+	nibbles  bool    // counters are 4 bits wide, set by ReducePrecision
+	salts    [][]byte
+	meta     []byte   // big-endian element count; part of the mapping for file-backed Filters
+	file     *os.File // backing file, or nil
+	mapping  []byte   // the whole mapped file
+
+	decayMu   sync.Mutex
+	stopDecay context.CancelFunc // stops the goroutine started by StartDecay, or nil
+	decayDone chan struct{}      // closed when that goroutine exits
+}
+
+const maxCount = 255
+
+// maxNibbleCount is the largest value of a counter after ReducePrecision
+const maxNibbleCount = 15
+
+// NewCountingBloomFilter returns a new in-memory counting bloom Filter sized like NewBloomFilter2, with one counter in place of each bit.
+func NewCountingBloomFilter(Capacity uint32, falsePositiveRate float64, Salts []uint32) *CountingBloomFilter {
+
+	cbf := new(CountingBloomFilter)
+
+	cbf.capacity = Capacity
+	cbf.fpr = falsePositiveRate
+	cbf.buckets = FilterBits2(Capacity, falsePositiveRate)
+	cbf.counters = make([]uint8, cbf.buckets)
+	cbf.meta = make([]byte, 4)
+
+	cbf.salts = make([][]byte, len(Salts))
+	for i, s := range Salts {
+		cbf.salts[i] = uint32ToByteArray2(s)
+	}
+
+	return cbf
+}
+
+// Len returns the number of Elements currently stored in the Filter.
+func (cbf *CountingBloomFilter) Len() uint32 {
+	cbf.mu.Lock()
+	defer cbf.mu.Unlock()
+	return cbf.count()
+}
+
+func (cbf *CountingBloomFilter) count() uint32 { return binary.BigEndian.Uint32(cbf.meta) }
+
+func (cbf *CountingBloomFilter) setLen(n uint32) { binary.BigEndian.PutUint32(cbf.meta, n) }
+
+// Cap returns the Capacity of the Filter.
+func (cbf *CountingBloomFilter) Cap() uint32 { return cbf.capacity }
+
+// location returns the counter index for b hashed with salt s
+func (cbf *CountingBloomFilter) location(s []byte, b []byte) uint64 {
+	return uint64(fnv32(s, b)) % cbf.buckets
+}
+
+// counter returns the value of counter i
+func (cbf *CountingBloomFilter) counter(i uint64) uint8 {
+	if cbf.nibbles {
+		return cbf.counters[i/2] >> (4 * (i % 2)) & 0xf
+	}
+	return cbf.counters[i]
+}
+
+// setCounter sets counter i to c, which must fit its width
+func (cbf *CountingBloomFilter) setCounter(i uint64, c uint8) {
+	if cbf.nibbles {
+		shift := 4 * (i % 2)
+		cbf.counters[i/2] = cbf.counters[i/2]&^(0xf<<shift) | c<<shift
+		return
+	}
+	cbf.counters[i] = c
+}
+
+// saturated returns the value at which counters stop counting
+func (cbf *CountingBloomFilter) saturated() uint8 {
+	if cbf.nibbles {
+		return maxNibbleCount
+	}
+	return maxCount
+}
+
+// Insert inserts the byte array b into the Filter.
+// If the function returns false, the Capacity of the Filter has been reached.
+func (cbf *CountingBloomFilter) Insert(b []byte) bool {
+
+	cbf.mu.Lock()
+	defer cbf.mu.Unlock()
+
+	n := cbf.count() + 1
+	cbf.setLen(n)
+
+	for _, s := range cbf.salts {
+		i := cbf.location(s, b)
+		if c := cbf.counter(i); c < cbf.saturated() {
+			cbf.setCounter(i, c+1)
+		}
+	}
+
+	return n < cbf.capacity
+}
+
+// Exists checks the Filter for the byte array b.
+func (cbf *CountingBloomFilter) Exists(b []byte) bool {
+
+	cbf.mu.Lock()
+	defer cbf.mu.Unlock()
+
+	return cbf.exists(b)
+}
+
+func (cbf *CountingBloomFilter) exists(b []byte) bool {
+
+	for _, s := range cbf.salts {
+		if cbf.counter(cbf.location(s, b)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Delete removes one insertion of the byte array b from the Filter.
+// It returns false, and changes nothing, if b is not present.
+// Deleting an element that was never inserted but tests present, a false positive, removes other Elements; only delete what was inserted.
+func (cbf *CountingBloomFilter) Delete(b []byte) bool {
+
+	cbf.mu.Lock()
+	defer cbf.mu.Unlock()
+
+	if !cbf.exists(b) {
+		return false
+	}
+
+	for _, s := range cbf.salts {
+		i := cbf.location(s, b)
+		if c := cbf.counter(i); c < cbf.saturated() {
+			cbf.setCounter(i, c-1)
+		}
+	}
+
+	if n := cbf.count(); n > 0 {
+		cbf.setLen(n - 1)
+	}
+
+	return true
+}
+
+// Consume is Delete for at-most-once processing: it removes one insertion of b and returns true if b is present.
+// A false positive is consumed too, taking a count from other Elements, so consume only keys known to have been inserted.
+func (cbf *CountingBloomFilter) Consume(b []byte) bool { return cbf.Delete(b) }
+
+// StartDecay starts a goroutine that ages the Filter every interval until ctx is done or StopDecay is called, replacing any decay already running.
+// On each tick every nonzero counter, saturated or not, is decremented with probability rate, so an element that is not inserted again fades out after about 1/rate ticks per insertion.
+// This gives leaky-bucket membership: recent or repeated Elements test present and old ones are forgotten.
+// Decay causes false negatives by design, and Len is not adjusted, since the Filter cannot tell which Elements have faded.
+// An error is returned, and any running decay left alone, if interval is not positive.
+func (cbf *CountingBloomFilter) StartDecay(ctx context.Context, interval time.Duration, rate float64) error {
+
+	if interval <= 0 {
+		return fmt.Errorf("dgobloom: decay interval %v is not positive", interval)
+	}
+
+	// stopping and starting under one lock keeps concurrent calls from each starting a goroutine
+	cbf.decayMu.Lock()
+	defer cbf.decayMu.Unlock()
+
+	cbf.stopDecayLocked()
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	cbf.stopDecay, cbf.decayDone = cancel, done
+
+	go func() {
+		defer close(done)
+
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				cbf.decay(rnd, rate)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// StopDecay stops the goroutine started by StartDecay and waits for it to exit.  It does nothing if no decay is running.
+func (cbf *CountingBloomFilter) StopDecay() {
+
+	cbf.decayMu.Lock()
+	defer cbf.decayMu.Unlock()
+
+	cbf.stopDecayLocked()
+}
+
+// stopDecayLocked is StopDecay for callers holding decayMu
+func (cbf *CountingBloomFilter) stopDecayLocked() {
+
+	if cbf.stopDecay == nil {
+		return
+	}
+
+	cbf.stopDecay()
+	<-cbf.decayDone
+	cbf.stopDecay, cbf.decayDone = nil, nil
+}
+
+// decay decrements each nonzero counter with probability rate
+func (cbf *CountingBloomFilter) decay(rnd *rand.Rand, rate float64) {
+
+	cbf.mu.Lock()
+	defer cbf.mu.Unlock()
+
+	for i := uint64(0); i < cbf.buckets; i++ {
+		if c := cbf.counter(i); c != 0 && (rate >= 1 || rnd.Float64() < rate) {
+			cbf.setCounter(i, c-1)
+		}
+	}
+}
+
+// ReducePrecision halves the memory of an in-memory counting Filter by packing its counters into 4 bits each, two to a byte.
+// Counters above 15 are clamped to 15, which is then the saturation point: a clamped or saturated counter is never decremented, so membership is preserved and deletes still cannot cause false negatives.
+// Deletes do become less effective, since many more counters saturate and every element touching one keeps testing present after it is deleted.
+// It does nothing if the counters are already reduced, and returns an error for file-backed Filters, whose layout is fixed.
+func (cbf *CountingBloomFilter) ReducePrecision() error {
+
+	cbf.mu.Lock()
+	defer cbf.mu.Unlock()
+
+	if cbf.file != nil {
+		return errors.New("dgobloom: cannot reduce the precision of a file-backed counting filter")
+	}
+	if cbf.nibbles {
+		return nil
+	}
+
+	packed := make([]uint8, (cbf.buckets+1)/2)
+	for i := uint64(0); i < cbf.buckets; i++ {
+		c := cbf.counters[i]
+		if c > maxNibbleCount {
+			c = maxNibbleCount
+		}
+		packed[i/2] |= c << (4 * (i % 2))
+	}
+
+	cbf.counters = packed
+	cbf.nibbles = true
+
+	return nil
+}
+
+// MergeCounts adds each counter of other to the matching counter of cbf, so that an element inserted n times across the two tests with count n,
+// for aggregating per-shard counting Filters.  Sums saturate at the counter width of cbf, and a saturated counter in either Filter stays saturated,
+// so deletes after a merge still cannot cause false negatives.  Len becomes the sum of the two, saturating at math.MaxUint32.
+// ErrIncompatible is returned, and cbf left unchanged, if the Filters do not have the same number of counters and the same salts; their counter widths may differ.
+// A file-backed cbf is changed in place, as by Insert.
+func (cbf *CountingBloomFilter) MergeCounts(other *CountingBloomFilter) error {
+
+	// copy other first, so the two locks are never held together and a Filter can be merged into itself
+	other.mu.Lock()
+	buckets, salts, elements := other.buckets, other.salts, other.count()
+	counts := make([]uint8, other.buckets)
+	for i := range counts {
+		counts[i] = other.counter(uint64(i))
+	}
+	otherMax := other.saturated()
+	other.mu.Unlock()
+
+	cbf.mu.Lock()
+	defer cbf.mu.Unlock()
+
+	if buckets != cbf.buckets || len(salts) != len(cbf.salts) {
+		return fmt.Errorf("%w: %d counters and %d salts, want %d and %d", ErrIncompatible, buckets, len(salts), cbf.buckets, len(cbf.salts))
+	}
+	for i, s := range salts {
+		if !bytes.Equal(s, cbf.salts[i]) {
+			return fmt.Errorf("%w: salt %d differs", ErrIncompatible, i)
+		}
+	}
+
+	limit := cbf.saturated()
+	for i, c := range counts {
+		have := cbf.counter(uint64(i))
+		sum := uint(have) + uint(c)
+		if have == limit || c == otherMax || sum > uint(limit) {
+			sum = uint(limit)
+		}
+		cbf.setCounter(uint64(i), uint8(sum))
+	}
+
+	n := uint64(cbf.count()) + uint64(elements)
+	if n > math.MaxUint32 {
+		n = math.MaxUint32
+	}
+	cbf.setLen(uint32(n))
+
+	return nil
+}
+
+/*
+A file-backed counting Filter is laid out as, with all integers big-endian:
+
+	magic    [4]byte "DGBC"
+	elements uint32
+	capacity uint32
+	salts    uint32   number of salts
+	buckets  uint64
+	salts             4 bytes each
+	counters          one byte per bucket
+*/
+
+var countingMagic = [4]byte{'D', 'G', 'B', 'C'}
+
+const countingHeaderSize = 24
+
+// ErrMmapUnsupported is returned by OpenCountingBloomFilter on platforms without mmap.
+var ErrMmapUnsupported = errors.New("dgobloom: memory-mapped filters are not supported on this platform")
+
+// OpenCountingBloomFilter opens the counting bloom Filter stored in the file at path, creating it if it does not exist.
+// The counters are memory-mapped, so Insert and Delete change the file directly and survive restarts without explicit serialization; call Sync to make them durable and Close when done.
+// A new file is sized for Capacity and falsePositiveRate with freshly generated salts, which are stored in the file.
+// An existing file must have been created with the same Capacity and false positive rate.
+func OpenCountingBloomFilter(path string, Capacity uint32, falsePositiveRate float64) (*CountingBloomFilter, error) {
+
+	buckets := FilterBits2(Capacity, falsePositiveRate)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if fi.Size() == 0 {
+		err = initCountingFile(f, Capacity, buckets, SaltsRequired2(Capacity, falsePositiveRate))
+		if err == nil {
+			fi, err = f.Stat()
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	if fi.Size() < countingHeaderSize {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s is too short", ErrBadFormat, path)
+	}
+
+	mapping, err := mmapFile(f, int(fi.Size()))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	cbf, err := mapCountingFilter(mapping, Capacity, buckets)
+	if err != nil {
+		munmapFile(mapping)
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	cbf.fpr = falsePositiveRate
+	cbf.file = f
+	cbf.mapping = mapping
+
+	return cbf, nil
+}
+
+// initCountingFile writes the header and zeroed counters of a new counting Filter file
+func initCountingFile(f *os.File, Capacity uint32, buckets uint64, nsalts uint) error {
+
+	hdr := make([]byte, countingHeaderSize+4*nsalts)
+	copy(hdr, countingMagic[:])
+	binary.BigEndian.PutUint32(hdr[8:], Capacity)
+	binary.BigEndian.PutUint32(hdr[12:], uint32(nsalts))
+	binary.BigEndian.PutUint64(hdr[16:], buckets)
+	for i := uint(0); i < nsalts; i++ {
+		binary.BigEndian.PutUint32(hdr[countingHeaderSize+4*i:], rand.Uint32())
+	}
+
+	if _, err := f.WriteAt(hdr, 0); err != nil {
+		return err
+	}
+
+	if err := f.Truncate(int64(len(hdr)) + int64(buckets)); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// mapCountingFilter interprets a mapped counting Filter file
+func mapCountingFilter(mapping []byte, Capacity uint32, buckets uint64) (*CountingBloomFilter, error) {
+
+	if string(mapping[:4]) != string(countingMagic[:]) {
+		return nil, ErrBadFormat
+	}
+
+	cbf := new(CountingBloomFilter)
+	cbf.capacity = binary.BigEndian.Uint32(mapping[8:])
+	nsalts := uint64(binary.BigEndian.Uint32(mapping[12:]))
+	cbf.buckets = binary.BigEndian.Uint64(mapping[16:])
+
+	if cbf.capacity != Capacity || cbf.buckets != buckets {
+		return nil, fmt.Errorf("%w: file has capacity %d and %d counters, want %d and %d", ErrIncompatible, cbf.capacity, cbf.buckets, Capacity, buckets)
+	}
+
+	if uint64(len(mapping)) != countingHeaderSize+4*nsalts+cbf.buckets {
+		return nil, fmt.Errorf("%w: file is %d bytes, want %d", ErrBadFormat, len(mapping), countingHeaderSize+4*nsalts+cbf.buckets)
+	}
+
+	cbf.meta = mapping[4:8]
+	cbf.salts = make([][]byte, nsalts)
+	for i := range cbf.salts {
+		cbf.salts[i] = mapping[countingHeaderSize+4*i : countingHeaderSize+4*i+4]
+	}
+	cbf.counters = mapping[countingHeaderSize+4*nsalts:]
+
+	return cbf, nil
+}
+
+// Sync flushes the counters of a file-backed Filter to disk.  It does nothing for in-memory Filters.
+func (cbf *CountingBloomFilter) Sync() error {
+	if cbf.file == nil {
+		return nil
+	}
+	return cbf.file.Sync()
+}
+
+// Close stops any decay, then syncs and unmaps a file-backed Filter.  The Filter must not be used afterwards.
+func (cbf *CountingBloomFilter) Close() error {
+
+	cbf.StopDecay()
+
+	if cbf.file == nil {
+		return nil
+	}
+
+	err := cbf.file.Sync()
+	if uerr := munmapFile(cbf.mapping); err == nil {
+		err = uerr
+	}
+	if cerr := cbf.file.Close(); err == nil {
+		err = cerr
+	}
+
+	cbf.file = nil
+	cbf.mapping = nil
+	cbf.counters = nil
+
+	return err
+}
+
+// Compact returns a standard bloom Filter holding the Elements currently in the counting Filter, shrunk to the smallest size that keeps the configured false positive rate for the current Len.
+// Every nonzero counter becomes a set bit, and the bit vector is then folded in half, as by Compress, until it is right-sized.
+// The result has different dimensions from the counting Filter, can no longer delete, and uses the same salts.
+func (cbf *CountingBloomFilter) Compact() BloomFilter2 {
+
+	cbf.mu.Lock()
+	defer cbf.mu.Unlock()
+
+	target := FilterBits2(cbf.count(), cbf.fpr)
+
+	bf := new(bloomFilter2)
+	bf.Capacity = cbf.capacity
+	bf.Elements = cbf.count()
+	bf.FalsePositiveRate = cbf.fpr
+	bf.Bits = cbf.buckets
+	bf.Filter = newBitvector2(int(cbf.buckets+31) / 32)
+	bf.Salts = make([][]byte, len(cbf.salts))
+	for i, s := range cbf.salts {
+		bf.Salts[i] = append([]byte(nil), s...)
+	}
+
+	for i := uint64(0); i < cbf.buckets; i++ {
+		if cbf.counter(i) != 0 {
+			bf.Filter.set(i)
+		}
+	}
+
+	for bf.Bits > target && len(bf.Filter) > 1 {
+		bf.Compress()
+	}
+
+	return bf
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package dgobloom
+
+import "os"
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, ErrMmapUnsupported
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
@@ -0,0 +1,415 @@
+package dgobloom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCountingBloomFilter(t *testing.T) {
+
+	cbf := NewCountingBloomFilter(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+
+	for i := 0; i < 1000; i++ {
+		cbf.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	for i := 0; i < 1000; i += 2 {
+		if !cbf.Delete([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("Delete of key-%d failed", i)
+		}
+	}
+
+	if cbf.Len() != 500 {
+		t.Errorf("Len=%d after deletes, want 500", cbf.Len())
+	}
+
+	present := 0
+	for i := 0; i < 1000; i++ {
+		exists := cbf.Exists([]byte(fmt.Sprintf("key-%d", i)))
+		if i%2 == 1 && !exists {
+			t.Fatalf("key-%d lost after deleting others", i)
+		}
+		if i%2 == 0 && exists {
+			present++
+		}
+	}
+	if present > 10 {
+		t.Errorf("%d of 500 deleted keys still present", present)
+	}
+
+	if cbf.Delete([]byte("never inserted")) {
+		t.Error("Delete of an absent key succeeded")
+	}
+}
+
+func TestOpenCountingBloomFilter(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "counting.dgbc")
+
+	cbf, err := OpenCountingBloomFilter(path, CAPACITY, ERRPCT)
+	if err == ErrMmapUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("OpenCountingBloomFilter failed: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		cbf.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	cbf.Delete([]byte("key-0"))
+	if err := cbf.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if err := cbf.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	cbf, err = OpenCountingBloomFilter(path, CAPACITY, ERRPCT)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer cbf.Close()
+
+	if cbf.Len() != 99 {
+		t.Errorf("reopened Len=%d, want 99", cbf.Len())
+	}
+	if cbf.Exists([]byte("key-0")) {
+		t.Error("deleted key present after reopen")
+	}
+	for i := 1; i < 100; i++ {
+		if !cbf.Exists([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("key-%d lost after reopen", i)
+		}
+	}
+
+	if _, err := OpenCountingBloomFilter(path, CAPACITY*4, ERRPCT); err == nil {
+		t.Error("reopening with a different capacity succeeded")
+	}
+}
+
+func TestCompact(t *testing.T) {
+
+	cbf := NewCountingBloomFilter(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+
+	for i := 0; i < CAPACITY; i++ {
+		cbf.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	for i := 1000; i < CAPACITY; i++ {
+		cbf.Delete([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	bf := cbf.Compact()
+
+	if bf.Len() != 1000 {
+		t.Errorf("compacted Len=%d, want 1000", bf.Len())
+	}
+	if bits := bf.(*bloomFilter2).Bits; bits != FilterBits2(1000, ERRPCT) {
+		t.Errorf("compacted filter has %d bits, want %d", bits, FilterBits2(1000, ERRPCT))
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !bf.Exists([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("remaining key-%d missing after Compact", i)
+		}
+	}
+
+	fp := 0
+	for i := 0; i < 10000; i++ {
+		if bf.Exists([]byte(fmt.Sprintf("other-%d", i))) {
+			fp++
+		}
+	}
+	t.Log("compacted false positive rate:", float64(fp)/10000)
+	if float64(fp)/10000 > 2*ERRPCT {
+		t.Errorf("compacted false positive rate %f", float64(fp)/10000)
+	}
+}
+
+func TestCountingBloomFilterDecay(t *testing.T) {
+
+	cbf := NewCountingBloomFilter(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	for i := 0; i < 100; i++ {
+		cbf.Insert([]byte(fmt.Sprintf("old-%d", i)))
+	}
+
+	total := func() int {
+		cbf.mu.Lock()
+		defer cbf.mu.Unlock()
+		n := 0
+		for _, c := range cbf.counters {
+			n += int(c)
+		}
+		return n
+	}
+	before := total()
+
+	if err := cbf.StartDecay(context.Background(), time.Millisecond, 0.5); err != nil {
+		t.Fatal(err)
+	}
+
+	// inserts carry on while the counters decay
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			cbf.Insert([]byte(fmt.Sprintf("new-%d", i)))
+			cbf.Exists([]byte(fmt.Sprintf("old-%d", i%100)))
+		}
+	}()
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for total() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("counter total %d after decaying for 5s, started at %d", total(), before)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cbf.StopDecay()
+	cbf.StopDecay() // stopping twice is harmless
+
+	for i := 0; i < 100; i++ {
+		if cbf.Exists([]byte(fmt.Sprintf("old-%d", i))) {
+			t.Fatalf("old-%d present after its counters decayed", i)
+		}
+	}
+
+	// stopped decay leaves new inserts alone, and a cancelled context stops it too
+	cbf.Insert([]byte("kept"))
+	time.Sleep(5 * time.Millisecond)
+	if !cbf.Exists([]byte("kept")) {
+		t.Error("counters decayed after StopDecay")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cbf.StartDecay(ctx, time.Millisecond, 1)
+	cancel()
+	cbf.StopDecay()
+
+	// concurrent starts leave a single decay, which StopDecay ends
+	var starts sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		starts.Add(1)
+		go func() {
+			defer starts.Done()
+			cbf.StartDecay(context.Background(), time.Millisecond, 1)
+		}()
+	}
+	starts.Wait()
+	cbf.StopDecay()
+
+	cbf.Insert([]byte("kept"))
+	time.Sleep(20 * time.Millisecond)
+	if !cbf.Exists([]byte("kept")) {
+		t.Error("a decay started concurrently outlived StopDecay")
+	}
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if err := cbf.StartDecay(context.Background(), interval, 0.5); err == nil {
+			t.Errorf("StartDecay with interval %v succeeded", interval)
+		}
+	}
+}
+
+func TestCountingBloomFilterConsume(t *testing.T) {
+
+	cbf := NewCountingBloomFilter(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+
+	for i := 0; i < 1000; i++ {
+		cbf.Insert([]byte(fmt.Sprintf("job-%d", i)))
+	}
+	// queued twice, so consumable twice
+	cbf.Insert([]byte("job-0"))
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("job-%d", i))
+		if !cbf.Consume(key) {
+			t.Fatalf("first Consume of %s failed", key)
+		}
+		if i == 0 && !cbf.Consume(key) {
+			t.Fatal("second Consume of a key inserted twice failed")
+		}
+		if cbf.Consume(key) {
+			t.Fatalf("%s consumed again", key)
+		}
+	}
+
+	if cbf.Len() != 0 {
+		t.Errorf("Len=%d after consuming everything", cbf.Len())
+	}
+}
+
+func TestCountingBloomFilterReducePrecision(t *testing.T) {
+
+	cbf := NewCountingBloomFilter(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	for i := 0; i < 1000; i++ {
+		cbf.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	for i := 0; i < 40; i++ {
+		cbf.Insert([]byte("hot"))
+	}
+	cbf.Insert([]byte("twice"))
+	cbf.Insert([]byte("twice"))
+
+	before := make([]uint8, cbf.buckets)
+	copy(before, cbf.counters)
+
+	if err := cbf.ReducePrecision(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cbf.counters) != int(cbf.buckets+1)/2 {
+		t.Errorf("%d bytes of counters for %d buckets after ReducePrecision", len(cbf.counters), cbf.buckets)
+	}
+
+	for i, c := range before {
+		want := c
+		if want > maxNibbleCount {
+			want = maxNibbleCount
+		}
+		if got := cbf.counter(uint64(i)); got != want {
+			t.Fatalf("counter %d is %d after ReducePrecision, was %d", i, got, c)
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !cbf.Exists([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("key-%d lost by ReducePrecision", i)
+		}
+	}
+
+	// clamped counters are saturated, so the hot key cannot be deleted away
+	for i := 0; i < 40; i++ {
+		cbf.Delete([]byte("hot"))
+	}
+	if !cbf.Exists([]byte("hot")) {
+		t.Error("hot key deleted past its clamped counters")
+	}
+
+	// unsaturated counters still count
+	if !cbf.Delete([]byte("twice")) || !cbf.Exists([]byte("twice")) {
+		t.Error("first delete of a key inserted twice removed it")
+	}
+
+	if err := cbf.ReducePrecision(); err != nil {
+		t.Errorf("second ReducePrecision: %v", err)
+	}
+
+	mapped, err := OpenCountingBloomFilter(filepath.Join(t.TempDir(), "counting.dgbc"), CAPACITY, ERRPCT)
+	if err == ErrMmapUnsupported {
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mapped.Close()
+	if err := mapped.ReducePrecision(); err == nil {
+		t.Error("ReducePrecision of a file-backed filter succeeded")
+	}
+}
+
+func TestCountingBloomFilterMergeCounts(t *testing.T) {
+
+	Salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+	a := NewCountingBloomFilter(CAPACITY, ERRPCT, Salts)
+	b := NewCountingBloomFilter(CAPACITY, ERRPCT, Salts)
+
+	for i := 0; i < 500; i++ {
+		a.Insert([]byte(fmt.Sprintf("a-%d", i)))
+		b.Insert([]byte(fmt.Sprintf("b-%d", i)))
+	}
+	a.Insert([]byte("shared"))
+	b.Insert([]byte("shared"))
+	b.Insert([]byte("shared"))
+	for i := 0; i < 200; i++ {
+		a.Insert([]byte("hot"))
+		b.Insert([]byte("hot"))
+	}
+
+	want := make([]int, a.buckets)
+	for i := range want {
+		want[i] = int(a.counter(uint64(i))) + int(b.counter(uint64(i)))
+		if want[i] > maxCount {
+			want[i] = maxCount
+		}
+	}
+
+	if err := a.MergeCounts(b); err != nil {
+		t.Fatalf("MergeCounts failed: %v", err)
+	}
+
+	for i, c := range want {
+		if got := a.counter(uint64(i)); int(got) != c {
+			t.Fatalf("counter %d is %d after the merge, want %d", i, got, c)
+		}
+	}
+	if a.Len() != 1403 {
+		t.Errorf("Len after the merge = %d, want 1403", a.Len())
+	}
+
+	for i := 0; i < 500; i++ {
+		if !a.Exists([]byte(fmt.Sprintf("a-%d", i))) || !a.Exists([]byte(fmt.Sprintf("b-%d", i))) {
+			t.Fatalf("key %d lost by the merge", i)
+		}
+	}
+
+	// the shared key was inserted three times in all, so it survives two deletes and not a third
+	for i := 0; i < 3; i++ {
+		if !a.Exists([]byte("shared")) || !a.Delete([]byte("shared")) {
+			t.Fatalf("delete %d of the shared key failed", i+1)
+		}
+	}
+	if a.Exists([]byte("shared")) {
+		t.Error("shared key present after three deletes")
+	}
+
+	// 400 inserts saturate the hot key's counters, which deletes no longer move
+	for _, s := range a.salts {
+		if c := a.counter(a.location(s, []byte("hot"))); c != maxCount {
+			t.Errorf("hot counter is %d, want %d", c, maxCount)
+		}
+	}
+	for i := 0; i < 400; i++ {
+		a.Delete([]byte("hot"))
+	}
+	if !a.Exists([]byte("hot")) {
+		t.Error("saturated hot key deleted")
+	}
+
+	// sums saturate at the narrower width of a reduced Filter
+	c := NewCountingBloomFilter(CAPACITY, ERRPCT, Salts)
+	c.ReducePrecision()
+	for i := 0; i < 10; i++ {
+		c.Insert([]byte("warm"))
+		b.Insert([]byte("warm"))
+	}
+	if err := c.MergeCounts(b); err != nil {
+		t.Fatalf("MergeCounts into a reduced filter failed: %v", err)
+	}
+	for _, s := range c.salts {
+		if got := c.counter(c.location(s, []byte("warm"))); got != maxNibbleCount {
+			t.Errorf("warm counter is %d, want %d", got, maxNibbleCount)
+		}
+	}
+
+	if err := a.MergeCounts(NewCountingBloomFilter(CAPACITY, ERRPCT, []uint32{9, 8, 7, 6, 5, 4, 3})); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("merge with different salts: got %v, want ErrIncompatible", err)
+	}
+	if err := a.MergeCounts(NewCountingBloomFilter(CAPACITY*2, ERRPCT, Salts)); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("merge with a different size: got %v, want ErrIncompatible", err)
+	}
+
+	// a Filter merged into itself doubles
+	d := NewCountingBloomFilter(CAPACITY, ERRPCT, Salts)
+	d.Insert([]byte("self"))
+	if err := d.MergeCounts(d); err != nil || d.Len() != 2 || !d.Delete([]byte("self")) || !d.Exists([]byte("self")) {
+		t.Errorf("self merge: err %v, Len %d", err, d.Len())
+	}
+}
@@ -0,0 +1,188 @@
+package dgobloom
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/rand"
+)
+
+const (
+	cuckooBucketSize = 4   // fingerprints per bucket
+	cuckooMaxKicks   = 500 // relocations before an insert gives up
+)
+
+// ErrFull is returned when an element cannot be inserted into a CuckooFilter.
+var ErrFull = errors.New("dgobloom: filter is full")
+
+// CuckooFilter is an alternative to a counting bloom Filter that supports deletion while using less space at low false positive rates.
+// It stores a short fingerprint of each element in one of two candidate buckets, moving existing fingerprints between their candidates ("kicking") to make room.
+// Like a counting Filter, only elements that were inserted may be deleted.
+type CuckooFilter struct {
+	buckets  [][cuckooBucketSize]uint16
+	mask     uint64 // number of buckets - 1
+	fpMask   uint16 // fingerprint width
+	elements uint32
+	victim   uint16 // fingerprint evicted by a failed insert, or 0
+	victimAt uint64 // a candidate bucket of the victim
+	rnd      *rand.Rand
+}
+
+// NewCuckooFilter returns a new cuckoo Filter holding up to Capacity elements with about the given false positive rate.
+// Fingerprints are up to 16 bits wide, which bounds the false positive rate from below at about 1e-4.
+func NewCuckooFilter(Capacity uint32, falsePositiveRate float64) *CuckooFilter {
+
+	cf := new(CuckooFilter)
+
+	// buckets fill to about 95% before inserts start failing
+	n := nextPowerOfTwo2(uint64(float64(Capacity)/(0.95*cuckooBucketSize)) + 1)
+	cf.buckets = make([][cuckooBucketSize]uint16, n)
+	cf.mask = n - 1
+
+	// a lookup compares against 2*cuckooBucketSize fingerprints
+	bits := math.Ceil(math.Log2(2 * cuckooBucketSize / falsePositiveRate))
+	if bits > 16 {
+		bits = 16
+	}
+	if bits < 4 {
+		bits = 4
+	}
+	cf.fpMask = uint16(1<<uint(bits) - 1)
+
+	cf.rnd = rand.New(rand.NewSource(1))
+
+	return cf
+}
+
+// Len returns the number of elements currently stored in the Filter.
+func (cf *CuckooFilter) Len() uint32 { return cf.elements }
+
+// fingerprint returns the nonzero fingerprint of b and its first candidate bucket
+func (cf *CuckooFilter) fingerprint(b []byte) (uint16, uint64) {
+	h := fnv.New64a()
+	h.Write(b)
+	x := fmix64(h.Sum64())
+
+	fp := uint16(x>>48) & cf.fpMask
+	if fp == 0 {
+		fp = 1
+	}
+
+	return fp, x & cf.mask
+}
+
+// alternate returns the other candidate bucket for fingerprint fp in bucket i
+func (cf *CuckooFilter) alternate(i uint64, fp uint16) uint64 {
+	return (i ^ fmix64(uint64(fp))) & cf.mask
+}
+
+func (cf *CuckooFilter) add(i uint64, fp uint16) bool {
+	for j, v := range cf.buckets[i] {
+		if v == 0 {
+			cf.buckets[i][j] = fp
+			return true
+		}
+	}
+	return false
+}
+
+func (cf *CuckooFilter) remove(i uint64, fp uint16) bool {
+	for j, v := range cf.buckets[i] {
+		if v == fp {
+			cf.buckets[i][j] = 0
+			return true
+		}
+	}
+	return false
+}
+
+func (cf *CuckooFilter) contains(i uint64, fp uint16) bool {
+	for _, v := range cf.buckets[i] {
+		if v == fp {
+			return true
+		}
+	}
+	return false
+}
+
+// Insert adds the byte array b to the Filter.
+// ErrFull is returned if no room could be made after cuckooMaxKicks relocations; the Filter is then full and further inserts fail until something is deleted.
+func (cf *CuckooFilter) Insert(b []byte) error {
+
+	if cf.victim != 0 {
+		return ErrFull
+	}
+
+	fp, i1 := cf.fingerprint(b)
+	i2 := cf.alternate(i1, fp)
+
+	if cf.add(i1, fp) || cf.add(i2, fp) {
+		cf.elements++
+		return nil
+	}
+
+	i := i1
+	if cf.rnd.Intn(2) == 1 {
+		i = i2
+	}
+
+	for kick := 0; kick < cuckooMaxKicks; kick++ {
+		j := cf.rnd.Intn(cuckooBucketSize)
+		fp, cf.buckets[i][j] = cf.buckets[i][j], fp
+		i = cf.alternate(i, fp)
+		if cf.add(i, fp) {
+			cf.elements++
+			return nil
+		}
+	}
+
+	// keep the last evicted fingerprint so nothing already stored is lost
+	cf.victim = fp
+	cf.victimAt = i
+	cf.elements++
+
+	return ErrFull
+}
+
+// Exists checks the Filter for the byte array b.
+func (cf *CuckooFilter) Exists(b []byte) bool {
+
+	fp, i1 := cf.fingerprint(b)
+	i2 := cf.alternate(i1, fp)
+
+	if cf.contains(i1, fp) || cf.contains(i2, fp) {
+		return true
+	}
+
+	return cf.victim == fp && (cf.victimAt == i1 || cf.victimAt == i2)
+}
+
+// Delete removes one insertion of the byte array b and reports whether it was found.
+// Deleting an element that was never inserted may remove another element with the same fingerprint.
+func (cf *CuckooFilter) Delete(b []byte) bool {
+
+	fp, i1 := cf.fingerprint(b)
+	i2 := cf.alternate(i1, fp)
+
+	switch {
+	case cf.remove(i1, fp) || cf.remove(i2, fp):
+	case cf.victim == fp && (cf.victimAt == i1 || cf.victimAt == i2):
+		cf.victim = 0
+		cf.elements--
+		return true
+	default:
+		return false
+	}
+
+	cf.elements--
+
+	// there is room again for the victim
+	if cf.victim != 0 {
+		fp, i := cf.victim, cf.victimAt
+		if cf.add(i, fp) || cf.add(cf.alternate(i, fp), fp) {
+			cf.victim = 0
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,88 @@
+package dgobloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCuckooFilter(t *testing.T) {
+
+	cf := NewCuckooFilter(CAPACITY, ERRPCT)
+
+	for i := 0; i < CAPACITY; i++ {
+		if err := cf.Insert([]byte(fmt.Sprintf("key-%d", i))); err != nil {
+			t.Fatalf("insert %d failed: %v", i, err)
+		}
+	}
+
+	for i := 0; i < CAPACITY; i += 2 {
+		if !cf.Delete([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("Delete of key-%d failed", i)
+		}
+	}
+
+	if cf.Len() != CAPACITY/2 {
+		t.Errorf("Len=%d, want %d", cf.Len(), CAPACITY/2)
+	}
+
+	deleted := 0
+	for i := 0; i < CAPACITY; i++ {
+		exists := cf.Exists([]byte(fmt.Sprintf("key-%d", i)))
+		if i%2 == 1 && !exists {
+			t.Fatalf("key-%d lost", i)
+		}
+		if i%2 == 0 && exists {
+			deleted++
+		}
+	}
+
+	fp := 0
+	for i := 0; i < 20000; i++ {
+		if cf.Exists([]byte(fmt.Sprintf("other-%d", i))) {
+			fp++
+		}
+	}
+
+	t.Log(deleted, "deleted keys still present; false positive rate", float64(fp)/20000)
+	if float64(fp)/20000 > ERRPCT {
+		t.Errorf("false positive rate %f above %f", float64(fp)/20000, ERRPCT)
+	}
+
+	if cf.Delete([]byte("never inserted")) {
+		t.Error("Delete of an absent key succeeded")
+	}
+}
+
+func TestCuckooFilterFull(t *testing.T) {
+
+	cf := NewCuckooFilter(100, ERRPCT)
+
+	var err error
+	n := 0
+	for ; n < 10000 && err == nil; n++ {
+		err = cf.Insert([]byte(fmt.Sprintf("key-%d", n)))
+	}
+
+	if err != ErrFull {
+		t.Fatalf("inserting %d elements into a filter for 100: got %v, want ErrFull", n, err)
+	}
+	t.Log("filter for 100 filled after", n, "inserts")
+
+	// nothing inserted before the failure is lost, including the evicted victim
+	for i := 0; i < n; i++ {
+		if !cf.Exists([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("key-%d lost when the filter filled", i)
+		}
+	}
+
+	if cf.Insert([]byte("more")) != ErrFull {
+		t.Error("a full filter accepted an insert")
+	}
+
+	for i := 0; i < n/2; i++ {
+		cf.Delete([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	if err := cf.Insert([]byte("more")); err != nil {
+		t.Errorf("insert after deletes: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package dgobloom
+
+// deletableRegion is the number of bits covered by one collision bit of a DeletableBloomFilter
+const deletableRegion = 8
+
+// DeletableBloomFilter is a bloom Filter with approximate deletion at a fraction of the memory of a CountingBloomFilter.
+// Next to the bit vector it keeps one collision bit for every region of 8 bits, set when an insertion finds one of its bits in the region already set.
+// Different insertions setting different bits of a region do not mark it, since none of their bits is shared; only setting the same bit twice does.
+// While a region is unmarked each of its set bits was set by exactly one insertion, so it can be cleared when that element is deleted without disturbing others;
+// once marked, no bit of the region is cleared, since the collision bit does not say which of its bits is shared.
+// Deletes are logged and take effect on Rebuild; an element all of whose bits lie in collided regions cannot be removed and keeps testing present.
+// As with a counting Filter, only elements that were inserted may be deleted.
+type DeletableBloomFilter struct {
+	capacity uint32
+	elements uint32
+	bits     uint64
+	filter   bitvector2
+	collided bitvector2 // one bit per region
+	salts    [][]byte
+	pending  map[string]struct{} // deletes since the last Rebuild
+}
+
+// NewDeletableBloomFilter returns a new deletable bloom Filter sized like NewBloomFilter2, using an eighth more memory for the collision bits.
+func NewDeletableBloomFilter(Capacity uint32, falsePositiveRate float64, Salts []uint32) *DeletableBloomFilter {
+
+	dbf := new(DeletableBloomFilter)
+
+	dbf.capacity = Capacity
+	dbf.bits = FilterBits2(Capacity, falsePositiveRate)
+	dbf.filter = newBitvector2(int(dbf.bits+31) / 32)
+	dbf.collided = newBitvector2(int(dbf.bits/deletableRegion+31) / 32)
+	dbf.pending = make(map[string]struct{})
+
+	dbf.salts = make([][]byte, len(Salts))
+	for i, s := range Salts {
+		dbf.salts[i] = uint32ToByteArray2(s)
+	}
+
+	return dbf
+}
+
+// Len returns the number of Elements inserted, less those removed by Rebuild.
+func (dbf *DeletableBloomFilter) Len() uint32 { return dbf.elements }
+
+// Pending returns the number of deletes waiting for Rebuild.
+func (dbf *DeletableBloomFilter) Pending() int { return len(dbf.pending) }
+
+// location returns the bit index for b hashed with salt s
+func (dbf *DeletableBloomFilter) location(s []byte, b []byte) uint64 {
+	return uint64(fnv32(s, b)) % dbf.bits
+}
+
+// Insert inserts the byte array b into the Filter, cancelling any pending delete of b.
+// If the function returns false, the Capacity of the Filter has been reached.
+func (dbf *DeletableBloomFilter) Insert(b []byte) bool {
+
+	delete(dbf.pending, string(b))
+
+	dbf.elements++
+
+	for _, s := range dbf.salts {
+		i := dbf.location(s, b)
+		if dbf.filter.testAndSet(i) {
+			dbf.collided.set(i / deletableRegion)
+		}
+	}
+
+	return dbf.elements < dbf.capacity
+}
+
+// Exists checks the Filter for the byte array b.  Pending deletes are not taken into account until Rebuild.
+func (dbf *DeletableBloomFilter) Exists(b []byte) bool {
+
+	for _, s := range dbf.salts {
+		if dbf.filter.get(dbf.location(s, b)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Delete logs b for removal by the next Rebuild.
+// It returns false, and logs nothing, if b is not present.
+func (dbf *DeletableBloomFilter) Delete(b []byte) bool {
+
+	if !dbf.Exists(b) {
+		return false
+	}
+
+	dbf.pending[string(b)] = struct{}{}
+
+	return true
+}
+
+// Rebuild applies the pending deletes, clearing the bits of each deleted element that lie in collision-free regions, and empties the log.
+// It returns the number of deleted elements that could not be removed because all of their bits lie in collided regions; those keep testing present.
+// The fewer Elements the Filter holds, the fewer regions have collided.
+func (dbf *DeletableBloomFilter) Rebuild() int {
+
+	stuck := 0
+
+	for key := range dbf.pending {
+		b := []byte(key)
+
+		removed := false
+		for _, s := range dbf.salts {
+			i := dbf.location(s, b)
+			if dbf.collided.get(i/deletableRegion) == 0 {
+				dbf.filter[i/32] &^= 1 << (i % 32)
+				removed = true
+			}
+		}
+
+		if !removed {
+			stuck++
+		}
+		if dbf.elements > 0 {
+			dbf.elements--
+		}
+	}
+
+	dbf.pending = make(map[string]struct{})
+
+	return stuck
+}
@@ -0,0 +1,58 @@
+package dgobloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDeletableBloomFilter(t *testing.T) {
+
+	dbf := NewDeletableBloomFilter(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+
+	for i := 0; i < 1000; i++ {
+		dbf.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	for i := 0; i < 1000; i += 2 {
+		if !dbf.Delete([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("Delete of key-%d failed", i)
+		}
+	}
+
+	if dbf.Delete([]byte("never inserted")) {
+		t.Error("Delete of an absent key succeeded")
+	}
+
+	// deletes wait for Rebuild, and a later insert cancels one
+	if !dbf.Exists([]byte("key-0")) || dbf.Pending() != 500 {
+		t.Errorf("before Rebuild key-0 present=%v, %d pending; want true and 500", dbf.Exists([]byte("key-0")), dbf.Pending())
+	}
+	dbf.Insert([]byte("key-0"))
+
+	stuck := dbf.Rebuild()
+	if dbf.Pending() != 0 {
+		t.Errorf("%d deletes pending after Rebuild", dbf.Pending())
+	}
+	if dbf.Len() != 1001-499 {
+		t.Errorf("Len=%d after Rebuild, want %d", dbf.Len(), 1001-499)
+	}
+
+	present := 0
+	for i := 0; i < 1000; i++ {
+		exists := dbf.Exists([]byte(fmt.Sprintf("key-%d", i)))
+		if (i%2 == 1 || i == 0) && !exists {
+			t.Fatalf("key-%d lost after deleting others", i)
+		}
+		if i%2 == 0 && i != 0 && exists {
+			present++
+		}
+	}
+
+	// keys stuck in collided regions remain, plus the odd false positive
+	if present < stuck || present > stuck+5 {
+		t.Errorf("%d deleted keys present, %d reported stuck", present, stuck)
+	}
+	if present > 10 {
+		t.Errorf("%d of 499 deleted keys still present", present)
+	}
+}
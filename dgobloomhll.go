@@ -0,0 +1,79 @@
+package dgobloom
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// hllPrecision is the number of index bits of the HyperLogLog sketch, giving 2^14 one-byte registers and a standard error of about 0.8%
+const hllPrecision = 14
+
+// hyperLogLog estimates the number of distinct byte arrays added to it
+type hyperLogLog struct {
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]uint8, 1<<hllPrecision)}
+}
+
+// fmix64 is the murmur3 64-bit finalizer
+func fmix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func (hll *hyperLogLog) add(b []byte) {
+	h := fnv.New64a()
+	h.Write(b)
+	x := fmix64(h.Sum64())
+
+	i := x >> (64 - hllPrecision)
+	rho := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+
+	if rho > hll.registers[i] {
+		hll.registers[i] = rho
+	}
+}
+
+func (hll *hyperLogLog) merge(other *hyperLogLog) {
+	for i, r := range other.registers {
+		if r > hll.registers[i] {
+			hll.registers[i] = r
+		}
+	}
+}
+
+func (hll *hyperLogLog) reset() {
+	for i := range hll.registers {
+		hll.registers[i] = 0
+	}
+}
+
+func (hll *hyperLogLog) estimate() float64 {
+	m := float64(len(hll.registers))
+
+	sum := 0.0
+	zeros := 0
+	for _, r := range hll.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	e := alpha * m * m / sum
+
+	// linear counting is more accurate for small cardinalities
+	if e <= 2.5*m && zeros != 0 {
+		return m * math.Log(m/float64(zeros))
+	}
+
+	return e
+}
@@ -0,0 +1,47 @@
+package dgobloom
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestEstimateCountHLL(t *testing.T) {
+
+	b := NewBloomFilterWithHLL(1000, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+
+	n := 20000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		b.Insert(key)
+		b.Insert(key)
+	}
+
+	hll := b.EstimateCountHLL()
+	bits := b.EstimateCount()
+
+	hllErr := math.Abs(hll-float64(n)) / float64(n)
+	bitsErr := math.Abs(bits-float64(n)) / float64(n)
+
+	t.Log("HLL estimate:", hll, "bit estimate:", bits, "of", n)
+
+	if hllErr > 0.05 {
+		t.Errorf("HLL estimate %f is %.1f%% off", hll, 100*hllErr)
+	}
+	if !(hllErr < bitsErr) {
+		t.Errorf("HLL estimate (%.1f%% off) is no better than the bit estimate (%.1f%% off)", 100*hllErr, 100*bitsErr)
+	}
+
+	small := NewBloomFilterWithHLL(CAPACITY, ERRPCT, []uint32{1, 2, 3})
+	for i := 0; i < 100; i++ {
+		small.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	if e := small.EstimateCountHLL(); math.Abs(e-100) > 5 {
+		t.Errorf("HLL estimate of 100 elements is %f", e)
+	}
+
+	small.Clear()
+	if e := small.EstimateCountHLL(); e != 0 {
+		t.Errorf("HLL estimate after Clear is %f", e)
+	}
+}
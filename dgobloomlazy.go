@@ -0,0 +1,29 @@
+package dgobloom
+
+import "sync"
+
+// LazyBloomFilter builds a bloom Filter on first use, for package-level Filters that should not be constructed at init time.
+// The builder runs exactly once, from whichever goroutine gets there first, and every other caller waits for it to finish.
+// Only the construction is synchronized: concurrent Inserts into the built Filter need the same care as on any other Filter.
+type LazyBloomFilter struct {
+	once  sync.Once
+	build func() BloomFilter2
+	bf    BloomFilter2
+}
+
+// NewLazyBloomFilter returns a LazyBloomFilter that calls build to construct its Filter on first use.
+func NewLazyBloomFilter(build func() BloomFilter2) *LazyBloomFilter {
+	return &LazyBloomFilter{build: build}
+}
+
+// Filter returns the bloom Filter, building it if this is the first use.
+func (l *LazyBloomFilter) Filter() BloomFilter2 {
+	l.once.Do(func() { l.bf = l.build() })
+	return l.bf
+}
+
+// Insert inserts the byte array b into the Filter, building it first if necessary.
+func (l *LazyBloomFilter) Insert(b []byte) bool { return l.Filter().Insert(b) }
+
+// Exists checks the Filter for the byte array b, building it first if necessary.
+func (l *LazyBloomFilter) Exists(b []byte) bool { return l.Filter().Exists(b) }
@@ -0,0 +1,52 @@
+package dgobloom
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLazyBloomFilter(t *testing.T) {
+
+	var builds int32
+	lazy := NewLazyBloomFilter(func() BloomFilter2 {
+		atomic.AddInt32(&builds, 1)
+		bf := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+		for i := 0; i < 1000; i++ {
+			bf.Insert([]byte(fmt.Sprintf("preload-%d", i)))
+		}
+		return bf
+	})
+
+	if builds != 0 {
+		t.Fatal("filter built before first use")
+	}
+
+	// every goroutine races to be first, and all of them must see the preloaded contents
+	var wg sync.WaitGroup
+	missing := make(chan int, 64)
+	for g := 0; g < 64; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			if !lazy.Exists([]byte(fmt.Sprintf("preload-%d", g))) {
+				missing <- g
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(missing)
+
+	for g := range missing {
+		t.Errorf("goroutine %d saw a filter without its preloaded key", g)
+	}
+	if builds != 1 {
+		t.Errorf("filter built %d times, want once", builds)
+	}
+
+	lazy.Insert([]byte("later"))
+	if !lazy.Filter().Exists([]byte("later")) || lazy.Filter().Len() != 1001 {
+		t.Error("Insert did not reach the built filter")
+	}
+}
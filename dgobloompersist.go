@@ -12,10 +12,28 @@ Licensed under the GPLv3, or at your option any later version.
 package dgobloom
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash"
 	"hash/fnv"
+	"io"
 	"math"
+	"math/bits"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
 )
 
 // Internal routines for the bit vector
@@ -23,7 +41,7 @@ import (
 type bitvector2 []uint32
 
 // get bit 'bit' in the bitvector2 d
-func (d bitvector2) get(bit uint32) uint {
+func (d bitvector2) get(bit uint64) uint {
 
 	shift := bit % 32
 	bb := d[bit/32]
@@ -33,10 +51,41 @@ func (d bitvector2) get(bit uint32) uint {
 }
 
 // set bit 'bit' in the bitvector2 d
-func (d bitvector2) set(bit uint32) {
+func (d bitvector2) set(bit uint64) {
 	d[bit/32] |= (1 << (bit % 32))
 }
 
+// set bit 'bit' in the bitvector2 d, returning whether it was already set
+func (d bitvector2) testAndSet(bit uint64) bool {
+	mask := uint32(1) << (bit % 32)
+	old := d[bit/32]
+	d[bit/32] = old | mask
+	return old&mask != 0
+}
+
+// set bit 'bit' in the bitvector2 d with an atomic compare-and-swap, for writers sharing d
+func (d bitvector2) setAtomic(bit uint64) {
+	mask := uint32(1) << (bit % 32)
+	p := &d[bit/32]
+	for {
+		old := atomic.LoadUint32(p)
+		if old&mask != 0 || atomic.CompareAndSwapUint32(p, old, old|mask) {
+			return
+		}
+	}
+}
+
+// cacheLine is the alignment in bytes of bit vectors from newBitvector2
+const cacheLine = 64
+
+// newBitvector2 returns a zeroed bitvector2 of the given number of words starting on a cache line boundary.
+// We over-allocate by one cache line and reslice; the garbage collector does not move heap objects, so the alignment holds for the life of the slice.
+func newBitvector2(words int) bitvector2 {
+	buf := make([]uint32, words+cacheLine/4)
+	off := int((cacheLine-uintptr(unsafe.Pointer(&buf[0]))%cacheLine)%cacheLine) / 4
+	return buf[off : off+words : off+words]
+}
+
 // 32-bit, which is why it only goes up to 16
 // return the integer >= i which is a power of two
 func nextPowerOfTwo2(i uint64) uint64 {
@@ -59,16 +108,256 @@ type BloomFilter2 interface {
 	// Determine if an element is in the set
 	Exists(b []byte) bool
 
-	// Return the number of Elements currently stored in the set
+	// Determine if an element is probably or definitely not in the set
+	Query(b []byte) Membership
+
+	// Add a string to the set
+	InsertString(s string) bool
+
+	// Determine if a string is in the set
+	ExistsString(s string) bool
+
+	// Prepare lookups of many elements sharing a prefix
+	PrefixQuerier(prefix []byte) *PrefixQuerier
+
+	// Return the number of Elements inserted into the set, including those of merged sets
 	Len() uint32
 
+	// Return the number of Elements the set can hold at its false positive rate
+	Cap() uint32
+
+	// Return the fraction of Capacity used
+	LoadRatio() float64
+
 	// Merge two bloom Filters
-	Merge(BloomFilter2)
+	Merge(BloomFilter2) error
+
+	// Merge a serialized bloom Filter read from a stream
+	MergeFrom(r io.Reader) error
+
+	// Merge two bloom Filters, counting the Elements in both only once
+	UnionWithOverlap(other BloomFilter2, overlapEstimate uint32) error
+
+	// Merge a bloom Filter in the binary format without decoding it
+	MergeBytes(data []byte) error
+
+	// Insert a batch of elements using several goroutines
+	InsertAllParallel(items [][]byte, workers int) int
+
+	// Merge two bloom Filters using several goroutines
+	MergeParallel(other BloomFilter2, workers int) error
 
 	// Compress a bloom Filter
-	Compress()
+	Compress() error
 
 	Serialization(file string) error
+
+	// Write the serialized bloom Filter to a stream
+	WriteTo(w io.Writer) (int64, error)
+
+	// Check the internal invariants of the filter
+	Validate() error
+
+	// Reallocate the bit vector to match the filter dimensions
+	Repair() error
+
+	// Test for an element, inserting it with probability p if it is absent
+	TouchAndMaybeInsert(b []byte, p float64) bool
+
+	// Return an immutable copy of the bloom Filter
+	Freeze() *FrozenBloomFilter2
+
+	// Return the number of bits set in the bloom Filter
+	PopCount() uint64
+
+	// Estimate the number of distinct Elements in the set
+	EstimateCount() float64
+
+	// Estimate the number of distinct Elements in the union of two sets
+	UnionCountEstimate(other BloomFilter2) (float64, error)
+
+	// Insert an element into the set, reporting whether it was new
+	InsertNew(b []byte) bool
+
+	// Encode the bloom Filter in the binary format
+	MarshalBinary() ([]byte, error)
+
+	// Decode the bloom Filter from the binary format
+	UnmarshalBinary(data []byte) error
+
+	// Report whether two bloom Filters are identical
+	Equal(other BloomFilter2) bool
+
+	// Install the secret key of a keyed bloom Filter
+	SetKey(key []byte) error
+
+	// Install the secret pepper of a peppered bloom Filter
+	SetPepper(pepper []byte) error
+
+	// Rebuild the bloom Filter from the Elements that remain after a removal
+	Without(items [][]byte, falsePositiveRate float64) BloomFilter2
+
+	// Partition the bit vector into shards for parallel persistence
+	Split(n int) ([]*Shard, error)
+
+	// Return the configured false positive rate
+	ConfiguredFPR() float64
+
+	// Empty the bloom Filter
+	Clear() error
+
+	// Empty the bloom Filter and install new salts
+	Rotate(Salts []uint32) error
+
+	// Estimate the number of distinct Elements using the HyperLogLog sketch
+	EstimateCountHLL() float64
+
+	// Return the bit indices an element maps to
+	Indices(b []byte) []uint64
+
+	// Return the approximate heap footprint in bytes
+	SizeBytes() int
+
+	// Insert an element given its precomputed 64-bit hash
+	InsertHash(h uint64) bool
+
+	// Determine if an element given its precomputed 64-bit hash is in the set
+	ExistsHash(h uint64) bool
+
+	// Determine which of a batch of precomputed hashes are in the set
+	ExistsHashes(hashes []uint64) []bool
+
+	// Count the bits that differ between two bloom Filters
+	DiffCount(other BloomFilter2) (int, error)
+
+	// Register a function to observe inserts
+	OnInsert(fn func(b []byte, novel bool))
+
+	// Insert an element, rejecting empty input
+	InsertStrict(b []byte) (bool, error)
+
+	// Install an exact membership test to back ExistsExact
+	SetExactLookup(lookup func(b []byte) bool)
+
+	// Determine if an element is in the set, without false positives when an exact lookup is installed
+	ExistsExact(b []byte) bool
+
+	// Snapshot the bit vector for SerializeDiff
+	Checkpoint()
+
+	// Return the number of inserts since the bloom Filter was last serialized
+	PendingInserts() uint32
+
+	// Write the words changed since the last Checkpoint
+	SerializeDiff(w io.Writer) error
+
+	// Apply changes written by SerializeDiff
+	ApplyDiff(r io.Reader) error
+
+	// Call a function on each word of the bit vector
+	Walk(fn func(wordIndex int, word uint32) bool)
+
+	// Allow or refuse further writes
+	SetReadOnly(readOnly bool)
+
+	// Report whether writes are refused
+	ReadOnly() bool
+
+	// Return the number of salts needed for a false positive rate at the current dimensions
+	OptimalHashesForCurrentSize(falsePositiveRate float64) int
+
+	// Return a snapshot of the size and fill of the bloom Filter
+	Stats() Stats
+
+	// Return an expvar.Var publishing Stats
+	ExpvarVar() expvar.Var
+
+	// Insert a uint64 key, encoded big-endian
+	InsertUint64(x uint64) bool
+
+	// Determine if a uint64 key, encoded big-endian, is in the set
+	ExistsUint64(x uint64) bool
+
+	// List the differences between two bloom Filters that matter for Merge
+	Compatibility(other BloomFilter2) []string
+
+	// Add a salt to an empty bloom Filter
+	AppendSalt(salt uint32) error
+
+	// Estimate the current false positive rate from the fraction of bits set
+	EstimatedFalsePositiveRate() float64
+
+	// Return the estimated false positive rate as a multiple of the configured one
+	DegradationFactor() float64
+
+	// Draw the bit vector as text
+	RenderASCII(width int) string
+
+	// Draw the bit vector as a PNG image
+	RenderPNG(w io.Writer) error
+
+	// Test an element against only the first few salts
+	ExistsPrescreen(b []byte, j int) bool
+
+	// Test an element against at most maxSalts salts
+	ExistsLimited(b []byte, maxSalts int) bool
+
+	// Test an element and report the first salt whose bit is clear
+	ExistsDebug(b []byte) (present bool, firstZeroSalt int)
+
+	// Return the Shannon entropy of the distribution of set bits over 64-bit blocks
+	BitEntropy() float64
+
+	// Report whether two salts map an element to the same bit
+	SaltsCollide(b []byte) bool
+
+	// Return how many times the bloom Filter can be compressed within a false positive rate
+	MaxCompressions(maxFPR float64) int
+
+	// Compress a bloom Filter several times
+	CompressBy(n int) error
+
+	// Compare compressing the Filter with rebuilding it at a smaller size
+	CompressVsRebuildAdvice(targetBits uint64) (CompressAdvice, error)
+
+	// Count the bits set in an older generation but not in a newer one
+	StaleBits(newer BloomFilter2) (uint64, error)
+
+	// Return the index of the first of a batch of elements in the set
+	AnyPresent(items [][]byte) (index int, found bool)
+
+	// Measure the false positive rate over keys known to be absent
+	MeasureFPR(negatives [][]byte) float64
+
+	// Return the number of Elements at which the estimated false positive rate reaches a limit
+	RecommendedRotateAt(maxFPR float64) uint32
+
+	// Return how many more Elements fit before the expected false positive rate exceeds a target
+	RemainingCapacity(targetFPR float64) int
+
+	// List the indices of the set bits
+	SetBits() []uint64
+
+	// Return how the bloom Filter derives bit indices
+	Strategy() Strategy
+
+	// Return the byte order of the uint32 salts
+	SaltByteOrder() binary.ByteOrder
+
+	// Rebuild the bloom Filter from its items in the standard layout
+	ToStandard(items [][]byte) BloomFilter2
+
+	// Rebuild the bloom Filter from its items in the partitioned layout
+	ToPartitioned(items [][]byte) BloomFilter2
+
+	// Write a hex dump of the header and the start of the bit vector
+	DumpHead(w io.Writer, words int) error
+
+	// Record a generation tag serialized with the bloom Filter
+	SetTag(tag string)
+
+	// Return the generation tag
+	Tag() string
 }
 
 // Internal struct for our bloom Filter
@@ -78,17 +367,100 @@ type bloomFilter2 struct {
 	Bits     uint64     // size of bit vector in Bits
 	Filter   bitvector2 // our Filter bit vector
 	Salts    [][]byte
+	Mix      bool // apply a finalization mix to each hash before indexing
+	Keyed    bool // hash with SipHash under a secret key instead of FNV
+	Wide     bool // double hash a 128-bit FNV hash into 64-bit indices instead of hashing per salt
+	Strict   bool // move colliding salts of an element onto distinct bits
+
+	LittleEndian bool // uint32 salts are encoded little-endian instead of big-endian
+	Partitioned  bool // each salt sets bits in its own slice of the bit vector
+	Peppered     bool // elements are replaced by their HMAC under a secret pepper before hashing
+
+	FalsePositiveRate float64 // configured false positive rate at Capacity
+
+	DatasetTag string // user-supplied generation tag set with SetTag
+
+	sipKey [2]uint64 // secret key for Keyed filters; never serialized
+	hasKey bool
+
+	pepper []byte // secret HMAC key for Peppered filters; never serialized
+
+	hll *hyperLogLog // distinct count sketch from NewBloomFilterWithHLL; never serialized
+
+	random func() float64 // source for TouchAndMaybeInsert; nil means math/rand
+
+	onInsert func(b []byte, novel bool) // observer registered with OnInsert
+
+	exact func(b []byte) bool // exact membership test registered with SetExactLookup
+
+	checkpoint bitvector2 // bit vector at the last Checkpoint
+
+	pending uint32 // inserts since the last WriteTo or MarshalBinary; never serialized
+
+	indexFn func(data []byte, saltIndex int, bits uint64) uint64 // bit positions from NewBloomFilterWithIndex; never serialized
+
+	readOnly bool // set by SetReadOnly and Freeze; writes fail with ErrReadOnly
 }
 
+// Len returns the number of Elements inserted, which is what the bits of the Filter represent and what LoadRatio compares with Capacity:
+// Clear resets it to 0, Compress keeps it, since every Element still tests present in the smaller Filter whose Capacity has halved,
+// and Merge adds the other Filter's Len, counting Elements in both twice; UnionWithOverlap corrects for an estimated overlap.
+// Insert counts every call, InsertNew only Elements not already present.  A Merge that would overflow the count leaves it at math.MaxUint32.
 func (bf *bloomFilter2) Len() uint32 { return bf.Elements }
 
+func (bf *bloomFilter2) Cap() uint32 { return bf.Capacity }
+
+// LoadRatio returns Len as a fraction of Capacity.  Values above 1 mean the Filter is over Capacity and the false positive rate is above its configured value.
+func (bf *bloomFilter2) LoadRatio() float64 {
+	if bf.Capacity == 0 {
+		return math.Inf(1)
+	}
+	return float64(bf.Elements) / float64(bf.Capacity)
+}
+
+// ConfiguredFPR returns the false positive rate the bloom Filter was built for.
+// After a Merge it is the looser of the two Filters' rates, since that is all the union can promise.
+func (bf *bloomFilter2) ConfiguredFPR() float64 { return bf.FalsePositiveRate }
+
+// SetTag records a user-supplied tag, such as a dataset version or generation number, that is serialized with the bloom Filter.
+// Loaders can compare Tag with the version they expect to avoid querying a stale Filter.  The tag does not affect membership or merging.
+func (bf *bloomFilter2) SetTag(tag string) { bf.DatasetTag = tag }
+
+// Tag returns the tag set with SetTag, or "" if there is none.
+func (bf *bloomFilter2) Tag() string { return bf.DatasetTag }
+
+// OptimalHashesForCurrentSize returns the smallest number of salts k that keeps the false positive rate at or below falsePositiveRate with Capacity Elements in the current Bits.
+// The rate is lowest at round(Bits/Capacity * ln 2) salts; if even that misses the target, that k is returned and the target is out of reach without a larger Filter.
+// Compare it with the current number of salts after merges or compressions have changed the dimensions.
+func (bf *bloomFilter2) OptimalHashesForCurrentSize(falsePositiveRate float64) int {
+
+	best := optimalSalts(bf.Bits, bf.Capacity)
+
+	for k := 1; k < best; k++ {
+		if expectedFPR(bf.Bits, bf.Capacity, k) <= falsePositiveRate {
+			return k
+		}
+	}
+
+	return best
+}
+
 // FilterBits2 returns the number of Bits required for the desired Capacity and false positive rate.
 func FilterBits2(Capacity uint32, falsePositiveRate float64) uint64 {
+	return FilterBitsMin(Capacity, falsePositiveRate, 1024)
+}
+
+// FilterBitsMin returns the number of Bits required for the desired Capacity and false positive rate, but never less than minBits.
+// FilterBits2 uses a minimum of 1024; a minBits of 0 sizes tiny Filters exactly, still rounded up to a power of two.
+func FilterBitsMin(Capacity uint32, falsePositiveRate float64, minBits uint64) uint64 {
 	Bits := float64(Capacity) * -math.Log(falsePositiveRate) / (math.Log(2.0) * math.Log(2.0)) // in Bits
-	m := nextPowerOfTwo2(uint64(Bits))
+	m := uint64(1)
+	if Bits > 1 {
+		m = nextPowerOfTwo2(uint64(Bits))
+	}
 
-	if m < 1024 {
-		return 1024
+	if m < minBits {
+		return nextPowerOfTwo2(minBits)
 	}
 
 	return m
@@ -96,7 +468,12 @@ func FilterBits2(Capacity uint32, falsePositiveRate float64) uint64 {
 
 // SaltsRequired2 returns the number of Salts required by the constructor for the desired Capacity and false positive rate.
 func SaltsRequired2(Capacity uint32, falsePositiveRate float64) uint {
-	m := FilterBits2(Capacity, falsePositiveRate)
+	return SaltsRequiredMin(Capacity, falsePositiveRate, 1024)
+}
+
+// SaltsRequiredMin returns the number of Salts required by NewBloomFilterMin for the desired Capacity, false positive rate and minimum size.
+func SaltsRequiredMin(Capacity uint32, falsePositiveRate float64, minBits uint64) uint {
+	m := FilterBitsMin(Capacity, falsePositiveRate, minBits)
 	Salts := uint(0.7 * float32(float64(m)/float64(Capacity)))
 	if Salts < 2 {
 		return 2
@@ -113,6 +490,14 @@ func uint32ToByteArray2(salt uint32) []byte {
 	return p
 }
 
+// saltBytes encodes a uint32 salt in the byte order of the bloom Filter
+func (bf *bloomFilter2) saltBytes(salt uint32) []byte {
+	if bf.LittleEndian {
+		return binary.LittleEndian.AppendUint32(nil, salt)
+	}
+	return uint32ToByteArray2(salt)
+}
+
 // NewBloomFilter2 returns a new bloom Filter with the specified Capacity and false positive rate.
 // The hash function h will be salted with the array of Salts.
 func NewBloomFilter2(Capacity uint32, falsePositiveRate float64, Salts []uint32) BloomFilter2 {
@@ -120,8 +505,9 @@ func NewBloomFilter2(Capacity uint32, falsePositiveRate float64, Salts []uint32)
 	bf := new(bloomFilter2)
 
 	bf.Capacity = Capacity
+	bf.FalsePositiveRate = falsePositiveRate
 	bf.Bits = FilterBits2(Capacity, falsePositiveRate)
-	bf.Filter = make([]uint32, uint(bf.Bits+31)/32)
+	bf.Filter = newBitvector2(int(bf.Bits+31) / 32)
 
 	bf.Salts = make([][]byte, len(Salts))
 	for i, s := range Salts {
@@ -131,98 +517,2503 @@ func NewBloomFilter2(Capacity uint32, falsePositiveRate float64, Salts []uint32)
 	return bf
 }
 
-// Insert inserts the byte array b into the bloom Filter.
-// If the function returns false, the Capacity of the bloom Filter has been reached.  Further inserts will increase the rate of false positives.
-func (bf *bloomFilter2) Insert(b []byte) bool {
-	h := fnv.New32()
+// NewBloomFilterRawSalts returns a new bloom Filter like NewBloomFilter2, salted with arbitrary byte strings instead of uint32s, for interoperating with systems that define their own salt material.
+// The salts are copied and serialized as given.  A four byte salt is equivalent to the big-endian encoding of a uint32 salt.
+func NewBloomFilterRawSalts(Capacity uint32, falsePositiveRate float64, Salts [][]byte) BloomFilter2 {
 
-	bf.Elements++
+	bf := NewBloomFilter2(Capacity, falsePositiveRate, nil).(*bloomFilter2)
 
-	for _, s := range bf.Salts {
-		h.Reset()
-		h.Write(s)
-		h.Write(b)
-		bf.Filter.set(uint32(uint64(h.Sum32()) % bf.Bits))
+	bf.Salts = make([][]byte, len(Salts))
+	for i, s := range Salts {
+		bf.Salts[i] = append([]byte(nil), s...)
 	}
 
-	return bf.Elements < bf.Capacity
+	return bf
 }
 
-// Exists checks the bloom Filter for the byte array b
-func (bf *bloomFilter2) Exists(b []byte) bool {
-	h := fnv.New32()
+// NewBloomFilterFromBits rebuilds a bloom Filter of Bits bits from a sparse representation: its salts and the indices of its set bits, as SetBits lists them.
+// The salts are copied.  Bits must be a power of two and every index below it, or an error is returned.
+// Capacity, element count and hashing options are not part of the representation; the result has none of them, so it matches the original in its bits, and DiffCount, but not in Len.
+func NewBloomFilterFromBits(Bits uint64, Salts [][]byte, setIndices []uint64) (BloomFilter2, error) {
 
-	for _, s := range bf.Salts {
-		h.Reset()
-		h.Write(s)
-		h.Write(b)
+	bf := &bloomFilter2{Bits: Bits}
 
-		if bf.Filter.get(uint32(uint64(h.Sum32())%bf.Bits)) == 0 {
-			return false
+	if Bits == 0 || Bits&(Bits-1) != 0 {
+		return nil, fmt.Errorf("dgobloom: Bits is %d, which is not a power of two", Bits)
+	}
+	for _, x := range setIndices {
+		if x >= Bits {
+			return nil, fmt.Errorf("dgobloom: bit index %d is out of range for %d bits", x, Bits)
 		}
 	}
 
-	return true
+	bf.Filter = newBitvector2(int((Bits + 31) / 32))
+	bf.Salts = make([][]byte, len(Salts))
+	for i, s := range Salts {
+		bf.Salts[i] = append([]byte(nil), s...)
+	}
+
+	if err := bf.validateLayout(); err != nil {
+		return nil, err
+	}
+
+	for _, x := range setIndices {
+		bf.Filter.set(x)
+	}
+
+	return bf, nil
 }
 
-// Merge adds bf2 into the current bloom Filter.  They must have the same dimensions and be constructed with identical random seeds.
-func (bf *bloomFilter2) Merge(bf2 BloomFilter2) {
+// NewBloomFilterMin returns a new bloom Filter like NewBloomFilter2, sized with FilterBitsMin using the given minimum number of Bits instead of 1024.
+func NewBloomFilterMin(Capacity uint32, falsePositiveRate float64, Salts []uint32, minBits uint64) BloomFilter2 {
 
-	other := bf2.(*bloomFilter2)
+	bf := NewBloomFilter2(Capacity, falsePositiveRate, Salts).(*bloomFilter2)
 
-	for i, v := range other.Filter {
-		bf.Filter[i] |= v
+	if Bits := FilterBitsMin(Capacity, falsePositiveRate, minBits); Bits != bf.Bits {
+		bf.Bits = Bits
+		bf.Filter = newBitvector2(int(bf.Bits+31) / 32)
 	}
+
+	return bf
 }
 
-// Compress halves the space used by the bloom Filter, at the cost of increased error rate.
-func (bf *bloomFilter2) Compress() {
+// NewWideBloomFilter returns a new bloom Filter like NewBloomFilter2 for Filters too large to index with 32-bit hashes.
+// Each element is hashed once with 128-bit FNV-1a, seeded with the first salt, and the two 64-bit halves of the hash are combined by double hashing into one index per salt.
+// The 64-bit indices spread evenly over bit vectors beyond 2^32 Bits, where the per-salt 32-bit hashes of other Filters cannot reach the upper part.
+// Only the number of salts and the first salt's value matter; Mix has no effect.  Filters must agree on wide hashing to be merged.
+func NewWideBloomFilter(Capacity uint32, falsePositiveRate float64, Salts []uint32) BloomFilter2 {
 
-	w := len(bf.Filter)
+	bf := NewBloomFilter2(Capacity, falsePositiveRate, Salts).(*bloomFilter2)
+	bf.Wide = true
 
-	if w&(w-1) != 0 {
-		panic("width must be a power of two")
+	return bf
+}
+
+// Strategy selects how a bloom Filter derives the bit indices of an element from its salts.
+type Strategy int
+
+const (
+	// StrategyPerSalt hashes the element once per salt: k hashes per operation, each index independent of the others.
+	StrategyPerSalt Strategy = iota
+
+	// StrategyDoubleHash hashes the element once and derives all k indices from the two halves of the hash, as NewWideBloomFilter does.
+	// It costs one hash however many salts there are, which pays off for large k or expensive hashes.
+	StrategyDoubleHash
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case StrategyPerSalt:
+		return "per-salt"
+	case StrategyDoubleHash:
+		return "double-hash"
 	}
+	return fmt.Sprintf("Strategy(%d)", int(s))
+}
 
-	neww := w / 2
+// NewBloomFilterWithStrategy returns a new bloom Filter like NewBloomFilter2 that derives indices with the given strategy.
+// The strategy is serialized with the Filter, as the wide flag, so a loaded Filter indexes the way it was built.
+func NewBloomFilterWithStrategy(Capacity uint32, falsePositiveRate float64, Salts []uint32, strategy Strategy) (BloomFilter2, error) {
 
-	// We allocate a new array here so old space can actually be garbage collected.
-	// TODO(dgryski): reslice and only reallocate every few compressions
-	row := make([]uint32, neww)
-	for j := 0; j < neww; j++ {
-		row[j] = bf.Filter[j] | bf.Filter[j+neww]
+	switch strategy {
+	case StrategyPerSalt:
+		return NewBloomFilter2(Capacity, falsePositiveRate, Salts), nil
+	case StrategyDoubleHash:
+		return NewWideBloomFilter(Capacity, falsePositiveRate, Salts), nil
 	}
-	bf.Filter = row
-	bf.Bits /= 2
+
+	return nil, fmt.Errorf("dgobloom: unknown index strategy %v", strategy)
 }
 
-func UnSerialization(file string) (BloomFilter2, error) {
-	bf := new(bloomFilter2)
-	fp, err := os.Open(file)
-	if err != nil {
-		return bf, err
+// Strategy returns how the bloom Filter derives bit indices.
+func (bf *bloomFilter2) Strategy() Strategy {
+	if bf.Wide {
+		return StrategyDoubleHash
 	}
+	return StrategyPerSalt
+}
 
-	dec := gob.NewDecoder(fp)
-	err = dec.Decode(&bf)
-	if err != nil {
-		return bf, err
+// NewBloomFilterWithByteOrder returns a new bloom Filter like NewBloomFilter2 whose uint32 salts are encoded in order, binary.BigEndian or binary.LittleEndian,
+// for interoperating with implementations that salt their hashes with little-endian words.  The two orders give different, incompatible Filters.
+// The order is serialized with the Filter, so salts added later by AppendSalt or Rotate are encoded the same way.
+func NewBloomFilterWithByteOrder(Capacity uint32, falsePositiveRate float64, Salts []uint32, order binary.ByteOrder) (BloomFilter2, error) {
+
+	if order != binary.BigEndian && order != binary.LittleEndian {
+		return nil, fmt.Errorf("dgobloom: unsupported salt byte order %v", order)
 	}
 
-	//fmt.Println(bf.Capacity)
+	bf := NewBloomFilter2(Capacity, falsePositiveRate, nil).(*bloomFilter2)
+	bf.LittleEndian = order == binary.LittleEndian
+	bf.Salts = make([][]byte, len(Salts))
+	for i, s := range Salts {
+		bf.Salts[i] = bf.saltBytes(s)
+	}
 
 	return bf, nil
 }
 
-func (bf *bloomFilter2) Serialization(file string) error {
-	fp, err := os.Create(file)
-	if err != nil {
-		return err
+// SaltByteOrder returns the byte order of the uint32 salts of the bloom Filter.
+func (bf *bloomFilter2) SaltByteOrder() binary.ByteOrder {
+	if bf.LittleEndian {
+		return binary.LittleEndian
 	}
-	enc := gob.NewEncoder(fp)
-	err = enc.Encode(bf)
-	if err != nil {
-		return err
+	return binary.BigEndian
+}
+
+// NewBloomFilterWithIndex returns a new bloom Filter like NewBloomFilter2 in which indexFn derives the bit set and tested for an element under each salt,
+// replacing the salted FNV hash, for experimenting with other indexing schemes on top of the same bit vector.
+// indexFn is called with saltIndex from 0 to len(Salts)-1 and the number of Bits; its result is taken modulo Bits.  A nil indexFn gives NewBloomFilter2.
+// The function is not serialized, so a decoded Filter indexes with FNV again, and Merge only accepts another Filter with an index function, which it cannot compare.
+func NewBloomFilterWithIndex(Capacity uint32, falsePositiveRate float64, Salts []uint32, indexFn func(data []byte, saltIndex int, bits uint64) uint64) BloomFilter2 {
+
+	bf := NewBloomFilter2(Capacity, falsePositiveRate, Salts).(*bloomFilter2)
+	bf.indexFn = indexFn
+
+	return bf
+}
+
+// NewPartitionedBloomFilter returns a new bloom Filter like NewBloomFilter2 with the bit vector divided into len(Salts) equal partitions, one per salt,
+// so that the bits of an element never collide with each other and each salt fills its partition independently.
+// The layout is serialized with the Filter.  Partitioned and standard Filters set different bits and cannot be merged; ToStandard and ToPartitioned rebuild one as the other from the items.
+func NewPartitionedBloomFilter(Capacity uint32, falsePositiveRate float64, Salts []uint32) BloomFilter2 {
+
+	bf := NewBloomFilter2(Capacity, falsePositiveRate, Salts).(*bloomFilter2)
+	bf.Partitioned = len(Salts) > 0
+
+	return bf
+}
+
+// ToStandard returns a standard bloom Filter with the dimensions, salts and tag of bf holding items.
+// The bits of a partitioned Filter cannot be moved to the positions the standard layout uses without knowing the items, so they must be inserted again from the source.
+func (bf *bloomFilter2) ToStandard(items [][]byte) BloomFilter2 { return bf.relayout(false, items) }
+
+// ToPartitioned returns a partitioned bloom Filter with the dimensions, salts and tag of bf holding items, as ToStandard does for the opposite layout.
+func (bf *bloomFilter2) ToPartitioned(items [][]byte) BloomFilter2 { return bf.relayout(true, items) }
+
+// relayout returns an empty copy of bf with the given layout, filled with items
+func (bf *bloomFilter2) relayout(partitioned bool, items [][]byte) BloomFilter2 {
+
+	nbf := EmptyLike(bf).(*bloomFilter2)
+	nbf.Partitioned = partitioned && len(nbf.Salts) > 0
+	nbf.DatasetTag = bf.DatasetTag
+
+	for _, b := range items {
+		nbf.Insert(b)
+	}
+
+	return nbf
+}
+
+// ErrDuplicateSalts is returned by NewStrictBloomFilter when two salts are equal.
+var ErrDuplicateSalts = errors.New("dgobloom: duplicate salts map every element to the same bits")
+
+// NewStrictBloomFilter returns a new bloom Filter like NewBloomFilter2 in which every element sets and tests exactly len(Salts) distinct bits.
+// In other Filters two salts occasionally map an element to the same bit, silently weakening the test for that element; SaltsCollide detects it.
+// A strict Filter moves the later of two colliding indices to the next free bit, for Insert and Exists alike.
+// Equal salts would collide on every element, so they are rejected with ErrDuplicateSalts.  Filters must agree on strictness to be merged,
+// and a strict Filter cannot be compressed.
+func NewStrictBloomFilter(Capacity uint32, falsePositiveRate float64, Salts []uint32) (BloomFilter2, error) {
+
+	seen := make(map[uint32]bool, len(Salts))
+	for _, s := range Salts {
+		if seen[s] {
+			return nil, fmt.Errorf("%w: salt %d appears twice", ErrDuplicateSalts, s)
+		}
+		seen[s] = true
+	}
+
+	bf := NewBloomFilter2(Capacity, falsePositiveRate, Salts).(*bloomFilter2)
+	bf.Strict = true
+
+	return bf, nil
+}
+
+// NewMixedBloomFilter2 returns a new bloom Filter like NewBloomFilter2, but each salted hash is passed through a finalization mix before indexing.
+// The mix decorrelates the bit locations produced by weak salts, such as sequential integers.
+// Filters must agree on mixing to be merged.
+func NewMixedBloomFilter2(Capacity uint32, falsePositiveRate float64, Salts []uint32) BloomFilter2 {
+
+	bf := NewBloomFilter2(Capacity, falsePositiveRate, Salts).(*bloomFilter2)
+	bf.Mix = true
+
+	return bf
+}
+
+// Optimal returns everything needed to build a bloom Filter for n Elements at false positive rate p: the number of Bits, the number of salts k, and k distinct salts generated with math/rand.
+// Pass n, p and salts to NewBloomFilter2; peers wanting mergeable Filters must use the same salts.
+func Optimal(n uint32, p float64) (bits uint64, k int, salts []uint32) {
+
+	bits = FilterBits2(n, p)
+	k = int(SaltsRequired2(n, p))
+
+	seen := make(map[uint32]bool, k)
+	for len(salts) < k {
+		s := rand.Uint32()
+		if !seen[s] {
+			seen[s] = true
+			salts = append(salts, s)
+		}
+	}
+
+	return bits, k, salts
+}
+
+// SizeForQueryBudget sizes a bloom Filter for Capacity Elements so that `queries` lookups of absent keys are expected to produce at most maxExpectedFalsePositives false positives in total.
+// The per-query false positive rate is the budget divided by queries; the returned Bits are a power of two, as FilterBits2 gives, and k is the optimal number of salts for them.
+// A budget that is not positive cannot be met and returns zero Bits and salts.
+func SizeForQueryBudget(Capacity uint32, queries uint64, maxExpectedFalsePositives float64) (bits uint64, k int) {
+
+	if maxExpectedFalsePositives <= 0 {
+		return 0, 0
+	}
+
+	p := 1.0
+	if float64(queries) > maxExpectedFalsePositives {
+		p = maxExpectedFalsePositives / float64(queries)
+	}
+
+	bits = FilterBits2(Capacity, p)
+	k = optimalSalts(bits, Capacity)
+
+	// rounding k can leave the rate just above p; the next size up is always below it
+	for expectedFPR(bits, Capacity, k)*float64(queries) > maxExpectedFalsePositives {
+		bits *= 2
+		k = optimalSalts(bits, Capacity)
+	}
+
+	return bits, k
+}
+
+// NewBloomFilterFromScanner returns a new bloom Filter holding every token read from s, typically the lines of a word list or blocklist.
+// A Scanner cannot be rewound to count its lines first, so the caller supplies an estimate of the number of tokens as the Capacity; inserting more only raises the false positive rate.
+// Tokens are inserted as they are read, so memory use is independent of the input size.  Salts are generated as by Optimal.
+func NewBloomFilterFromScanner(s *bufio.Scanner, Capacity uint32, falsePositiveRate float64) (BloomFilter2, error) {
+
+	_, _, Salts := Optimal(Capacity, falsePositiveRate)
+	bf := NewBloomFilter2(Capacity, falsePositiveRate, Salts)
+
+	for s.Scan() {
+		bf.Insert(s.Bytes())
+	}
+
+	return bf, s.Err()
+}
+
+// ExtendSalts returns Salts extended to n salts.
+// The extra salts are derived deterministically from the given ones, so peers extending the same salts get the same result.
+// If Salts already has n or more entries it is returned unchanged.
+func ExtendSalts(Salts []uint32, n uint) []uint32 {
+
+	if uint(len(Salts)) >= n {
+		return Salts
+	}
+
+	extended := make([]uint32, len(Salts), n)
+	copy(extended, Salts)
+
+	seen := make(map[uint32]bool, n)
+	for _, s := range Salts {
+		seen[s] = true
+	}
+
+	seed := uint32(0x9e3779b9)
+	for _, s := range Salts {
+		seed = fmix32(seed ^ s)
+	}
+
+	for i := uint32(1); uint(len(extended)) < n; i++ {
+		s := fmix32(seed + i*0x9e3779b9)
+		if !seen[s] {
+			seen[s] = true
+			extended = append(extended, s)
+		}
+	}
+
+	return extended
+}
+
+// NewExtendedBloomFilter2 returns a new bloom Filter like NewBloomFilter2, but if fewer Salts are given than SaltsRequired2 recommends they are first extended with ExtendSalts.
+// The salts actually used are returned so that peers can construct mergeable Filters.
+func NewExtendedBloomFilter2(Capacity uint32, falsePositiveRate float64, Salts []uint32) (BloomFilter2, []uint32) {
+
+	Salts = ExtendSalts(Salts, SaltsRequired2(Capacity, falsePositiveRate))
+
+	return NewBloomFilter2(Capacity, falsePositiveRate, Salts), Salts
+}
+
+// NewBloomFilterWithHLL returns a new bloom Filter like NewBloomFilter2 that also feeds every insert into a HyperLogLog sketch.
+// EstimateCountHLL then stays accurate, to about 1%, even when the Filter is so far over Capacity that nearly every bit is set and EstimateCount breaks down.
+// The sketch costs an extra 16 KiB and one more hash per insert.  It is not serialized.
+func NewBloomFilterWithHLL(Capacity uint32, falsePositiveRate float64, Salts []uint32) BloomFilter2 {
+
+	bf := NewBloomFilter2(Capacity, falsePositiveRate, Salts).(*bloomFilter2)
+	bf.hll = newHyperLogLog()
+
+	return bf
+}
+
+// expectedFPR returns the expected false positive rate of a Filter of m bits holding n Elements with k salts
+func expectedFPR(m uint64, n uint32, k int) float64 {
+	return math.Pow(1-math.Exp(-float64(k)*float64(n)/float64(m)), float64(k))
+}
+
+// optimalSalts returns the number of salts minimizing the false positive rate of a Filter of m bits holding n Elements
+func optimalSalts(m uint64, n uint32) int {
+	if n == 0 {
+		return 1
+	}
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		return 1
+	}
+	return k
+}
+
+// sizeForFile returns the largest power of two Bits, and the optimal number of salts for them, of a Filter for n Elements whose MarshalBinary output fits in maxBytes
+func sizeForFile(maxBytes int, n uint32) (uint64, int, error) {
+
+	// each salt costs a 4 byte length and 4 bytes of salt
+	avail := maxBytes - HeaderSize - checksumSize - 8
+	if avail < 4 {
+		return 0, 0, fmt.Errorf("dgobloom: %d bytes is too small for a filter", maxBytes)
+	}
+
+	// bit indices are 32-bit hashes, so a larger bit vector would go unused
+	m := uint64(1) << 32
+	if uint64(avail) < m/8 {
+		m = nextPowerOfTwo2(uint64(avail)*8+1) / 2
+	}
+	for ; m >= 32; m /= 2 {
+		k := optimalSalts(m, n)
+		if HeaderSize+8*k+int(m/8)+checksumSize <= maxBytes {
+			break
+		}
+	}
+	if m < 32 {
+		return 0, 0, fmt.Errorf("dgobloom: %d bytes is too small for a filter", maxBytes)
+	}
+
+	return m, optimalSalts(m, n), nil
+}
+
+// ParetoPoint is the best false positive rate reachable within a memory budget, as returned by ParetoSuggest.
+type ParetoPoint struct {
+	Bytes uint64  // budget for the MarshalBinary output
+	Bits  uint64  // size of the bit vector; 0 if no Filter fits
+	Salts int     // optimal number of salts for Bits
+	FPR   float64 // expected false positive rate at Capacity; 1 if no Filter fits
+}
+
+// ParetoSuggest returns, for each budget in maxBytes, the lowest false positive rate a Filter for Capacity Elements can reach in that many bytes,
+// sized as NewBloomFilterForFileSize would size it, for plotting the space/accuracy tradeoff.
+// Bits are a power of two, so the rate only improves when a budget allows the bit vector to double.
+func ParetoSuggest(Capacity uint32, maxBytes []uint64) []ParetoPoint {
+
+	points := make([]ParetoPoint, len(maxBytes))
+	for i, n := range maxBytes {
+		points[i] = ParetoPoint{Bytes: n, FPR: 1}
+
+		budget := n
+		if budget > math.MaxInt {
+			budget = math.MaxInt
+		}
+
+		if m, k, err := sizeForFile(int(budget), Capacity); err == nil {
+			points[i].Bits, points[i].Salts, points[i].FPR = m, k, expectedFPR(m, Capacity, k)
+		}
+	}
+
+	return points
+}
+
+// NewBloomFilterForFileSize returns the bloom Filter for estimatedElements with the lowest false positive rate whose MarshalBinary output fits in maxBytes, together with that rate.
+// It picks the largest power of two Bits that fits and the optimal number of salts for it; the salts are generated with math/rand.
+// The bit vector of a well filled Filter is close to random and does not compress, so maxBytes should not count on gzip.
+func NewBloomFilterForFileSize(maxBytes int, estimatedElements uint32) (BloomFilter2, float64, error) {
+
+	m, k, err := sizeForFile(maxBytes, estimatedElements)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	Salts := make([]uint32, k)
+	for i := range Salts {
+		Salts[i] = rand.Uint32()
+	}
+
+	fpr := expectedFPR(m, estimatedElements, k)
+
+	bf := NewBloomFilterMin(estimatedElements, fpr, Salts, m).(*bloomFilter2)
+	if bf.Bits != m {
+		bf.Bits = m
+		bf.Filter = newBitvector2(int(m+31) / 32)
+	}
+
+	return bf, fpr, nil
+}
+
+// testSeed seeds the salts of NewTestBloomFilter
+const testSeed = 20111201
+
+// NewTestBloomFilter returns a new bloom Filter with salts generated from a fixed seed.
+// Every call with the same arguments returns an identical, mergeable Filter, which makes it convenient for tests.
+// The salts are public knowledge, so it should not be used where callers may be adversarial.
+func NewTestBloomFilter(Capacity uint32, falsePositiveRate float64) BloomFilter2 {
+
+	r := rand.New(rand.NewSource(testSeed))
+
+	Salts := make([]uint32, SaltsRequired2(Capacity, falsePositiveRate))
+	for i := range Salts {
+		Salts[i] = r.Uint32()
+	}
+
+	return NewBloomFilter2(Capacity, falsePositiveRate, Salts)
+}
+
+// fmix32 is the murmur3 32-bit finalizer
+func fmix32(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// ErrKeySize is returned when a SipHash key is not 16 bytes long.
+var ErrKeySize = errors.New("dgobloom: key must be 16 bytes")
+
+// ErrNoKey is returned when a keyed bloom Filter is used before its key has been set.
+var ErrNoKey = errors.New("dgobloom: keyed filter has no key; call SetKey")
+
+// NewKeyedBloomFilter returns a new bloom Filter with the specified Capacity and false positive rate whose bit locations are computed with SipHash-2-4 under the 16 byte secret key.
+// With a plain salted FNV hash, an attacker who knows the salts can craft keys that all land on the same bits and drive up the false positive rate;
+// without the key the locations are unpredictable.  The salts are fixed and need not be secret.
+// The key is never serialized: a keyed Filter that has been read back must have SetKey called with the same key before use.
+func NewKeyedBloomFilter(Capacity uint32, falsePositiveRate float64, key []byte) (BloomFilter2, error) {
+
+	Salts := make([]uint32, SaltsRequired2(Capacity, falsePositiveRate))
+	for i := range Salts {
+		Salts[i] = uint32(i)
+	}
+
+	bf := NewBloomFilter2(Capacity, falsePositiveRate, Salts).(*bloomFilter2)
+	bf.Keyed = true
+
+	if err := bf.SetKey(key); err != nil {
+		return nil, err
+	}
+
+	return bf, nil
+}
+
+// SetKey installs the 16 byte secret key of a keyed bloom Filter.
+// A new key changes every answer of the Filter, so it is refused with ErrReadOnly on a read-only Filter.
+func (bf *bloomFilter2) SetKey(key []byte) error {
+
+	if bf.readOnly {
+		return ErrReadOnly
+	}
+
+	if len(key) != 16 {
+		return ErrKeySize
+	}
+
+	bf.sipKey[0] = binary.LittleEndian.Uint64(key[:8])
+	bf.sipKey[1] = binary.LittleEndian.Uint64(key[8:])
+	bf.hasKey = true
+
+	return nil
+}
+
+// ErrNoPepper is returned when a peppered bloom Filter is used before its pepper has been set.
+var ErrNoPepper = errors.New("dgobloom: peppered filter has no pepper; call SetPepper")
+
+// NewPepperedBloomFilter returns a new bloom Filter like NewBloomFilter2 that replaces every element by its HMAC-SHA256 under the secret pepper
+// before the usual salted hashing, for holding membership of sensitive identifiers such as email addresses or phone numbers.
+//
+// Such identifiers come from small, guessable spaces.  Anyone holding the bit vector and salts of a plain Filter can hash every candidate offline
+// and keep those that test present, recovering most of the members along with a few false positives.
+// With a pepper the candidates cannot be tested without it, so a leaked or published Filter reveals only its size and fill.
+// Only that a pepper was used is serialized, never the pepper: a Filter that has been read back must have SetPepper called with the same pepper
+// before use, and must be stored apart from it for the protection to mean anything.
+//
+// The pepper protects the serialized Filter, not a live one: whoever can query it, or learns the pepper, can test candidates as before,
+// and a false positive rate chosen for deniability is the only protection left then.  Changing the pepper means rebuilding from the original elements.
+// Each insert and lookup computes an HMAC and allocates, so peppered Filters are several times slower than plain ones.
+func NewPepperedBloomFilter(Capacity uint32, falsePositiveRate float64, Salts []uint32, pepper []byte) (BloomFilter2, error) {
+
+	bf := NewBloomFilter2(Capacity, falsePositiveRate, Salts).(*bloomFilter2)
+	bf.Peppered = true
+
+	if err := bf.SetPepper(pepper); err != nil {
+		return nil, err
+	}
+
+	return bf, nil
+}
+
+// SetPepper installs the secret pepper of a peppered bloom Filter; it must not be empty.
+// A new pepper changes every answer of the Filter, so it is refused with ErrReadOnly on a read-only Filter.
+func (bf *bloomFilter2) SetPepper(pepper []byte) error {
+
+	if bf.readOnly {
+		return ErrReadOnly
+	}
+
+	if len(pepper) == 0 {
+		return errors.New("dgobloom: empty pepper")
+	}
+
+	bf.pepper = append([]byte(nil), pepper...)
+
+	return nil
+}
+
+// pepperKey returns the HMAC of b under the pepper, the element a peppered Filter hashes in place of b
+func (bf *bloomFilter2) pepperKey(b []byte) []byte {
+	mac := hmac.New(sha256.New, bf.pepper)
+	mac.Write(b)
+	return mac.Sum(nil)
+}
+
+// newHash returns the hash function used to compute bit locations
+func (bf *bloomFilter2) newHash() hash.Hash32 {
+	if bf.Keyed {
+		return newSipDigest(bf.sipKey[0], bf.sipKey[1])
+	}
+	return fnv.New32()
+}
+
+// location returns the bit index for byte array b hashed with salt s
+func (bf *bloomFilter2) location(h hash.Hash32, s []byte, b []byte) uint32 {
+	h.Reset()
+	h.Write(s)
+	h.Write(b)
+
+	return bf.index(h.Sum32())
+}
+
+// index maps the salted hash v to a bit index
+func (bf *bloomFilter2) index(v uint32) uint32 {
+	if bf.Mix {
+		v = fmix32(v)
+	}
+
+	return uint32(uint64(v) % bf.Bits)
+}
+
+// wideHash returns the two halves of the 128-bit FNV-1a hash of the first salt followed by b.
+// FNV mixes the low half poorly for short inputs, so both halves are finalized with fmix64, and the second is made odd so that every step of double hashing moves.
+func (bf *bloomFilter2) wideHash(ctx *QueryContext, b []byte) (uint64, uint64) {
+	h, sum := ctx.hash128()
+	if len(bf.Salts) > 0 {
+		h.Write(bf.Salts[0])
+	}
+	h.Write(b)
+
+	sum = h.Sum(sum)
+
+	return fmix64(binary.BigEndian.Uint64(sum[:8])), fmix64(binary.BigEndian.Uint64(sum[8:])) | 1
+}
+
+// wideIndex returns the i'th bit index derived from the hash halves h1 and h2 by double hashing
+func (bf *bloomFilter2) wideIndex(h1, h2 uint64, i int) uint64 {
+	return (h1 + uint64(i)*h2) % bf.Bits
+}
+
+// fnv32 returns the 32-bit FNV-1 hash of s followed by b, the same value as fnv.New32 but computed inline so it does not allocate
+func fnv32(s []byte, b []byte) uint32 {
+	return fnv32Add(fnv32Add(fnv32Offset, s), b)
+}
+
+const (
+	fnv32Offset = 2166136261
+	fnv32Prime  = 16777619
+)
+
+// fnv32Add continues the FNV-1 hash h over b
+func fnv32Add(h uint32, b []byte) uint32 {
+	for _, c := range b {
+		h *= fnv32Prime
+		h ^= uint32(c)
+	}
+	return h
+}
+
+// Insert inserts the byte array b into the bloom Filter.
+// If the function returns false, the Capacity of the bloom Filter has been reached.  Further inserts will increase the rate of false positives.
+// A read-only Filter is left unchanged and Insert returns false; use InsertStrict to get ErrReadOnly instead.
+func (bf *bloomFilter2) Insert(b []byte) bool { return bf.insert(nil, b) }
+
+// insert is Insert hashing with the hashers of ctx, or fresh ones if ctx is nil
+func (bf *bloomFilter2) insert(ctx *QueryContext, b []byte) bool {
+
+	if bf.readOnly {
+		return false
+	}
+
+	bf.Elements++
+	bf.pending++
+
+	if bf.onInsert != nil {
+		bf.onInsert(b, bf.insertBits(ctx, b))
+		return bf.Elements < bf.Capacity
+	}
+
+	if bf.Wide || bf.listsIndices() {
+		bf.insertBits(ctx, b)
+		return bf.Elements < bf.Capacity
+	}
+
+	h := ctx.hash32(bf)
+
+	if bf.hll != nil {
+		bf.hll.add(b)
+	}
+
+	for _, s := range bf.Salts {
+		bf.Filter.set(uint64(bf.location(h, s, b)))
+	}
+
+	return bf.Elements < bf.Capacity
+}
+
+// ErrEmptyKey is returned when inserting a nil or empty byte array with InsertStrict.
+var ErrEmptyKey = errors.New("dgobloom: empty key")
+
+// InsertStrict is Insert, except that a nil or empty b is rejected with ErrEmptyKey instead of being stored, and writes to a read-only Filter fail with ErrReadOnly.
+// An empty element is almost always a caller bug, and once inserted every later empty lookup matches it.
+// Use Insert to store empty elements deliberately.
+func (bf *bloomFilter2) InsertStrict(b []byte) (bool, error) {
+
+	if bf.readOnly {
+		return false, ErrReadOnly
+	}
+
+	if len(b) == 0 {
+		return bf.Elements < bf.Capacity, ErrEmptyKey
+	}
+
+	return bf.Insert(b), nil
+}
+
+// insertBits sets the bits for b and reports whether any of them were previously unset
+func (bf *bloomFilter2) insertBits(ctx *QueryContext, b []byte) bool {
+	if bf.hll != nil {
+		bf.hll.add(b)
+	}
+
+	novel := false
+
+	if bf.Wide && !bf.Peppered {
+		h1, h2 := bf.wideHash(ctx, b)
+		for i := range bf.Salts {
+			if !bf.Filter.testAndSet(bf.wideIndex(h1, h2, i)) {
+				novel = true
+			}
+		}
+		return novel
+	}
+
+	if bf.listsIndices() {
+		for _, x := range bf.Indices(b) {
+			if !bf.Filter.testAndSet(x) {
+				novel = true
+			}
+		}
+		return novel
+	}
+
+	h := ctx.hash32(bf)
+	for _, s := range bf.Salts {
+		if !bf.Filter.testAndSet(uint64(bf.location(h, s, b))) {
+			novel = true
+		}
+	}
+
+	return novel
+}
+
+// InsertNew inserts the byte array b into the bloom Filter and returns true if b was (probably) not present before, that is, if at least one of its bits was previously unset.
+// A false return means b, or a set of colliding Elements, had already been inserted.
+// Unlike Insert, Len is only incremented for new Elements, so re-inserting duplicates does not use up Capacity.
+func (bf *bloomFilter2) InsertNew(b []byte) bool {
+
+	if bf.readOnly {
+		return false
+	}
+
+	novel := bf.insertBits(nil, b)
+
+	if novel {
+		bf.Elements++
+		bf.pending++
+	}
+
+	if bf.onInsert != nil {
+		bf.onInsert(b, novel)
+	}
+
+	return novel
+}
+
+// OnInsert registers fn to be called after every Insert and InsertNew with the element and whether it was new, as InsertNew reports it.
+// Only one observer is kept; a nil fn removes it.  Without an observer Insert does no extra work.
+// The observer is not serialized or carried over by Freeze and Without.
+func (bf *bloomFilter2) OnInsert(fn func(b []byte, novel bool)) {
+	bf.onInsert = fn
+}
+
+// Exists checks the bloom Filter for the byte array b
+func (bf *bloomFilter2) Exists(b []byte) bool { return bf.exists(nil, b) }
+
+// InsertString inserts the bytes of s, as Insert([]byte(s)) would.
+func (bf *bloomFilter2) InsertString(s string) bool { return bf.Insert([]byte(s)) }
+
+// ExistsString checks the bloom Filter for the bytes of s, as Exists([]byte(s)) would.
+func (bf *bloomFilter2) ExistsString(s string) bool { return bf.Exists([]byte(s)) }
+
+// Membership is the answer of a bloom Filter to a query: an element is either certainly absent or only probably present.
+type Membership int
+
+const (
+	DefinitelyNot Membership = iota // no element mapping to these bits was inserted
+	ProbablyYes                     // present, or a false positive
+)
+
+func (m Membership) String() string {
+	switch m {
+	case DefinitelyNot:
+		return "definitely not"
+	case ProbablyYes:
+		return "probably yes"
+	}
+	return fmt.Sprintf("Membership(%d)", int(m))
+}
+
+// membership converts the result of Exists
+func membership(found bool) Membership {
+	if found {
+		return ProbablyYes
+	}
+	return DefinitelyNot
+}
+
+// Query checks the bloom Filter for the byte array b as Exists does, with a result whose type spells out that a positive is not certain.
+func (bf *bloomFilter2) Query(b []byte) Membership { return membership(bf.Exists(b)) }
+
+// exists is Exists hashing with the hashers of ctx, or fresh ones if ctx is nil
+func (bf *bloomFilter2) exists(ctx *QueryContext, b []byte) bool {
+
+	if bf.Wide && !bf.Peppered {
+		h1, h2 := bf.wideHash(ctx, b)
+		for i := range bf.Salts {
+			if bf.Filter.get(bf.wideIndex(h1, h2, i)) == 0 {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if bf.listsIndices() {
+		for _, x := range bf.Indices(b) {
+			if bf.Filter.get(x) == 0 {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if !bf.Keyed {
+		// fast path: hash inline rather than through hash.Hash32, so lookups make no allocations
+		for _, s := range bf.Salts {
+			if bf.Filter.get(uint64(bf.index(fnv32(s, b)))) == 0 {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	h := ctx.hash32(bf)
+
+	for _, s := range bf.Salts {
+		if bf.Filter.get(uint64(bf.location(h, s, b))) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AnyPresent checks the bloom Filter for each of items in order and returns the index of the first one present, stopping there.
+// It returns -1 and false if none is present.  One set of hashers is reused for the whole batch.
+func (bf *bloomFilter2) AnyPresent(items [][]byte) (index int, found bool) {
+	return bf.anyPresent(NewQueryContext(), items)
+}
+
+// anyPresent is AnyPresent hashing with ctx
+func (bf *bloomFilter2) anyPresent(ctx *QueryContext, items [][]byte) (int, bool) {
+
+	for i, b := range items {
+		if bf.exists(ctx, b) {
+			return i, true
+		}
+	}
+
+	return -1, false
+}
+
+// InsertUint64 inserts x encoded as 8 big-endian bytes, exactly as Insert would insert the encoded bytes.
+// For unkeyed Filters without an observer or HyperLogLog sketch it makes no allocations.
+func (bf *bloomFilter2) InsertUint64(x uint64) bool {
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], x)
+
+	if bf.readOnly || bf.Keyed || bf.Wide || bf.listsIndices() || bf.onInsert != nil || bf.hll != nil {
+		// these paths let the key escape, so hand them a heap copy and keep buf on the stack
+		return bf.Insert(append([]byte(nil), buf[:]...))
+	}
+
+	bf.Elements++
+	bf.pending++
+
+	for _, s := range bf.Salts {
+		bf.Filter.set(uint64(bf.index(fnv32(s, buf[:]))))
+	}
+
+	return bf.Elements < bf.Capacity
+}
+
+// ExistsUint64 checks the bloom Filter for x encoded as 8 big-endian bytes.  For unkeyed Filters it makes no allocations.
+func (bf *bloomFilter2) ExistsUint64(x uint64) bool {
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], x)
+
+	if bf.Keyed || bf.Wide || bf.listsIndices() {
+		return bf.Exists(append([]byte(nil), buf[:]...))
+	}
+
+	for _, s := range bf.Salts {
+		if bf.Filter.get(uint64(bf.index(fnv32(s, buf[:])))) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ExistsPrescreen checks the bloom Filter for the byte array b using only the first j salts, as a cheap early-out for workloads where most lookups miss.
+// A false result is definite: b was never inserted.  A true result only means b passed the prescreen, with a higher false positive rate than Exists, and should be confirmed with Exists.
+// A j of zero or less tests nothing and returns true; a j beyond the number of salts is Exists.
+func (bf *bloomFilter2) ExistsPrescreen(b []byte, j int) bool {
+
+	if j > len(bf.Salts) {
+		j = len(bf.Salts)
+	}
+	if j < 0 {
+		j = 0
+	}
+
+	if bf.Wide && !bf.Peppered {
+		h1, h2 := bf.wideHash(nil, b)
+		for i := 0; i < j; i++ {
+			if bf.Filter.get(bf.wideIndex(h1, h2, i)) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	if bf.listsIndices() {
+		for _, x := range bf.firstIndices(b, j) {
+			if bf.Filter.get(x) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !bf.Keyed {
+		for _, s := range bf.Salts[:j] {
+			if bf.Filter.get(uint64(bf.index(fnv32(s, b)))) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	h := bf.newHash()
+	for _, s := range bf.Salts[:j] {
+		if bf.Filter.get(uint64(bf.location(h, s, b))) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ExistsLimited checks the bloom Filter for the byte array b using at most maxSalts salts, an explicit bound on the work of a lookup for latency-sensitive paths.
+// It never gives a false negative, but the false positive rate rises from about f^k towards f^maxSalts, where f is the fraction of bits set and k the number of salts:
+// in a Filter at Capacity, about half the bits are set, so each salt left out doubles it.  It is ExistsPrescreen under a name for this use.
+func (bf *bloomFilter2) ExistsLimited(b []byte, maxSalts int) bool {
+	return bf.ExistsPrescreen(b, maxSalts)
+}
+
+// ExistsDebug checks the bloom Filter for the byte array b as Exists does, and for an absent b also returns the index of the first salt whose bit is clear,
+// to see whether some salts reject far more often than others.  firstZeroSalt is -1 when b tests present.
+// It computes every index through Indices, so it allocates and is slower than Exists; keep it off hot paths.
+func (bf *bloomFilter2) ExistsDebug(b []byte) (present bool, firstZeroSalt int) {
+
+	for i, x := range bf.Indices(b) {
+		if bf.Filter.get(x) == 0 {
+			return false, i
+		}
+	}
+
+	return true, -1
+}
+
+// TouchAndMaybeInsert checks the bloom Filter for the byte array b and reports whether it was present.
+// If b is absent it is inserted with probability p, so a stream of lookups slowly populates the Filter with a sample of the keys that miss.
+// Keys that occur often are likely to be inserted early, which makes this useful for approximate heavy-hitter detection.
+// A p of 0 never inserts and a p of 1 always inserts; present keys are never reinserted and do not count towards Len.
+// This is separate from Insert and does not report whether Capacity has been reached.
+func (bf *bloomFilter2) TouchAndMaybeInsert(b []byte, p float64) bool {
+
+	if bf.Exists(b) {
+		return true
+	}
+
+	random := bf.random
+	if random == nil {
+		random = rand.Float64
+	}
+
+	if random() < p {
+		bf.Insert(b)
+	}
+
+	return false
+}
+
+// ErrIncompatible is returned when two bloom Filters do not have the same dimensions and salts.
+var ErrIncompatible = errors.New("dgobloom: incompatible filters")
+
+// compatible checks that other can be merged into bf
+func (bf *bloomFilter2) compatible(other *bloomFilter2) error {
+
+	if diffs := bf.mergeConflicts(other); len(diffs) > 0 {
+		return fmt.Errorf("%w: %s", ErrIncompatible, diffs[0])
+	}
+
+	return nil
+}
+
+// mergeConflicts lists every difference that prevents merging other into bf, most fundamental first
+func (bf *bloomFilter2) mergeConflicts(other *bloomFilter2) []string {
+
+	var diffs []string
+
+	// listed first: no choice of dimensions makes such Filters mergeable
+	if len(bf.Salts) != len(other.Salts) {
+		diffs = append(diffs, fmt.Sprintf("%d salts != %d salts; filters with different numbers of hash functions cannot be merged, rebuild them with MergeRebuild", len(bf.Salts), len(other.Salts)))
+	}
+
+	if bf.Bits != other.Bits || len(bf.Filter) != len(other.Filter) {
+		diffs = append(diffs, fmt.Sprintf("Bits %d != %d", bf.Bits, other.Bits))
+	}
+
+	if bf.Mix != other.Mix {
+		diffs = append(diffs, "hash mixing differs")
+	}
+
+	if bf.Wide != other.Wide {
+		diffs = append(diffs, "one filter uses wide hashing")
+	}
+
+	if bf.Strict != other.Strict {
+		diffs = append(diffs, "one filter is strict")
+	}
+
+	if (bf.indexFn == nil) != (other.indexFn == nil) {
+		diffs = append(diffs, "one filter uses a custom index function")
+	}
+
+	if bf.Partitioned != other.Partitioned {
+		diffs = append(diffs, "one filter is partitioned")
+	}
+
+	if bf.LittleEndian != other.LittleEndian {
+		diffs = append(diffs, "salt byte orders differ")
+	}
+
+	if bf.Keyed != other.Keyed || bf.sipKey != other.sipKey {
+		diffs = append(diffs, "hash keys differ")
+	}
+
+	if bf.Peppered != other.Peppered || !hmac.Equal(bf.pepper, other.pepper) {
+		diffs = append(diffs, "peppers differ")
+	}
+
+	for i := 0; i < len(bf.Salts) && i < len(other.Salts); i++ {
+		if !bytes.Equal(bf.Salts[i], other.Salts[i]) {
+			diffs = append(diffs, fmt.Sprintf("salt %d differs", i))
+		}
+	}
+
+	return diffs
+}
+
+// Compatibility lists every difference between bf and other that Merge would reject, in the words of its errors, followed by differences that do not prevent merging, such as Capacity.
+// Merge succeeds exactly when every entry, if there are any, is marked as not preventing merging.
+func (bf *bloomFilter2) Compatibility(other BloomFilter2) []string {
+
+	o, ok := unwrapCached(other).(*bloomFilter2)
+	if !ok {
+		return []string{fmt.Sprintf("unsupported filter type %T", other)}
+	}
+
+	diffs := bf.mergeConflicts(o)
+
+	if bf.Capacity != o.Capacity {
+		diffs = append(diffs, fmt.Sprintf("Capacity %d != %d (does not prevent merging)", bf.Capacity, o.Capacity))
+	}
+
+	return diffs
+}
+
+// compatibleWith checks that bf2 is a bloom Filter that can be merged into bf and returns it
+func (bf *bloomFilter2) compatibleWith(bf2 BloomFilter2) (*bloomFilter2, error) {
+
+	other, ok := unwrapCached(bf2).(*bloomFilter2)
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported filter type %T", ErrIncompatible, bf2)
+	}
+
+	if err := bf.compatible(other); err != nil {
+		return nil, err
+	}
+
+	return other, nil
+}
+
+// Merge adds bf2 into the current bloom Filter, and its Len to Len.  They must have the same dimensions and be constructed with identical random seeds.
+// ErrIncompatible is returned, and the Filter left unchanged, if they do not.
+func (bf *bloomFilter2) Merge(bf2 BloomFilter2) error {
+
+	if bf.readOnly {
+		return ErrReadOnly
+	}
+
+	other, err := bf.compatibleWith(bf2)
+	if err != nil {
+		return err
+	}
+
+	for i, v := range other.Filter {
+		bf.Filter[i] |= v
+	}
+
+	bf.mergeMetadata(other)
+
+	return nil
+}
+
+// UnionWithOverlap merges other into the bloom Filter as Merge does, and sets Elements to the sum of both counts less overlapEstimate, the number of Elements thought to be in both.
+// Merge sums the counts, which over-counts overlapping sets; with an overlap estimate LoadRatio and Len stay meaningful.
+// The estimate is clamped so the count is never below the larger of the two.
+func (bf *bloomFilter2) UnionWithOverlap(other BloomFilter2, overlapEstimate uint32) error {
+
+	a, b := uint64(bf.Elements), uint64(other.Len())
+
+	if err := bf.Merge(other); err != nil {
+		return err
+	}
+
+	overlap := uint64(overlapEstimate)
+	if overlap > a {
+		overlap = a
+	}
+	if overlap > b {
+		overlap = b
+	}
+
+	n := a + b - overlap
+	if n > math.MaxUint32 {
+		n = math.MaxUint32
+	}
+	bf.Elements = uint32(n)
+
+	return nil
+}
+
+// MergeRebuild returns a new bloom Filter holding the union of several sets, given the items of each, for sets whose Filters cannot be merged.
+// Merge ORs bit vectors, which is only correct when both Filters set bits the same way; Filters with different numbers of salts, salts or dimensions map an element to different bits, and the union can only be built again from the items.
+// The new Filter is sized for the total number of items at falsePositiveRate and uses Salts; items present in several sets are counted once per set.
+func MergeRebuild(falsePositiveRate float64, Salts []uint32, itemSets ...[][]byte) BloomFilter2 {
+
+	Capacity := uint32(0)
+	for _, items := range itemSets {
+		Capacity += uint32(len(items))
+	}
+
+	bf := NewBloomFilter2(Capacity, falsePositiveRate, Salts)
+	for _, items := range itemSets {
+		for _, b := range items {
+			bf.Insert(b)
+		}
+	}
+
+	return bf
+}
+
+// UnionWithStats returns the union of the compatible bloom Filters, as merging them all into an empty copy of the first would build it,
+// together with the number of bits each one newly set, in order: the first Filter is credited with all of its bits, each later one only with those no earlier Filter had set.
+// The contributions show which sources dominate a union of shards.  Len of the union is the sum of the sources' Len, an over-count when they overlap.
+// The Filters must be compatible, as for Merge; the error names the first that is not.
+func UnionWithStats(filters ...BloomFilter2) (BloomFilter2, []int, error) {
+
+	if len(filters) == 0 {
+		return nil, nil, errors.New("dgobloom: no filters to union")
+	}
+
+	union, ok := EmptyLike(filters[0]).(*bloomFilter2)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: unsupported filter type %T", ErrIncompatible, filters[0])
+	}
+
+	added := make([]int, len(filters))
+	for i, f := range filters {
+		other, err := union.compatibleWith(f)
+		if err != nil {
+			return nil, nil, fmt.Errorf("filter %d: %w", i, err)
+		}
+
+		for j, v := range other.Filter {
+			added[i] += bits.OnesCount32(v &^ union.Filter[j])
+			union.Filter[j] |= v
+		}
+
+		union.mergeMetadata(other)
+	}
+
+	return union, added, nil
+}
+
+// mergeMetadata combines everything but the bit vector of other into bf
+func (bf *bloomFilter2) mergeMetadata(other *bloomFilter2) {
+
+	if n := uint64(bf.Elements) + uint64(other.Elements); n > math.MaxUint32 {
+		bf.Elements = math.MaxUint32
+	} else {
+		bf.Elements = uint32(n)
+	}
+
+	if other.FalsePositiveRate > bf.FalsePositiveRate {
+		bf.FalsePositiveRate = other.FalsePositiveRate
+	}
+
+	if bf.hll != nil && other.hll != nil {
+		bf.hll.merge(other.hll)
+	}
+}
+
+// MergeParallel is Merge with the word range split across workers goroutines.
+// The goroutines write disjoint words, so no locking is needed; it pays off for Filters of many megabytes.
+func (bf *bloomFilter2) MergeParallel(bf2 BloomFilter2, workers int) error {
+
+	if bf.readOnly {
+		return ErrReadOnly
+	}
+
+	other, err := bf.compatibleWith(bf2)
+	if err != nil {
+		return err
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(bf.Filter) {
+		workers = len(bf.Filter)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		start, end := w*len(bf.Filter)/workers, (w+1)*len(bf.Filter)/workers
+		wg.Add(1)
+		go func(dst, src bitvector2) {
+			defer wg.Done()
+			for i, v := range src {
+				dst[i] |= v
+			}
+		}(bf.Filter[start:end], other.Filter[start:end])
+	}
+	wg.Wait()
+
+	bf.mergeMetadata(other)
+
+	return nil
+}
+
+// InsertAllParallel inserts items with the slice split across workers goroutines and returns the number inserted, which is added to Len.
+// The goroutines set bits with atomic operations, so their writes to a shared word are not lost, and the result is the Filter serial Inserts would build.
+// It must not run concurrently with other writes to the Filter.  Filters with an observer or a HyperLogLog sketch, which are not safe for concurrent use, are filled serially.
+func (bf *bloomFilter2) InsertAllParallel(items [][]byte, workers int) int {
+
+	if bf.readOnly {
+		return 0
+	}
+
+	if workers > len(items) {
+		workers = len(items)
+	}
+	if workers <= 1 || bf.onInsert != nil || bf.hll != nil {
+		for _, b := range items {
+			bf.Insert(b)
+		}
+		return len(items)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(chunk [][]byte) {
+			defer wg.Done()
+			for _, b := range chunk {
+				if bf.Keyed || bf.Wide || bf.listsIndices() {
+					for _, x := range bf.Indices(b) {
+						bf.Filter.setAtomic(x)
+					}
+					continue
+				}
+				for _, s := range bf.Salts {
+					bf.Filter.setAtomic(uint64(bf.index(fnv32(s, b))))
+				}
+			}
+			atomic.AddUint32(&bf.Elements, uint32(len(chunk)))
+		}(items[w*len(items)/workers : (w+1)*len(items)/workers])
+	}
+	wg.Wait()
+	bf.pending += uint32(len(items))
+
+	return len(items)
+}
+
+// MergeFrom decodes a serialized bloom Filter from r and merges it into the current one.
+func (bf *bloomFilter2) MergeFrom(r io.Reader) error {
+
+	if bf.readOnly {
+		return ErrReadOnly
+	}
+
+	other, err := ReadFrom(r)
+	if err != nil {
+		return err
+	}
+
+	return bf.Merge(other)
+}
+
+// Compress halves the space used by the bloom Filter, at the cost of increased error rate.
+// Capacity is halved along with the bit vector, since the smaller Filter only holds half as many Elements at the original false positive rate; Len is unchanged, so LoadRatio doubles.
+// The bit vector must have a power of two number of words, and more than one.
+// Partitioned and strict Filters cannot be compressed, since where their indices land depends on Bits; rebuild them at the smaller size instead.
+func (bf *bloomFilter2) Compress() error {
+
+	if bf.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := bf.foldable(); err != nil {
+		return err
+	}
+
+	w := len(bf.Filter)
+
+	if w < 2 || w&(w-1) != 0 {
+		return fmt.Errorf("dgobloom: cannot compress a bit vector of %d words; the width must be a power of two greater than one", w)
+	}
+
+	neww := w / 2
+
+	// We allocate a new array here so old space can actually be garbage collected.
+	// TODO(dgryski): reslice and only reallocate every few compressions
+	row := newBitvector2(neww)
+	for j := 0; j < neww; j++ {
+		row[j] = bf.Filter[j] | bf.Filter[j+neww]
+	}
+	bf.Filter = row
+	bf.Bits /= 2
+	bf.Capacity /= 2
+
+	return nil
+}
+
+// foldable reports why Compress would lose Elements of bf, or nil if it keeps them all
+func (bf *bloomFilter2) foldable() error {
+	if bf.Partitioned {
+		return errors.New("dgobloom: cannot compress a partitioned filter; its indices depend on the partition size")
+	}
+	if bf.Strict {
+		return errors.New("dgobloom: cannot compress a strict filter; colliding indices are moved apart modulo Bits")
+	}
+	return nil
+}
+
+// CompressBy compresses the bloom Filter n times, dividing its size by 2^n.
+// It stops at the first Compress that fails and returns its error, leaving the compressions before it in place.
+func (bf *bloomFilter2) CompressBy(n int) error {
+
+	for i := 0; i < n; i++ {
+		if err := bf.Compress(); err != nil {
+			return fmt.Errorf("compression %d of %d: %w", i+1, n, err)
+		}
+	}
+
+	return nil
+}
+
+// MaxCompressions returns the largest n for which CompressBy(n) keeps the estimated false positive rate, as EstimatedFalsePositiveRate reports it, at or below maxFPR.
+// Compress ORs the two halves of the bit vector together, so with set bits spread evenly a fill of f becomes 1-(1-f)^2.
+// The result is 0 if the rate is already above maxFPR or the Filter cannot be compressed, and never more than the bit vector can be halved.
+func (bf *bloomFilter2) MaxCompressions(maxFPR float64) int {
+
+	if bf.foldable() != nil {
+		return 0
+	}
+
+	st := bf.Stats()
+	free := 1 - st.Fill
+
+	n := 0
+	for w := len(bf.Filter); w >= 2 && w&(w-1) == 0; w /= 2 {
+		free *= free
+		if math.Pow(1-free, float64(st.Salts)) > maxFPR {
+			break
+		}
+		n++
+	}
+
+	return n
+}
+
+// CompressAdvice compares two ways of shrinking a bloom Filter to the same number of Bits, as returned by CompressVsRebuildAdvice.
+type CompressAdvice struct {
+	Bits         uint64  // target size
+	Compressions int     // CompressBy argument reaching Bits
+	CompressFPR  float64 // estimated false positive rate after CompressBy(Compressions)
+	RebuildSalts int     // optimal number of salts for a rebuilt Filter of Bits holding the current Elements
+	RebuildFPR   float64 // expected false positive rate of that rebuilt Filter
+	Rebuild      bool    // whether rebuilding gives the lower rate
+}
+
+func (a CompressAdvice) String() string {
+	if a.Rebuild {
+		return fmt.Sprintf("rebuild at %d bits with %d salts: false positive rate %.3g, against %.3g compressing %d times", a.Bits, a.RebuildSalts, a.RebuildFPR, a.CompressFPR, a.Compressions)
+	}
+	return fmt.Sprintf("compress %d times to %d bits: false positive rate %.3g, against %.3g rebuilding", a.Compressions, a.Bits, a.CompressFPR, a.RebuildFPR)
+}
+
+// CompressVsRebuildAdvice estimates the false positive rate of shrinking the bloom Filter to targetBits by compressing it, using the fill model of MaxCompressions,
+// and by rebuilding it from the original items at targetBits with the optimal number of salts for the current Elements.
+// Compressing keeps the current salts and needs no access to the items, but rebuilding is usually more accurate after several compressions.
+// targetBits must be reachable by CompressBy: a power of two no larger than Bits, leaving at least one word.
+// For a Filter that cannot be compressed, any smaller targetBits is an error.
+func (bf *bloomFilter2) CompressVsRebuildAdvice(targetBits uint64) (CompressAdvice, error) {
+
+	n := 0
+	for b := bf.Bits; b > targetBits && b > 32; b /= 2 {
+		n++
+	}
+	if w := len(bf.Filter); targetBits < 32 || bf.Bits>>uint(n) != targetBits || (n > 0 && w&(w-1) != 0) {
+		return CompressAdvice{}, fmt.Errorf("dgobloom: %d bits cannot be reached by compressing %d bits", targetBits, bf.Bits)
+	}
+	if err := bf.foldable(); err != nil && n > 0 {
+		return CompressAdvice{}, err
+	}
+
+	st := bf.Stats()
+	free := 1 - st.Fill
+	for i := 0; i < n; i++ {
+		free *= free
+	}
+
+	a := CompressAdvice{
+		Bits:         targetBits,
+		Compressions: n,
+		CompressFPR:  math.Pow(1-free, float64(st.Salts)),
+		RebuildSalts: optimalSalts(targetBits, bf.Elements),
+	}
+	a.RebuildFPR = expectedFPR(targetBits, bf.Elements, a.RebuildSalts)
+	a.Rebuild = a.RebuildFPR < a.CompressFPR
+
+	return a, nil
+}
+
+// gobFilter2 has the fields of bloomFilter2 but not its MarshalBinary method, so gob keeps encoding the struct field by field
+type gobFilter2 bloomFilter2
+
+// ReadFrom decodes a bloom Filter serialized with WriteTo or Serialization from r.
+func ReadFrom(r io.Reader) (BloomFilter2, error) {
+	bf := new(bloomFilter2)
+
+	dec := gob.NewDecoder(r)
+	err := dec.Decode((*gobFilter2)(bf))
+	if err != nil {
+		return bf, err
+	}
+
+	// gob allocates its own slice; move the bits onto a cache line
+	aligned := newBitvector2(len(bf.Filter))
+	copy(aligned, bf.Filter)
+	bf.Filter = aligned
+
+	return bf, nil
+}
+
+// UnSerialization reads a bloom Filter from file, which may hold either the output of Serialization or of MarshalBinary, and may be gzip compressed.
+// The binary format is checksummed, so damage to such a file is reported as ErrCorruptData.
+func UnSerialization(file string) (BloomFilter2, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return new(bloomFilter2), err
+	}
+	defer fp.Close()
+
+	r := bufio.NewReader(fp)
+	if magic, err := r.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return new(bloomFilter2), err
+		}
+		defer zr.Close()
+		r = bufio.NewReader(zr)
+	}
+
+	if magic, err := r.Peek(len(binaryMagic)); err == nil && string(magic) == string(binaryMagic[:]) {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return new(bloomFilter2), err
+		}
+		bf := new(bloomFilter2)
+		return bf, bf.UnmarshalBinary(data)
+	}
+
+	return ReadFrom(r)
+}
+
+// ExistsAny checks a set of generational bloom Filters for b, reporting whether any of them holds it.
+// In a tiered setup of hot, warm and cold Filters, a false result means b is definitely new.
+// Pass the Filters newest first, the same order as InsertIntoNewest: recent keys are the most likely to be found, so the search stops early.
+func ExistsAny(b []byte, filters ...BloomFilter2) bool {
+
+	for _, bf := range filters {
+		if bf.Exists(b) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// InsertIntoNewest inserts b into the first of filters, the newest generation, and returns that Filter's Insert result; a false return is the signal to start a new generation.
+// With no Filters it does nothing and returns false.
+func InsertIntoNewest(b []byte, filters ...BloomFilter2) bool {
+
+	if len(filters) == 0 {
+		return false
+	}
+
+	return filters[0].Insert(b)
+}
+
+// MergeFiles merges the bloom Filters serialized in the input files and writes their union to out with Serialization.
+// The inputs may be in either format UnSerialization reads and must be compatible, as for Merge; they are read one at a time, so at most two Filters are in memory.
+// out is written to a temporary file that is renamed into place, so it is never left half written and may be one of the inputs.
+// A single input is copied; no inputs is an error, since there are no dimensions to build an empty Filter from.
+func MergeFiles(out string, inputs ...string) error {
+	return mergeFiles(out, func(w io.Writer, bf BloomFilter2) error {
+		_, err := bf.WriteTo(w)
+		return err
+	}, inputs)
+}
+
+// MergeGzipFiles is MergeFiles for pipelines that store Filters compressed: the inputs may be gzip compressed or not, detected by their magic bytes,
+// and out is written with Serialization and gzip compressed.
+func MergeGzipFiles(out string, inputs ...string) error {
+	return mergeFiles(out, func(w io.Writer, bf BloomFilter2) error {
+		zw := gzip.NewWriter(w)
+		if _, err := bf.WriteTo(zw); err != nil {
+			return err
+		}
+		return zw.Close()
+	}, inputs)
+}
+
+// mergeFiles merges the inputs and writes the union to out with write
+func mergeFiles(out string, write func(w io.Writer, bf BloomFilter2) error, inputs []string) error {
+
+	if len(inputs) == 0 {
+		return errors.New("dgobloom: no input files to merge")
+	}
+
+	acc, err := UnSerialization(inputs[0])
+	if err != nil {
+		return fmt.Errorf("%s: %w", inputs[0], err)
+	}
+
+	for _, in := range inputs[1:] {
+		bf, err := UnSerialization(in)
+		if err == nil {
+			err = acc.Merge(bf)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", in, err)
+		}
+	}
+
+	fp, err := os.CreateTemp(filepath.Dir(out), filepath.Base(out)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	if err = write(fp, acc); err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), out)
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+	}
+
+	return err
+}
+
+// FilesEquivalent reports whether the bloom Filters serialized in files a and b hold the same set, that is, have identical bit vectors by DiffCount,
+// for checking in CI that a regenerated Filter matches a reference.  The files may be in either format UnSerialization reads.
+// Len and Capacity are not compared, so Filters built from the same keys with and without duplicates are equivalent; use Equal to compare those too.
+// ErrIncompatible is returned if the Filters could not hold the same set, as for Merge.
+func FilesEquivalent(a, b string) (bool, error) {
+
+	fa, err := UnSerialization(a)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", a, err)
+	}
+
+	fb, err := UnSerialization(b)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", b, err)
+	}
+
+	n, err := fa.DiffCount(fb)
+	if err != nil {
+		return false, err
+	}
+
+	return n == 0, nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// WriteTo serializes the bloom Filter to w and returns the number of bytes written.  On success PendingInserts starts again from 0.
+func (bf *bloomFilter2) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	enc := gob.NewEncoder(cw)
+	err := enc.Encode((*gobFilter2)(bf))
+	if err == nil {
+		bf.pending = 0
+	}
+	return cw.n, err
+}
+
+// Serialization writes the bloom Filter to file.
+func (bf *bloomFilter2) Serialization(file string) error {
+	fp, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+
+	_, err = bf.WriteTo(fp)
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// ErrNoSalts is returned when a filter has no salts and so can never set or test any bits.
+var ErrNoSalts = errors.New("dgobloom: filter has no salts; rebuild it with the salts it was created with")
+
+// Validate checks that the filter dimensions are consistent: Bits must be a power of two,
+// the bit vector must hold exactly Bits bits and there must be at least one non-empty salt.
+// Filters built by hand or decoded from damaged input should be validated before use.
+func (bf *bloomFilter2) Validate() error {
+
+	if err := bf.validateLayout(); err != nil {
+		return err
+	}
+
+	if bf.Keyed && !bf.hasKey {
+		return ErrNoKey
+	}
+
+	if bf.Peppered && bf.pepper == nil {
+		return ErrNoPepper
+	}
+
+	return nil
+}
+
+// validateLayout runs the checks of Validate that depend only on serialized state, leaving out the key
+func (bf *bloomFilter2) validateLayout() error {
+
+	if bf.Bits == 0 || bf.Bits&(bf.Bits-1) != 0 {
+		return fmt.Errorf("dgobloom: Bits is %d, which is not a power of two; call Repair or rebuild the filter", bf.Bits)
+	}
+
+	if want := (bf.Bits + 31) / 32; uint64(len(bf.Filter)) != want {
+		return fmt.Errorf("dgobloom: bit vector has %d words but Bits=%d requires %d; call Repair", len(bf.Filter), bf.Bits, want)
+	}
+
+	if len(bf.Salts) == 0 {
+		return ErrNoSalts
+	}
+
+	for i, s := range bf.Salts {
+		if len(s) == 0 {
+			return fmt.Errorf("dgobloom: salt %d is empty; rebuild the filter with the salts it was created with", i)
+		}
+	}
+
+	return nil
+}
+
+// Repair fixes the dimensions of the filter so that Validate succeeds.
+// Bits is rounded up to the next power of two and the bit vector is reallocated to the matching length, keeping as many existing words as fit.
+// If Bits had to be changed, existing entries are hashed to different locations and the contents of the filter should be considered lost.
+// Missing salts cannot be repaired.
+func (bf *bloomFilter2) Repair() error {
+
+	if bf.readOnly {
+		return ErrReadOnly
+	}
+
+	if bf.Bits == 0 {
+		bf.Bits = 1024
+	}
+	bf.Bits = nextPowerOfTwo2(bf.Bits)
+
+	if want := int((bf.Bits + 31) / 32); len(bf.Filter) != want {
+		row := newBitvector2(want)
+		copy(row, bf.Filter)
+		bf.Filter = row
+	}
+
+	return bf.Validate()
+}
+
+// ErrReadOnly is returned when modifying a bloom Filter that cannot be written.
+var ErrReadOnly = errors.New("dgobloom: filter is read-only")
+
+// SetReadOnly makes the bloom Filter refuse writes, or allows them again.
+// While read-only, Merge, MergeFrom, MergeBytes, MergeParallel, Compress, Clear, Rotate, Repair, ApplyDiff, UnmarshalBinary, SetKey, AppendSalt and InsertStrict return ErrReadOnly, Insert, InsertNew and InsertHash return false, and InsertAllParallel inserts nothing; none of them change the Filter.
+// It is a guard against accidental writes, not a lock: toggling it while other goroutines write is a race.
+func (bf *bloomFilter2) SetReadOnly(readOnly bool) { bf.readOnly = readOnly }
+
+// ReadOnly reports whether the bloom Filter refuses writes.
+func (bf *bloomFilter2) ReadOnly() bool { return bf.readOnly }
+
+// FrozenBloomFilter2 is an immutable bloom Filter created by Freeze.
+// Because nothing can write to it, any number of goroutines may call Exists concurrently without synchronization.
+type FrozenBloomFilter2 struct {
+	bf *bloomFilter2
+}
+
+// Freeze returns an immutable copy of the bloom Filter, for the common build once, query many pattern.
+// The copy shares no memory with bf, so bf may continue to be modified.
+func (bf *bloomFilter2) Freeze() *FrozenBloomFilter2 {
+
+	frozen := *bf
+	frozen.Filter = newBitvector2(len(bf.Filter))
+	copy(frozen.Filter, bf.Filter)
+	frozen.Salts = make([][]byte, len(bf.Salts))
+	for i, s := range bf.Salts {
+		frozen.Salts[i] = append([]byte(nil), s...)
+	}
+	frozen.random = nil
+	frozen.hll = nil
+	frozen.onInsert = nil
+	frozen.exact = nil
+	frozen.checkpoint = nil
+	frozen.readOnly = true
+
+	return &FrozenBloomFilter2{bf: &frozen}
+}
+
+// Exists checks the frozen bloom Filter for the byte array b.  It is safe for concurrent use.
+func (f *FrozenBloomFilter2) Exists(b []byte) bool { return f.bf.Exists(b) }
+
+// Len returns the number of Elements stored in the bloom Filter when it was frozen.
+func (f *FrozenBloomFilter2) Len() uint32 { return f.bf.Len() }
+
+// Insert always fails with ErrReadOnly.
+func (f *FrozenBloomFilter2) Insert(b []byte) error {
+	_, err := f.bf.InsertStrict(b)
+	return err
+}
+
+// Merge always fails with ErrReadOnly.
+func (f *FrozenBloomFilter2) Merge(bf2 BloomFilter2) error { return f.bf.Merge(bf2) }
+
+// PopCount returns the number of bits set in the bloom Filter.
+func (bf *bloomFilter2) PopCount() uint64 {
+	var n uint64
+	for _, w := range bf.Filter {
+		n += uint64(bits.OnesCount32(w))
+	}
+	return n
+}
+
+// estimateCount returns the Swamidass-Baldi estimate of the number of distinct elements in a filter of m bits using k salts with x bits set
+func estimateCount(x, m uint64, k int) float64 {
+	if k == 0 {
+		return 0
+	}
+	return -float64(m) / float64(k) * math.Log(1-float64(x)/float64(m))
+}
+
+// EstimateCount estimates the number of distinct Elements inserted from the fraction of bits set.
+// Unlike Len, re-inserting an element does not change the estimate.  A saturated Filter returns +Inf.
+func (bf *bloomFilter2) EstimateCount() float64 {
+	return estimateCount(bf.PopCount(), bf.Bits, len(bf.Salts))
+}
+
+// UnionCountEstimate estimates the number of distinct Elements in the union of bf and other without building the union Filter.
+// The bloom Filters must be compatible, as for Merge.
+func (bf *bloomFilter2) UnionCountEstimate(other BloomFilter2) (float64, error) {
+
+	o, err := bf.compatibleWith(other)
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	for i, w := range bf.Filter {
+		n += uint64(bits.OnesCount32(w | o.Filter[i]))
+	}
+
+	return estimateCount(n, bf.Bits, len(bf.Salts)), nil
+}
+
+// Equal reports whether other has the same dimensions, salts, element count and bits as bf.
+func (bf *bloomFilter2) Equal(other BloomFilter2) bool {
+
+	o, ok := unwrapCached(other).(*bloomFilter2)
+	if !ok || bf.compatible(o) != nil {
+		return false
+	}
+
+	if bf.Capacity != o.Capacity || bf.Elements != o.Elements {
+		return false
+	}
+
+	for i, w := range bf.Filter {
+		if w != o.Filter[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Without supports deletion by rebuilding: it returns a new bloom Filter holding only items, which must be every element that should remain.
+// A bloom Filter cannot enumerate its contents, so the caller has to supply the authoritative remaining items; anything left out reports absent, barring false positives.
+// The new Filter uses the same salts and hashing as bf and is sized for the larger of bf's Capacity and len(items) at falsePositiveRate.
+func (bf *bloomFilter2) Without(items [][]byte, falsePositiveRate float64) BloomFilter2 {
+
+	Capacity := bf.Capacity
+	if uint64(len(items)) > uint64(Capacity) {
+		Capacity = uint32(len(items))
+	}
+
+	nbf := *bf
+	nbf.Capacity = Capacity
+	nbf.onInsert = nil
+	nbf.checkpoint = nil
+	nbf.readOnly = false
+	nbf.FalsePositiveRate = falsePositiveRate
+	nbf.Elements = 0
+	nbf.Bits = FilterBits2(Capacity, falsePositiveRate)
+	nbf.Filter = newBitvector2(int(nbf.Bits+31) / 32)
+	nbf.Salts = make([][]byte, len(bf.Salts))
+	for i, s := range bf.Salts {
+		nbf.Salts[i] = append([]byte(nil), s...)
+	}
+	if bf.hll != nil {
+		nbf.hll = newHyperLogLog()
+	}
+
+	for _, b := range items {
+		nbf.Insert(b)
+	}
+
+	return &nbf
+}
+
+// Shard is one contiguous piece of the bit vector of a bloom Filter, produced by Split.
+// Each Shard carries the Filter's metadata so that Combine can check the pieces belong together.
+// Its fields are exported so Shards can be persisted independently with gob.
+type Shard struct {
+	Index    int // position of this Shard
+	Count    int // total number of Shards
+	Offset   int // index of the first word of this Shard in the bit vector
+	Capacity uint32
+	Elements uint32
+	Bits     uint64
+	Salts    [][]byte
+	Mix      bool
+	Keyed    bool
+	Wide     bool
+	Strict   bool
+	FPR      float64
+	Words    []uint32
+
+	LittleEndian bool
+	Partitioned  bool
+	Peppered     bool
+	Tag          string // generation tag of the Filter
+}
+
+// Split partitions the bit vector of the bloom Filter into n nearly equal Shards, which Combine reassembles losslessly.
+// n must be between 1 and the number of words in the bit vector.
+func (bf *bloomFilter2) Split(n int) ([]*Shard, error) {
+
+	words := len(bf.Filter)
+	if n < 1 || n > words {
+		return nil, fmt.Errorf("dgobloom: cannot split %d words into %d shards", words, n)
+	}
+
+	// the Shards share one copy of the salts, so writes to bf do not show through them
+	salts := make([][]byte, len(bf.Salts))
+	for i, s := range bf.Salts {
+		salts[i] = append([]byte(nil), s...)
+	}
+
+	shards := make([]*Shard, n)
+	for i := range shards {
+		start, end := i*words/n, (i+1)*words/n
+		shards[i] = &Shard{
+			Index:    i,
+			Count:    n,
+			Offset:   start,
+			Capacity: bf.Capacity,
+			Elements: bf.Elements,
+			Bits:     bf.Bits,
+			Salts:    salts,
+			Mix:      bf.Mix,
+			Keyed:    bf.Keyed,
+			Wide:     bf.Wide,
+			Strict:   bf.Strict,
+			FPR:      bf.FalsePositiveRate,
+			Words:    append([]uint32(nil), bf.Filter[start:end]...),
+
+			LittleEndian: bf.LittleEndian,
+			Partitioned:  bf.Partitioned,
+			Peppered:     bf.Peppered,
+			Tag:          bf.DatasetTag,
+		}
+	}
+
+	return shards, nil
+}
+
+// Combine reassembles the Shards produced by Split into a bloom Filter.  The Shards may be given in any order.
+// A keyed Filter needs SetKey, and a peppered one SetPepper, to be called on the result.
+func Combine(shards []*Shard) (BloomFilter2, error) {
+
+	if len(shards) == 0 {
+		return nil, errors.New("dgobloom: no shards to combine")
+	}
+
+	first := shards[0]
+	if first.Count != len(shards) {
+		return nil, fmt.Errorf("dgobloom: have %d shards, want %d", len(shards), first.Count)
+	}
+
+	bf := new(bloomFilter2)
+	bf.Capacity = first.Capacity
+	bf.Elements = first.Elements
+	bf.Bits = first.Bits
+	bf.Mix = first.Mix
+	bf.Keyed = first.Keyed
+	bf.Wide = first.Wide
+	bf.Strict = first.Strict
+	bf.LittleEndian = first.LittleEndian
+	bf.Partitioned = first.Partitioned
+	bf.Peppered = first.Peppered
+	bf.DatasetTag = first.Tag
+	bf.FalsePositiveRate = first.FPR
+	bf.Salts = make([][]byte, len(first.Salts))
+	for i, s := range first.Salts {
+		bf.Salts[i] = append([]byte(nil), s...)
+	}
+	bf.Filter = newBitvector2(int(bf.Bits+31) / 32)
+
+	seen := make([]bool, len(shards))
+	covered := 0
+	for _, sh := range shards {
+		other := &bloomFilter2{Bits: sh.Bits, Filter: bf.Filter, Salts: sh.Salts, Mix: sh.Mix, Keyed: sh.Keyed, Wide: sh.Wide, Strict: sh.Strict, LittleEndian: sh.LittleEndian, Partitioned: sh.Partitioned, Peppered: sh.Peppered}
+		if err := bf.compatible(other); err != nil || sh.Count != first.Count || sh.Capacity != first.Capacity || sh.Elements != first.Elements || sh.Tag != first.Tag {
+			return nil, fmt.Errorf("%w: shard %d is from a different filter", ErrIncompatible, sh.Index)
+		}
+		if sh.Index < 0 || sh.Index >= len(shards) || seen[sh.Index] {
+			return nil, fmt.Errorf("dgobloom: duplicate or invalid shard index %d", sh.Index)
+		}
+		if sh.Offset < 0 || sh.Offset+len(sh.Words) > len(bf.Filter) {
+			return nil, fmt.Errorf("dgobloom: shard %d is out of range", sh.Index)
+		}
+		seen[sh.Index] = true
+		covered += copy(bf.Filter[sh.Offset:], sh.Words)
+	}
+
+	if covered != len(bf.Filter) {
+		return nil, fmt.Errorf("dgobloom: shards cover %d of %d words", covered, len(bf.Filter))
+	}
+
+	return bf, nil
+}
+
+// Clear removes every element from the bloom Filter, keeping its dimensions and salts.
+func (bf *bloomFilter2) Clear() error {
+
+	if bf.readOnly {
+		return ErrReadOnly
+	}
+
+	for i := range bf.Filter {
+		bf.Filter[i] = 0
+	}
+
+	bf.Elements = 0
+
+	if bf.hll != nil {
+		bf.hll.reset()
+	}
+
+	return nil
+}
+
+// Rotate clears the bloom Filter and replaces its salts.
+// Rotating periodically invalidates whatever an attacker has learned about which keys collide under the old salts.
+// Filters that are merged together must be rotated to the same salts.
+func (bf *bloomFilter2) Rotate(Salts []uint32) error {
+
+	if err := bf.Clear(); err != nil {
+		return err
+	}
+
+	bf.Salts = make([][]byte, len(Salts))
+	for i, s := range Salts {
+		bf.Salts[i] = bf.saltBytes(s)
+	}
+
+	return nil
+}
+
+// MaxSalts is the largest number of salts AppendSalt will grow a bloom Filter to.
+// Past a few dozen each extra salt sets more bits than it saves, at any false positive rate a bloom Filter is useful for.
+const MaxSalts = 64
+
+// ErrNotEmpty is returned by AppendSalt when the bloom Filter already holds Elements.
+var ErrNotEmpty = errors.New("dgobloom: filter is not empty")
+
+// AppendSalt adds salt as one more hash function, to tune the number of salts of a new Filter before loading data.
+// Elements already inserted would not have the new salt's bit set and would no longer test present, so ErrNotEmpty is returned, and nothing changed, once the Filter has any Elements or set bits.
+// A Filter cannot grow beyond MaxSalts salts.
+func (bf *bloomFilter2) AppendSalt(salt uint32) error {
+
+	if bf.readOnly {
+		return ErrReadOnly
+	}
+
+	if bf.Elements != 0 || bf.PopCount() != 0 {
+		return ErrNotEmpty
+	}
+
+	if len(bf.Salts) >= MaxSalts {
+		return fmt.Errorf("dgobloom: filter already has the maximum of %d salts", MaxSalts)
+	}
+
+	bf.Salts = append(bf.Salts, bf.saltBytes(salt))
+
+	return nil
+}
+
+// EstimateCountHLL estimates the number of distinct Elements inserted using the HyperLogLog sketch of a Filter from NewBloomFilterWithHLL.
+// Other Filters have no sketch and return EstimateCount.
+func (bf *bloomFilter2) EstimateCountHLL() float64 {
+
+	if bf.hll == nil {
+		return bf.EstimateCount()
+	}
+
+	return bf.hll.estimate()
+}
+
+// Indices returns the bit index for b under each salt, in salt order; these are exactly the bits Insert sets and Exists tests.
+// Two salts may map to the same index, except in a strict Filter.  It is intended for debugging collisions.
+func (bf *bloomFilter2) Indices(b []byte) []uint64 { return bf.firstIndices(b, len(bf.Salts)) }
+
+// firstIndices returns Indices for the first n salts only; a strict Filter separates each index from earlier ones, so the prefix does not depend on the rest
+func (bf *bloomFilter2) firstIndices(b []byte, n int) []uint64 {
+
+	indices := bf.saltIndices(b, n)
+
+	if bf.Strict && !bf.Wide {
+		// move each colliding index to the next free bit, so the element covers len(Salts) distinct bits
+		for i := range indices {
+			for j := 0; j < i; j++ {
+				if indices[j] == indices[i] {
+					indices[i] = (indices[i] + 1) % bf.Bits
+					j = -1
+				}
+			}
+		}
+	}
+
+	return indices
+}
+
+// SaltsCollide reports whether two salts map b to the same bit, so that b is covered by fewer than len(Salts) distinct bits and tests present more easily.
+// Strict Filters move colliding salts apart, and wide Filters never collide.
+func (bf *bloomFilter2) SaltsCollide(b []byte) bool {
+
+	indices := bf.saltIndices(b, len(bf.Salts))
+	for i := range indices {
+		for j := 0; j < i; j++ {
+			if indices[i] == indices[j] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// listsIndices reports whether the bit indices of an element must come from Indices instead of the per-salt fast paths
+func (bf *bloomFilter2) listsIndices() bool {
+	return bf.Strict || bf.Partitioned || bf.Peppered || bf.indexFn != nil
+}
+
+// saltIndices returns the bit index for b under each of the first n salts, before a strict Filter separates collisions
+func (bf *bloomFilter2) saltIndices(b []byte, n int) []uint64 {
+
+	indices := make([]uint64, n)
+
+	if bf.Peppered {
+		b = bf.pepperKey(b)
+	}
+
+	if bf.indexFn != nil {
+		for i := range indices {
+			indices[i] = bf.indexFn(b, i, bf.Bits) % bf.Bits
+		}
+		return indices
+	}
+
+	if bf.Wide {
+		h1, h2 := bf.wideHash(nil, b)
+		for i := range indices {
+			indices[i] = bf.wideIndex(h1, h2, i)
+		}
+		return indices
+	}
+
+	h := bf.newHash()
+
+	if bf.Partitioned {
+		// reduce the full hash into the salt's partition; the few bits past the last partition are unused
+		part := bf.Bits / uint64(len(bf.Salts))
+		for i, s := range bf.Salts[:n] {
+			h.Reset()
+			h.Write(s)
+			h.Write(b)
+			v := h.Sum32()
+			if bf.Mix {
+				v = fmix32(v)
+			}
+			indices[i] = uint64(i)*part + uint64(v)%part
+		}
+		return indices
+	}
+
+	for i, s := range bf.Salts[:n] {
+		indices[i] = uint64(bf.location(h, s, b))
+	}
+
+	return indices
+}
+
+// SizeBytes returns the approximate heap footprint of the bloom Filter in bytes: the bit vector, the salts with their slice headers, the HyperLogLog sketch if any, and the struct itself.
+func (bf *bloomFilter2) SizeBytes() int {
+
+	n := int(unsafe.Sizeof(*bf))
+	n += 4 * cap(bf.Filter)
+
+	for _, s := range bf.Salts {
+		n += int(unsafe.Sizeof(s)) + cap(s)
+	}
+
+	if bf.hll != nil {
+		n += int(unsafe.Sizeof(*bf.hll)) + cap(bf.hll.registers)
+	}
+
+	return n
+}
+
+// hashIndex returns the i'th bit index derived from the 64-bit hash h by double hashing
+func (bf *bloomFilter2) hashIndex(h uint64, i int) uint64 {
+	if bf.Wide {
+		// 32-bit halves cannot reach the upper part of a wide Filter
+		return bf.wideIndex(h, fmix64(h)|1, i)
+	}
+
+	h1, h2 := h&0xffffffff, h>>32|1
+	return (h1 + uint64(i)*h2) % bf.Bits
+}
+
+// InsertHash inserts an element identified by a 64-bit hash computed by the caller, for example in bulk elsewhere.
+// One bit per salt is derived from h by double hashing; the salts themselves are not used.
+// Elements inserted this way must be looked up with ExistsHash or ExistsHashes, not Exists.
+func (bf *bloomFilter2) InsertHash(h uint64) bool {
+
+	if bf.readOnly {
+		return false
+	}
+
+	bf.Elements++
+	bf.pending++
+
+	for i := range bf.Salts {
+		bf.Filter.set(bf.hashIndex(h, i))
+	}
+
+	return bf.Elements < bf.Capacity
+}
+
+// ExistsHash checks the bloom Filter for an element inserted with InsertHash.
+func (bf *bloomFilter2) ExistsHash(h uint64) bool {
+
+	for i := range bf.Salts {
+		if bf.Filter.get(bf.hashIndex(h, i)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ExistsHashes checks the bloom Filter for a batch of elements inserted with InsertHash, returning one result per hash.
+func (bf *bloomFilter2) ExistsHashes(hashes []uint64) []bool {
+
+	present := make([]bool, len(hashes))
+	for j, h := range hashes {
+		present[j] = bf.ExistsHash(h)
+	}
+
+	return present
+}
+
+// DiffCount returns the number of bits set in exactly one of bf and other, which must be compatible as for Merge.
+// Replicas that have seen the same inserts report 0, so a nonzero result is a cheap signal of divergence.
+func (bf *bloomFilter2) DiffCount(other BloomFilter2) (int, error) {
+
+	o, err := bf.compatibleWith(other)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i, w := range bf.Filter {
+		n += bits.OnesCount32(w ^ o.Filter[i])
+	}
+
+	return n, nil
+}
+
+// StaleBits returns the number of bits set in bf but not in newer, which must be compatible as for Merge.
+// Treating bf as an older generation, a high count means it still covers keys that newer does not, so it is not yet safe to drop in compaction.
+// Bits shared with newer say nothing either way, since a bit can be set by several keys.
+func (bf *bloomFilter2) StaleBits(newer BloomFilter2) (uint64, error) {
+
+	o, err := bf.compatibleWith(newer)
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	for i, w := range bf.Filter {
+		n += uint64(bits.OnesCount32(w &^ o.Filter[i]))
+	}
+
+	return n, nil
+}
+
+// EmptyLike returns a new, empty bloom Filter with the same Capacity, Bits, salts and hashing as other, so the two are mergeable by construction.
+// A CachedBloomFilter is copied without its cache.  EmptyLike returns nil if other is not a Filter from this package.
+func EmptyLike(other BloomFilter2) BloomFilter2 {
+
+	o, ok := unwrapCached(other).(*bloomFilter2)
+	if !ok {
+		return nil
+	}
+
+	bf := &bloomFilter2{
+		Capacity:          o.Capacity,
+		Bits:              o.Bits,
+		Filter:            newBitvector2(len(o.Filter)),
+		Salts:             make([][]byte, len(o.Salts)),
+		Mix:               o.Mix,
+		Keyed:             o.Keyed,
+		Wide:              o.Wide,
+		Strict:            o.Strict,
+		LittleEndian:      o.LittleEndian,
+		FalsePositiveRate: o.FalsePositiveRate,
+		sipKey:            o.sipKey,
+		hasKey:            o.hasKey,
+		indexFn:           o.indexFn,
+		Partitioned:       o.Partitioned,
+		Peppered:          o.Peppered,
+		pepper:            o.pepper,
+	}
+
+	for i, s := range o.Salts {
+		bf.Salts[i] = append([]byte(nil), s...)
+	}
+
+	if o.hll != nil {
+		bf.hll = newHyperLogLog()
+	}
+
+	return bf
+}
+
+// SetExactLookup installs an authoritative membership test, such as a map lookup or a database query, for ExistsExact.
+// A nil lookup removes it.  It is not serialized or carried over by Freeze.
+func (bf *bloomFilter2) SetExactLookup(lookup func(b []byte) bool) {
+	bf.exact = lookup
+}
+
+// ExistsExact checks the bloom Filter for b and, only if the Filter answers yes, confirms it with the exact lookup.
+// Negatives stay as fast as Exists while false positives are eliminated; without a lookup ExistsExact is Exists.
+func (bf *bloomFilter2) ExistsExact(b []byte) bool {
+
+	if !bf.Exists(b) {
+		return false
+	}
+
+	if bf.exact == nil {
+		return true
+	}
+
+	return bf.exact(b)
+}
+
+// PendingInserts returns the number of inserts since the Filter was last written with WriteTo, Serialization or MarshalBinary, or since it was created,
+// for deciding when another backup is worth taking.  InsertNew only counts new Elements; Merge, Clear and other bulk changes are not counted.
+// The count itself is not serialized.
+func (bf *bloomFilter2) PendingInserts() uint32 { return bf.pending }
+
+// Checkpoint snapshots the bit vector, so that SerializeDiff writes only what changes after this point.
+// The snapshot doubles the memory used by the bit vector.
+func (bf *bloomFilter2) Checkpoint() {
+	bf.checkpoint = append(bf.checkpoint[:0], bf.Filter...)
+}
+
+var diffMagic = [4]byte{'D', 'G', 'B', 'D'}
+
+/*
+A diff written by SerializeDiff is, with all integers big-endian:
+
+	magic    [4]byte  "DGBD"
+	words    uint32   length of the bit vector
+	elements uint32
+	changes  uint32   number of changed words
+	changes           for each changed word its uint32 index and uint32 new value
+*/
+
+// SerializeDiff writes the index and new value of every word of the bit vector changed since the last Checkpoint, along with the element count.
+// Without a Checkpoint every nonzero word is written.  It does not move the Checkpoint.
+func (bf *bloomFilter2) SerializeDiff(w io.Writer) error {
+
+	var changes []uint32
+	for i, v := range bf.Filter {
+		old := uint32(0)
+		if i < len(bf.checkpoint) {
+			old = bf.checkpoint[i]
+		}
+		if v != old {
+			changes = append(changes, uint32(i), v)
+		}
+	}
+
+	p := make([]byte, 16+4*len(changes))
+	copy(p, diffMagic[:])
+	binary.BigEndian.PutUint32(p[4:], uint32(len(bf.Filter)))
+	binary.BigEndian.PutUint32(p[8:], bf.Elements)
+	binary.BigEndian.PutUint32(p[12:], uint32(len(changes)/2))
+	for i, v := range changes {
+		binary.BigEndian.PutUint32(p[16+4*i:], v)
+	}
+
+	_, err := w.Write(p)
+	return err
+}
+
+// ApplyDiff reads a diff written by SerializeDiff and applies it, so that a copy of the Filter as of the Checkpoint becomes identical to the Filter that wrote the diff.
+func (bf *bloomFilter2) ApplyDiff(r io.Reader) error {
+
+	if bf.readOnly {
+		return ErrReadOnly
+	}
+
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+
+	if string(hdr[:4]) != string(diffMagic[:]) {
+		return ErrBadFormat
+	}
+
+	if words := binary.BigEndian.Uint32(hdr[4:]); words != uint32(len(bf.Filter)) {
+		return fmt.Errorf("%w: diff is for %d words, filter has %d", ErrIncompatible, words, len(bf.Filter))
+	}
+
+	// a diff cannot change more words than the Filter has; check before allocating from the untrusted count
+	n := binary.BigEndian.Uint32(hdr[12:])
+	if uint64(n) > uint64(len(bf.Filter)) {
+		return fmt.Errorf("%w: diff changes %d words, filter has %d", ErrBadFormat, n, len(bf.Filter))
+	}
+	body := make([]byte, 8*uint64(n))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+
+	for i := uint32(0); i < n; i++ {
+		if binary.BigEndian.Uint32(body[8*i:]) >= uint32(len(bf.Filter)) {
+			return fmt.Errorf("%w: word index out of range", ErrBadFormat)
+		}
+	}
+
+	for i := uint32(0); i < n; i++ {
+		bf.Filter[binary.BigEndian.Uint32(body[8*i:])] = binary.BigEndian.Uint32(body[8*i+4:])
+	}
+	bf.Elements = binary.BigEndian.Uint32(hdr[8:])
+
+	return nil
+}
+
+// setInRange returns the number of bits set among the bits [start, start+span) of the bit vector, clipped to Bits
+func (bf *bloomFilter2) setInRange(start, span uint64) uint64 {
+
+	end := start + span
+	if end > bf.Bits {
+		end = bf.Bits
+	}
+
+	var n uint64
+	for i := start; i < end; i++ {
+		n += uint64(bf.Filter.get(i))
+	}
+
+	return n
+}
+
+// RenderASCII draws the bit vector as lines of width characters, for spotting clusters of set bits while debugging.
+// Each character stands for a run of consecutive bits, chosen so there are at most about width lines: '.' none set, ':' under half, 'o' half or more, '#' all set.
+// When there are few enough bits each character is a single bit, drawn '.' or '#'.
+func (bf *bloomFilter2) RenderASCII(width int) string {
+
+	if width < 1 {
+		width = 1
+	}
+
+	w := uint64(width)
+	span := (bf.Bits + w*w - 1) / (w * w)
+	if span < 1 {
+		span = 1
+	}
+
+	cells := (bf.Bits + span - 1) / span
+
+	var sb strings.Builder
+	for c := uint64(0); c < cells; c++ {
+		start := c * span
+		size := span
+		if start+size > bf.Bits {
+			size = bf.Bits - start
+		}
+
+		switch n := bf.setInRange(start, span); {
+		case n == 0:
+			sb.WriteByte('.')
+		case n == size:
+			sb.WriteByte('#')
+		case 2*n < size:
+			sb.WriteByte(':')
+		default:
+			sb.WriteByte('o')
+		}
+
+		if (c+1)%w == 0 || c+1 == cells {
+			sb.WriteByte('\n')
+		}
+	}
+
+	return sb.String()
+}
+
+// SetBits returns the indices of the set bits of the bit vector in increasing order, a sparse representation of a lightly filled Filter for NewBloomFilterFromBits.
+func (bf *bloomFilter2) SetBits() []uint64 {
+
+	set := make([]uint64, 0, bf.PopCount())
+	for i, w := range bf.Filter {
+		for ; w != 0; w &= w - 1 {
+			set = append(set, 32*uint64(i)+uint64(bits.TrailingZeros32(w)))
+		}
+	}
+
+	return set
+}
+
+// Walk calls fn with the index and value of each 32-bit word of the bit vector in order, stopping early if fn returns false.
+// It is read-only: fn sees copies of the words and must not modify the Filter while walking.
+func (bf *bloomFilter2) Walk(fn func(wordIndex int, word uint32) bool) {
+	for i, w := range bf.Filter {
+		if !fn(i, w) {
+			return
+		}
 	}
-	return nil
 }
@@ -1,9 +1,22 @@
 package dgobloom
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"math"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"unsafe"
 )
 
 func TestSerial(t *testing.T) {
@@ -34,3 +47,2855 @@ func TestSerial(t *testing.T) {
 	}
 
 }
+
+func TestPendingInserts(t *testing.T) {
+
+	b := NewTestBloomFilter(CAPACITY, ERRPCT)
+	if n := b.PendingInserts(); n != 0 {
+		t.Errorf("new filter has %d pending inserts", n)
+	}
+
+	for i := 0; i < 100; i++ {
+		b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	b.InsertUint64(7)
+	b.InsertNew([]byte("key-1"))
+	if n := b.PendingInserts(); n != 101 {
+		t.Errorf("after 101 inserts and a duplicate InsertNew, PendingInserts = %d", n)
+	}
+
+	file := filepath.Join(t.TempDir(), "pending.gob")
+	if err := b.Serialization(file); err != nil {
+		t.Fatalf("Serialization failed: %v", err)
+	}
+	if n := b.PendingInserts(); n != 0 {
+		t.Errorf("after Serialization, PendingInserts = %d", n)
+	}
+
+	b.Insert([]byte("more"))
+	b.InsertAllParallel([][]byte{[]byte("a"), []byte("b"), []byte("c")}, 2)
+	if n := b.PendingInserts(); n != 4 {
+		t.Errorf("after 4 more inserts, PendingInserts = %d", n)
+	}
+	b.MarshalBinary()
+	if n := b.PendingInserts(); n != 0 {
+		t.Errorf("after MarshalBinary, PendingInserts = %d", n)
+	}
+
+	// the count is not part of the serialized filter
+	b.Insert([]byte("unsaved"))
+	loaded, err := UnSerialization(file)
+	if err != nil {
+		t.Fatalf("UnSerialization failed: %v", err)
+	}
+	if n := loaded.PendingInserts(); n != 0 {
+		t.Errorf("loaded filter has %d pending inserts", n)
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3})
+	if err := b.Validate(); err != nil {
+		t.Fatalf("fresh filter failed validation: %v", err)
+	}
+
+	bf := b.(*bloomFilter2)
+
+	bf.Bits = 1000
+	if err := bf.Validate(); err == nil {
+		t.Error("non power of two Bits passed validation")
+	}
+
+	bf.Bits = FilterBits2(CAPACITY, ERRPCT)
+	bf.Filter = bf.Filter[:len(bf.Filter)-1]
+	if err := bf.Validate(); err == nil {
+		t.Error("short bit vector passed validation")
+	}
+
+	bf.Filter = make([]uint32, (bf.Bits+31)/32)
+	bf.Salts = nil
+	if err := bf.Validate(); err != ErrNoSalts {
+		t.Errorf("missing salts: got %v, want ErrNoSalts", err)
+	}
+
+	bf.Salts = [][]byte{{1}, {}}
+	if err := bf.Validate(); err == nil {
+		t.Error("empty salt passed validation")
+	}
+}
+
+func TestRepair(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3})
+	bf := b.(*bloomFilter2)
+
+	bf.Bits = 1000
+	bf.Filter = bf.Filter[:3]
+	if err := bf.Repair(); err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if bf.Bits != 1024 || len(bf.Filter) != 32 {
+		t.Errorf("Repair gave Bits=%d words=%d, want 1024 and 32", bf.Bits, len(bf.Filter))
+	}
+
+	a := []byte("repaired")
+	bf.Insert(a)
+	if !bf.Exists(a) {
+		t.Error("repaired filter lost an insert")
+	}
+
+	bf.Salts = nil
+	if err := bf.Repair(); err != ErrNoSalts {
+		t.Errorf("Repair without salts: got %v, want ErrNoSalts", err)
+	}
+}
+
+// chiSquaredSaltPair measures how independent the low bits of the locations chosen by two adjacent salts are.
+// Independent locations give a value close to the 255 degrees of freedom.
+func chiSquaredSaltPair(bf *bloomFilter2) float64 {
+
+	h := fnv.New32()
+	var cells [256]float64
+	n := 20000
+
+	for i := 0; i < n; i++ {
+		b := []byte(fmt.Sprintf("key-%d", i))
+		x := bf.location(h, bf.Salts[0], b) & 15
+		y := bf.location(h, bf.Salts[1], b) & 15
+		cells[x*16+y]++
+	}
+
+	expected := float64(n) / 256
+	chi := 0.0
+	for _, o := range cells {
+		chi += (o - expected) * (o - expected) / expected
+	}
+
+	return chi
+}
+
+func TestMixSequentialSalts(t *testing.T) {
+
+	salts := []uint32{0, 1, 2, 3, 4, 5, 6}
+
+	plain := NewBloomFilter2(CAPACITY, ERRPCT, salts).(*bloomFilter2)
+	mixed := NewMixedBloomFilter2(CAPACITY, ERRPCT, salts).(*bloomFilter2)
+
+	chiPlain := chiSquaredSaltPair(plain)
+	chiMixed := chiSquaredSaltPair(mixed)
+
+	t.Log("chi-squared plain:", chiPlain, "mixed:", chiMixed)
+
+	if chiMixed > 400 {
+		t.Errorf("mixed locations are not uniform: chi-squared %f", chiMixed)
+	}
+
+	if chiPlain < 10*chiMixed {
+		t.Errorf("mixing did not improve uniformity: plain %f mixed %f", chiPlain, chiMixed)
+	}
+
+	a := []byte("mixed")
+	mixed.Insert(a)
+	if !mixed.Exists(a) {
+		t.Error("mixed filter lost an insert")
+	}
+}
+
+func TestTouchAndMaybeInsert(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	bf := b.(*bloomFilter2)
+	bf.random = rand.New(rand.NewSource(1)).Float64
+
+	if b.TouchAndMaybeInsert([]byte("never"), 0) || b.Exists([]byte("never")) {
+		t.Error("p=0 inserted a key")
+	}
+
+	if b.TouchAndMaybeInsert([]byte("always"), 1) || !b.Exists([]byte("always")) {
+		t.Error("p=1 did not insert a key")
+	}
+
+	if !b.TouchAndMaybeInsert([]byte("always"), 1) {
+		t.Error("present key reported absent")
+	}
+
+	// replay the same random sequence to predict which keys are sampled
+	expect := rand.New(rand.NewSource(2)).Float64
+	bf.random = rand.New(rand.NewSource(2)).Float64
+
+	before := b.Len()
+	want := uint32(0)
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("sample-%d", i))
+		if b.Exists(key) {
+			continue
+		}
+		if expect() < 0.25 {
+			want++
+		}
+		b.TouchAndMaybeInsert(key, 0.25)
+	}
+
+	if got := b.Len() - before; got != want {
+		t.Errorf("sampled %d keys, want %d", got, want)
+	}
+
+	t.Logf("sampled %d of 1000 keys at p=0.25", want)
+	if want < 200 || want > 300 {
+		t.Errorf("sample rate %d/1000 far from p=0.25", want)
+	}
+}
+
+func TestMerge(t *testing.T) {
+
+	salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, salts)
+	b2 := NewBloomFilter2(CAPACITY, ERRPCT, salts)
+
+	b.Insert([]byte("one"))
+	b2.Insert([]byte("two"))
+
+	if err := b.Merge(b2); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+
+	if !b.Exists([]byte("one")) || !b.Exists([]byte("two")) {
+		t.Error("merged filter is missing an element")
+	}
+
+	if err := b.Merge(NewBloomFilter2(CAPACITY*4, ERRPCT, salts)); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("merge with different Bits: got %v, want ErrIncompatible", err)
+	}
+
+	if err := b.Merge(NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 8})); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("merge with different salts: got %v, want ErrIncompatible", err)
+	}
+
+	if err := b.Merge(NewMixedBloomFilter2(CAPACITY, ERRPCT, salts)); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("merge with different mixing: got %v, want ErrIncompatible", err)
+	}
+}
+
+func TestMergeFrom(t *testing.T) {
+
+	salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, salts)
+	peer := NewBloomFilter2(CAPACITY, ERRPCT, salts)
+
+	for i := 0; i < 100; i++ {
+		b.Insert([]byte(fmt.Sprintf("local-%d", i)))
+		peer.Insert([]byte(fmt.Sprintf("peer-%d", i)))
+	}
+
+	var buf bytes.Buffer
+	if _, err := peer.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+
+	if err := b.MergeFrom(&buf); err != nil {
+		t.Fatalf("MergeFrom failed: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if !b.Exists([]byte(fmt.Sprintf("local-%d", i))) || !b.Exists([]byte(fmt.Sprintf("peer-%d", i))) {
+			t.Fatalf("union is missing element %d", i)
+		}
+	}
+
+	if err := b.MergeFrom(bytes.NewReader([]byte("not a filter"))); err == nil {
+		t.Error("MergeFrom accepted garbage")
+	}
+}
+
+func TestFreeze(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	for i := 0; i < 1000; i++ {
+		b.Insert([]byte(fmt.Sprintf("frozen-%d", i)))
+	}
+
+	f := b.Freeze()
+
+	// later writes to the source must not show through
+	b.Insert([]byte("after"))
+
+	if err := f.Insert([]byte("x")); err != ErrReadOnly {
+		t.Errorf("Insert on frozen filter: got %v, want ErrReadOnly", err)
+	}
+	if err := f.Merge(b); err != ErrReadOnly {
+		t.Errorf("Merge on frozen filter: got %v, want ErrReadOnly", err)
+	}
+	if f.Len() != 1000 {
+		t.Errorf("frozen Len=%d, want 1000", f.Len())
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 32; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if !f.Exists([]byte(fmt.Sprintf("frozen-%d", i))) {
+					t.Errorf("frozen filter lost element %d", i)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func isAligned(d bitvector2) bool {
+	return uintptr(unsafe.Pointer(&d[:1][0]))%cacheLine == 0
+}
+
+func TestAlignment(t *testing.T) {
+
+	for _, words := range []int{1, 3, 32, 1000} {
+		d := newBitvector2(words)
+		if len(d) != words || cap(d) != words {
+			t.Errorf("newBitvector2(%d) has len %d cap %d", words, len(d), cap(d))
+		}
+		if !isAligned(d) {
+			t.Errorf("newBitvector2(%d) is not aligned", words)
+		}
+	}
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	b.Insert([]byte("aligned"))
+	b.Compress()
+
+	var buf bytes.Buffer
+	b.WriteTo(&buf)
+	b2, err := ReadFrom(&buf)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+
+	for _, f := range []BloomFilter2{b, b2} {
+		if !isAligned(f.(*bloomFilter2).Filter) {
+			t.Error("filter bit vector is not aligned")
+		}
+		if !f.Exists([]byte("aligned")) {
+			t.Error("aligned filter lost an insert")
+		}
+	}
+}
+
+func BenchmarkExistsLarge(b *testing.B) {
+
+	bf := NewBloomFilter2(1<<22, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	keys := make([][]byte, 1024)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		bf.Insert(keys[i])
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bf.Exists(keys[i%len(keys)])
+	}
+}
+
+func TestUnionCountEstimate(t *testing.T) {
+
+	salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+
+	a := NewBloomFilter2(CAPACITY, ERRPCT, salts)
+	b := NewBloomFilter2(CAPACITY, ERRPCT, salts)
+	union := NewBloomFilter2(CAPACITY, ERRPCT, salts)
+
+	// 3000 in a, 3000 in b, 1000 in both
+	for i := 0; i < 3000; i++ {
+		a.Insert([]byte(fmt.Sprintf("key-%d", i)))
+		b.Insert([]byte(fmt.Sprintf("key-%d", i+2000)))
+	}
+
+	est, err := a.UnionCountEstimate(b)
+	if err != nil {
+		t.Fatalf("UnionCountEstimate failed: %v", err)
+	}
+
+	union.Merge(a)
+	union.Merge(b)
+
+	t.Log("union estimate:", est, "merged estimate:", union.EstimateCount())
+
+	if est != union.EstimateCount() {
+		t.Errorf("estimate %f differs from merged filter estimate %f", est, union.EstimateCount())
+	}
+
+	if math.Abs(est-5000) > 250 {
+		t.Errorf("estimate %f too far from 5000", est)
+	}
+
+	if _, err := a.UnionCountEstimate(NewBloomFilter2(CAPACITY*4, ERRPCT, salts)); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("incompatible filters: got %v, want ErrIncompatible", err)
+	}
+}
+
+func TestInsertNew(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if !b.InsertNew(key) {
+			t.Errorf("first insert of %s was not new", key)
+		}
+		if b.InsertNew(key) {
+			t.Errorf("second insert of %s was new", key)
+		}
+		if !b.Exists(key) {
+			t.Errorf("%s missing after InsertNew", key)
+		}
+	}
+}
+
+func TestInsertNewElements(t *testing.T) {
+
+	b := NewBloomFilter2(1000, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 500; i++ {
+			b.InsertNew([]byte(fmt.Sprintf("key-%d", i)))
+		}
+
+		if b.Len() != 500 {
+			t.Errorf("round %d: Len=%d after re-inserting duplicates, want 500", round, b.Len())
+		}
+	}
+
+	if b.LoadRatio() != 0.5 {
+		t.Errorf("LoadRatio=%f, want 0.5", b.LoadRatio())
+	}
+}
+
+// measureFPR fills b to capacity and returns the fraction of unrelated keys it reports present
+func measureFPR(b BloomFilter2, capacity int) float64 {
+
+	for i := 0; i < capacity; i++ {
+		b.Insert([]byte(fmt.Sprintf("member-%d", i)))
+	}
+
+	fp := 0
+	n := 20000
+	for i := 0; i < n; i++ {
+		if b.Exists([]byte(fmt.Sprintf("other-%d", i))) {
+			fp++
+		}
+	}
+
+	return float64(fp) / float64(n)
+}
+
+func TestExtendSalts(t *testing.T) {
+
+	given := []uint32{42}
+	want := SaltsRequired2(CAPACITY, ERRPCT)
+
+	b, salts := NewExtendedBloomFilter2(CAPACITY, ERRPCT, given)
+
+	if uint(len(salts)) != want || salts[0] != 42 {
+		t.Fatalf("extended salts %v, want %d salts starting with 42", salts, want)
+	}
+
+	seen := make(map[uint32]bool)
+	for _, s := range salts {
+		if seen[s] {
+			t.Errorf("duplicate salt %d", s)
+		}
+		seen[s] = true
+	}
+
+	again := ExtendSalts(given, want)
+	for i := range salts {
+		if salts[i] != again[i] {
+			t.Fatal("salt extension is not deterministic")
+		}
+	}
+
+	peer := NewBloomFilter2(CAPACITY, ERRPCT, salts)
+	if err := peer.Merge(b); err != nil {
+		t.Errorf("filter built from emitted salts is not mergeable: %v", err)
+	}
+
+	under := measureFPR(NewBloomFilter2(CAPACITY, ERRPCT, given), CAPACITY)
+	fpr := measureFPR(b, CAPACITY)
+
+	t.Log("false positive rate with 1 salt:", under, "extended:", fpr)
+
+	if fpr > 2*ERRPCT {
+		t.Errorf("extended filter false positive rate %f, want near %f", fpr, ERRPCT)
+	}
+}
+
+func TestNewTestBloomFilter(t *testing.T) {
+
+	a := NewTestBloomFilter(CAPACITY, ERRPCT)
+	b := NewTestBloomFilter(CAPACITY, ERRPCT)
+
+	if !a.Equal(b) {
+		t.Fatal("two test filters are not equal")
+	}
+
+	a.Insert([]byte("one"))
+	if a.Equal(b) {
+		t.Error("filters with different contents are equal")
+	}
+
+	b.Insert([]byte("one"))
+	if !a.Equal(b) {
+		t.Error("filters with the same inserts are not equal")
+	}
+
+	if err := a.Merge(b); err != nil {
+		t.Errorf("test filters are not mergeable: %v", err)
+	}
+
+	if a.Equal(NewTestBloomFilter(CAPACITY*2, ERRPCT)) {
+		t.Error("filters of different sizes are equal")
+	}
+}
+
+func TestKeyedBloomFilter(t *testing.T) {
+
+	key1 := []byte("0123456789abcdef")
+	key2 := []byte("fedcba9876543210")
+
+	a, err := NewKeyedBloomFilter(CAPACITY, ERRPCT, key1)
+	if err != nil {
+		t.Fatalf("NewKeyedBloomFilter failed: %v", err)
+	}
+	b, _ := NewKeyedBloomFilter(CAPACITY, ERRPCT, key2)
+	c, _ := NewKeyedBloomFilter(CAPACITY, ERRPCT, key1)
+
+	for _, f := range []BloomFilter2{a, b, c} {
+		f.Insert([]byte("secret"))
+		if !f.Exists([]byte("secret")) {
+			t.Error("keyed filter lost an insert")
+		}
+	}
+
+	if a.Equal(b) {
+		t.Error("different keys produced the same bits")
+	}
+	if !a.Equal(c) {
+		t.Error("the same key produced different bits")
+	}
+	if err := a.Merge(b); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("merge of differently keyed filters: got %v, want ErrIncompatible", err)
+	}
+
+	if _, err := NewKeyedBloomFilter(CAPACITY, ERRPCT, []byte("short")); err != ErrKeySize {
+		t.Errorf("short key: got %v, want ErrKeySize", err)
+	}
+
+	var buf bytes.Buffer
+	a.WriteTo(&buf)
+	loaded, err := ReadFrom(&buf)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if err := loaded.Validate(); err != ErrNoKey {
+		t.Errorf("loaded keyed filter without key: got %v, want ErrNoKey", err)
+	}
+	loaded.SetKey(key1)
+	if !loaded.Exists([]byte("secret")) || !loaded.Equal(a) {
+		t.Error("reloaded keyed filter does not match")
+	}
+}
+
+func TestPepperedBloomFilter(t *testing.T) {
+
+	Salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+	pepper1, pepper2 := []byte("pepper one"), []byte("pepper two")
+
+	plain := NewBloomFilter2(CAPACITY, ERRPCT, Salts)
+	a, err := NewPepperedBloomFilter(CAPACITY, ERRPCT, Salts, pepper1)
+	if err != nil {
+		t.Fatalf("NewPepperedBloomFilter failed: %v", err)
+	}
+	b, _ := NewPepperedBloomFilter(CAPACITY, ERRPCT, Salts, pepper2)
+	c, _ := NewPepperedBloomFilter(CAPACITY, ERRPCT, Salts, pepper1)
+
+	for _, f := range []BloomFilter2{plain, a, b, c} {
+		for i := 0; i < 1000; i++ {
+			f.Insert([]byte(fmt.Sprintf("user%d@example.com", i)))
+		}
+		if !f.Exists([]byte("user7@example.com")) {
+			t.Error("peppered filter lost an insert")
+		}
+	}
+
+	if a.Equal(b) {
+		t.Error("different peppers produced the same bits")
+	}
+	if a.Equal(plain) {
+		t.Error("the pepper did not change the bits")
+	}
+	if !a.Equal(c) {
+		t.Error("the same pepper produced different bits")
+	}
+	if err := a.Merge(b); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("merge of differently peppered filters: got %v, want ErrIncompatible", err)
+	}
+	if err := a.Merge(plain); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("merge of a peppered and a plain filter: got %v, want ErrIncompatible", err)
+	}
+
+	if _, err := NewPepperedBloomFilter(CAPACITY, ERRPCT, Salts, nil); err == nil {
+		t.Error("an empty pepper was accepted")
+	}
+
+	// neither encoding carries the pepper
+	data, _ := a.MarshalBinary()
+	var gobbed bytes.Buffer
+	a.WriteTo(&gobbed)
+	if bytes.Contains(data, pepper1) || bytes.Contains(gobbed.Bytes(), pepper1) {
+		t.Error("the pepper was serialized")
+	}
+
+	loaded := NewBloomFilter2(1, ERRPCT, nil)
+	if err := loaded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %v", err)
+	}
+	if err := loaded.Validate(); err != ErrNoPepper {
+		t.Errorf("loaded peppered filter without pepper: got %v, want ErrNoPepper", err)
+	}
+	loaded.SetPepper(pepper1)
+	if !loaded.Exists([]byte("user7@example.com")) || !loaded.Equal(a) {
+		t.Error("reloaded peppered filter does not match")
+	}
+
+	fromGob, err := ReadFrom(&gobbed)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	fromGob.SetPepper(pepper2)
+	found := 0
+	for i := 0; i < 1000; i++ {
+		if fromGob.Exists([]byte(fmt.Sprintf("user%d@example.com", i))) {
+			found++
+		}
+	}
+	if found > 20 {
+		t.Errorf("with the wrong pepper %d of 1000 members still test present", found)
+	}
+}
+
+func TestCompressCapacity(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	for i := 0; i < CAPACITY*3/4; i++ {
+		b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	b.Compress()
+
+	if b.Cap() != CAPACITY/2 {
+		t.Errorf("Cap after Compress = %d, want %d", b.Cap(), CAPACITY/2)
+	}
+	if b.Len() != CAPACITY*3/4 {
+		t.Errorf("Len after Compress = %d, want %d", b.Len(), CAPACITY*3/4)
+	}
+
+	// the reported capacity is what a fresh filter of the compressed size would hold
+	if bits := FilterBits2(b.Cap(), ERRPCT); bits != b.(*bloomFilter2).Bits {
+		t.Errorf("compressed filter has %d bits, a filter of its capacity has %d", b.(*bloomFilter2).Bits, bits)
+	}
+
+	if b.Insert([]byte("over")) {
+		t.Error("Insert did not report the compressed filter is over capacity")
+	}
+}
+
+func TestMaxCompressions(t *testing.T) {
+
+	const maxFPR = 0.01
+
+	b := NewBloomFilter2(CAPACITY*16, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	for i := 0; i < CAPACITY; i++ {
+		b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	n := b.MaxCompressions(maxFPR)
+	if n < 1 {
+		t.Fatalf("MaxCompressions=%d for a filter at a sixteenth of capacity", n)
+	}
+
+	if err := b.CompressBy(n); err != nil {
+		t.Fatalf("CompressBy(%d) failed: %v", n, err)
+	}
+	if fpr := b.EstimatedFalsePositiveRate(); fpr > maxFPR {
+		t.Errorf("estimated FPR %f after %d compressions, cap %f", fpr, n, maxFPR)
+	}
+	if m := b.MaxCompressions(maxFPR); m != 0 {
+		t.Errorf("MaxCompressions=%d after compressing to the limit", m)
+	}
+
+	// one more compression would have gone over
+	b.Compress()
+	if fpr := b.EstimatedFalsePositiveRate(); fpr <= maxFPR {
+		t.Errorf("estimated FPR %f after %d compressions is still under the cap", fpr, n+1)
+	}
+
+	// CompressBy stops where the bit vector cannot be halved
+	small := NewBloomFilter2(10, ERRPCT, []uint32{1, 2, 3})
+	if m := small.MaxCompressions(1); m != 5 {
+		t.Errorf("MaxCompressions(1) of a 32 word filter=%d, want 5", m)
+	}
+	if err := small.CompressBy(6); err == nil {
+		t.Error("CompressBy past one word succeeded")
+	}
+}
+
+func TestCompressVsRebuildAdvice(t *testing.T) {
+
+	salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+	b := NewBloomFilter2(CAPACITY*16, ERRPCT, salts)
+	for i := 0; i < CAPACITY; i++ {
+		b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	bits := b.Stats().Bits
+
+	for n := 0; n <= 4; n++ {
+		target := bits >> uint(n)
+		a, err := b.CompressVsRebuildAdvice(target)
+		if err != nil {
+			t.Fatalf("advice for %d bits: %v", target, err)
+		}
+
+		// compressing: the fill model of MaxCompressions
+		free := 1 - b.Stats().Fill
+		for i := 0; i < n; i++ {
+			free *= free
+		}
+		compressFPR := math.Pow(1-free, float64(len(salts)))
+
+		// rebuilding: the textbook rate at the optimal k
+		k := int(math.Round(float64(target) / CAPACITY * math.Ln2))
+		rebuildFPR := math.Pow(1-math.Exp(-float64(k)*CAPACITY/float64(target)), float64(k))
+
+		if a.Compressions != n || a.RebuildSalts != k || math.Abs(a.CompressFPR-compressFPR) > 1e-12 || math.Abs(a.RebuildFPR-rebuildFPR) > 1e-12 {
+			t.Errorf("advice for %d bits: %+v, want %d compressions at %g, %d salts at %g", target, a, n, compressFPR, k, rebuildFPR)
+		}
+		if a.Rebuild != (rebuildFPR < compressFPR) {
+			t.Errorf("advice for %d bits: Rebuild=%v with rates %g and %g", target, a.Rebuild, compressFPR, rebuildFPR)
+		}
+		if a.String() == "" {
+			t.Errorf("empty advice")
+		}
+	}
+
+	// after several halvings a seven-salt filter is better rebuilt
+	if a, _ := b.CompressVsRebuildAdvice(bits >> 4); !a.Rebuild {
+		t.Errorf("advice for a sixteenth of the bits: %v", a)
+	}
+
+	for _, target := range []uint64{0, 16, bits * 2, bits/2 + 1} {
+		if _, err := b.CompressVsRebuildAdvice(target); err == nil {
+			t.Errorf("advice for unreachable %d bits succeeded", target)
+		}
+	}
+}
+
+func TestExistsFastPath(t *testing.T) {
+
+	for _, b := range []BloomFilter2{
+		NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7}),
+		NewMixedBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7}),
+	} {
+		bf := b.(*bloomFilter2)
+		for i := 0; i < 2000; i += 2 {
+			b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+		}
+
+		h := fnv.New32()
+		for i := 0; i < 2000; i++ {
+			key := []byte(fmt.Sprintf("key-%d", i))
+			key = bytes.Repeat(key, i%8)
+
+			generic := true
+			for _, s := range bf.Salts {
+				if bf.location(h, s, key) != bf.index(fnv32(s, key)) {
+					t.Fatalf("inline hash differs from fnv for %q", key)
+				}
+				if bf.Filter.get(uint64(bf.location(h, s, key))) == 0 {
+					generic = false
+				}
+			}
+
+			if b.Exists(key) != generic {
+				t.Fatalf("Exists(%q) differs from the generic path", key)
+			}
+		}
+
+		key := []byte("a short key of under 32 bytes")
+		if n := testing.AllocsPerRun(100, func() { b.Exists(key) }); n != 0 {
+			t.Errorf("Exists made %f allocations, want 0", n)
+		}
+	}
+}
+
+func BenchmarkExistsShortKey(b *testing.B) {
+
+	bf := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	key := []byte("user:1234567890")
+	bf.Insert(key)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bf.Exists(key)
+	}
+}
+
+func TestWithout(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+
+	var remaining [][]byte
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		b.Insert(key)
+		if i%2 == 0 {
+			remaining = append(remaining, key)
+		}
+	}
+
+	nb := b.Without(remaining, ERRPCT)
+
+	if nb.Len() != uint32(len(remaining)) {
+		t.Errorf("rebuilt Len=%d, want %d", nb.Len(), len(remaining))
+	}
+
+	removed := 0
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if i%2 == 0 && !nb.Exists(key) {
+			t.Fatalf("remaining %s is missing", key)
+		}
+		if i%2 == 1 && nb.Exists(key) {
+			removed++
+		}
+	}
+
+	if removed > 10 {
+		t.Errorf("%d of 500 removed items still present", removed)
+	}
+
+	if !b.Exists([]byte("key-1")) {
+		t.Error("Without modified the original filter")
+	}
+
+	// the rebuilt filter has its own checkpoint
+	b.Checkpoint()
+	nb.Checkpoint()
+	var diff bytes.Buffer
+	b.SerializeDiff(&diff)
+	if diff.Len() != 16 {
+		t.Errorf("checkpoint of the rebuilt filter changed the original's: diff is %d bytes", diff.Len())
+	}
+}
+
+func TestSplitCombine(t *testing.T) {
+
+	b := NewMixedBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	for i := 0; i < 1000; i++ {
+		b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	b.SetTag("2024-06-01")
+
+	for _, n := range []int{1, 3, 8, len(b.(*bloomFilter2).Filter)} {
+		shards, err := b.Split(n)
+		if err != nil {
+			t.Fatalf("Split(%d) failed: %v", n, err)
+		}
+		if len(shards) != n {
+			t.Fatalf("Split(%d) returned %d shards", n, len(shards))
+		}
+
+		// reverse the order, as if they came back from parallel writers
+		for i, j := 0, len(shards)-1; i < j; i, j = i+1, j-1 {
+			shards[i], shards[j] = shards[j], shards[i]
+		}
+
+		c, err := Combine(shards)
+		if err != nil {
+			t.Fatalf("Combine of %d shards failed: %v", n, err)
+		}
+		if !c.Equal(b) {
+			t.Errorf("Combine(Split(%d)) differs from the original", n)
+		}
+		if c.Tag() != b.Tag() {
+			t.Errorf("Combine(Split(%d)) has tag %q, want %q", n, c.Tag(), b.Tag())
+		}
+	}
+
+	if _, err := b.Split(0); err == nil {
+		t.Error("Split(0) succeeded")
+	}
+
+	shards, _ := b.Split(4)
+	shards[0].Salts[0][0] ^= 1
+	if b.(*bloomFilter2).Salts[0][0] == shards[0].Salts[0][0] {
+		t.Error("Split shares salts with the filter")
+	}
+	shards[0].Salts[0][0] ^= 1
+	if _, err := Combine(shards[:3]); err == nil {
+		t.Error("Combine with a missing shard succeeded")
+	}
+
+	shards[1].Tag = "2024-06-02"
+	if _, err := Combine(shards); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("Combine of shards with different tags: got %v, want ErrIncompatible", err)
+	}
+	shards[1].Tag = b.Tag()
+
+	other, _ := NewTestBloomFilter(CAPACITY, ERRPCT).Split(4)
+	shards[2] = other[2]
+	if _, err := Combine(shards); err == nil {
+		t.Error("Combine with a foreign shard succeeded")
+	}
+}
+
+func TestFilterBitsMin(t *testing.T) {
+
+	// 10 elements at 1% need about 96 bits
+	for _, tt := range []struct {
+		min  uint64
+		want uint64
+	}{
+		{0, 128},
+		{1024, 1024},
+		{4096, 4096},
+		{3000, 4096},
+	} {
+		if got := FilterBitsMin(10, ERRPCT, tt.min); got != tt.want {
+			t.Errorf("FilterBitsMin(10, %v, %d) = %d, want %d", ERRPCT, tt.min, got, tt.want)
+		}
+
+		b := NewBloomFilterMin(10, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7}, tt.min)
+		if err := b.Validate(); err != nil || b.(*bloomFilter2).Bits != tt.want {
+			t.Errorf("NewBloomFilterMin(min=%d) has %d bits, want %d (%v)", tt.min, b.(*bloomFilter2).Bits, tt.want, err)
+		}
+
+		b.Insert([]byte("tiny"))
+		if !b.Exists([]byte("tiny")) {
+			t.Errorf("NewBloomFilterMin(min=%d) lost an insert", tt.min)
+		}
+	}
+
+	if FilterBits2(10, ERRPCT) != FilterBitsMin(10, ERRPCT, 1024) || FilterBits2(CAPACITY, ERRPCT) != FilterBitsMin(CAPACITY, ERRPCT, 1024) {
+		t.Error("FilterBits2 does not default to a 1024 bit minimum")
+	}
+
+	if SaltsRequiredMin(10, ERRPCT, 0) >= SaltsRequired2(10, ERRPCT) {
+		t.Error("an exactly sized filter should need fewer salts than a padded one")
+	}
+}
+
+func TestConfiguredFPR(t *testing.T) {
+
+	salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+
+	strict := NewBloomFilter2(CAPACITY, 0.005, salts)
+	loose := NewBloomFilterMin(CAPACITY, 0.01, salts, 0)
+
+	if strict.ConfiguredFPR() != 0.005 || loose.ConfiguredFPR() != 0.01 {
+		t.Fatalf("configured rates %v and %v, want 0.005 and 0.01", strict.ConfiguredFPR(), loose.ConfiguredFPR())
+	}
+
+	if err := strict.Merge(loose); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if strict.ConfiguredFPR() != 0.01 {
+		t.Errorf("merged rate %v, want the looser 0.01", strict.ConfiguredFPR())
+	}
+
+	data, _ := strict.MarshalBinary()
+	b := NewBloomFilter2(1, ERRPCT, nil)
+	b.UnmarshalBinary(data)
+	if b.ConfiguredFPR() != 0.01 {
+		t.Errorf("decoded rate %v, want 0.01", b.ConfiguredFPR())
+	}
+}
+
+func TestRotate(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	for i := 0; i < 100; i++ {
+		b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	newSalts := []uint32{11, 12, 13, 14, 15, 16, 17}
+	b.Rotate(newSalts)
+
+	if b.Len() != 0 || b.PopCount() != 0 {
+		t.Errorf("rotated filter has Len=%d and %d bits set, want empty", b.Len(), b.PopCount())
+	}
+	if b.Exists([]byte("key-1")) {
+		t.Error("rotated filter still holds an old element")
+	}
+
+	b.Insert([]byte("fresh"))
+	want := NewBloomFilter2(CAPACITY, ERRPCT, newSalts)
+	want.Insert([]byte("fresh"))
+	if !b.Equal(want) {
+		t.Error("rotated filter does not use the new salts")
+	}
+}
+
+func TestIndices(t *testing.T) {
+
+	for _, b := range []BloomFilter2{
+		NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7}),
+		NewMixedBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7}),
+	} {
+		bf := b.(*bloomFilter2)
+		key := []byte("debug me")
+
+		idx := b.Indices(key)
+		if len(idx) != len(bf.Salts) {
+			t.Fatalf("got %d indices, want %d", len(idx), len(bf.Salts))
+		}
+
+		again := b.Indices(key)
+		for i, x := range idx {
+			if x >= bf.Bits {
+				t.Errorf("index %d is out of range", x)
+			}
+			if again[i] != x {
+				t.Error("indices differ between calls")
+			}
+		}
+
+		b.Insert(key)
+		if b.PopCount() > uint64(len(idx)) {
+			t.Errorf("Insert set %d bits, more than its %d indices", b.PopCount(), len(idx))
+		}
+		for _, x := range idx {
+			if bf.Filter.get(x) == 0 {
+				t.Errorf("Insert did not set index %d", x)
+			}
+		}
+	}
+}
+
+func TestMergeParallel(t *testing.T) {
+
+	a := NewTestBloomFilter(CAPACITY, ERRPCT)
+	b := NewTestBloomFilter(CAPACITY, ERRPCT)
+	for i := 0; i < 1000; i++ {
+		a.Insert([]byte(fmt.Sprintf("a-%d", i)))
+		b.Insert([]byte(fmt.Sprintf("b-%d", i)))
+	}
+
+	serial := NewTestBloomFilter(CAPACITY, ERRPCT)
+	serial.Merge(a)
+	serial.Merge(b)
+
+	for _, workers := range []int{0, 1, 3, 8, 1 << 20} {
+		parallel := NewTestBloomFilter(CAPACITY, ERRPCT)
+		if err := parallel.MergeParallel(a, workers); err != nil {
+			t.Fatalf("MergeParallel(%d) failed: %v", workers, err)
+		}
+		parallel.MergeParallel(b, workers)
+
+		if !parallel.Equal(serial) {
+			t.Errorf("MergeParallel with %d workers differs from Merge", workers)
+		}
+	}
+
+	if err := a.MergeParallel(NewTestBloomFilter(CAPACITY*4, ERRPCT), 4); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("incompatible MergeParallel: got %v, want ErrIncompatible", err)
+	}
+}
+
+func TestInsertAllParallel(t *testing.T) {
+
+	items := make([][]byte, 20000)
+	for i := range items {
+		items[i] = []byte(fmt.Sprintf("item-%d", i))
+	}
+
+	salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+	keyed := func() BloomFilter2 {
+		b, _ := NewKeyedBloomFilter(CAPACITY, ERRPCT, []byte("0123456789abcdef"))
+		return b
+	}
+	for name, mk := range map[string]func() BloomFilter2{
+		"plain": func() BloomFilter2 { return NewBloomFilter2(CAPACITY, ERRPCT, salts) },
+		"wide":  func() BloomFilter2 { return NewWideBloomFilter(CAPACITY, ERRPCT, salts) },
+		"keyed": keyed,
+		"hll":   func() BloomFilter2 { return NewBloomFilterWithHLL(CAPACITY, ERRPCT, salts) },
+	} {
+		serial := mk()
+		for _, b := range items {
+			serial.Insert(b)
+		}
+
+		for _, workers := range []int{0, 1, 4, 16, 1 << 20} {
+			parallel := mk()
+			if n := parallel.InsertAllParallel(items, workers); n != len(items) || parallel.Len() != uint32(len(items)) {
+				t.Errorf("%s, %d workers: inserted %d, Len %d, want %d", name, workers, n, parallel.Len(), len(items))
+			}
+			if !parallel.Equal(serial) {
+				t.Errorf("%s, %d workers: filter differs from serial inserts", name, workers)
+			}
+		}
+	}
+
+	frozen := NewBloomFilter2(CAPACITY, ERRPCT, salts)
+	frozen.SetReadOnly(true)
+	if n := frozen.InsertAllParallel(items, 4); n != 0 || frozen.PopCount() != 0 {
+		t.Errorf("read-only filter inserted %d items", n)
+	}
+}
+
+func benchmarkInsertAll(b *testing.B, insert func(bf BloomFilter2, items [][]byte)) {
+
+	items := make([][]byte, 1<<16)
+	for i := range items {
+		items[i] = []byte(fmt.Sprintf("item-%d", i))
+	}
+	bf := NewTestBloomFilter(1<<20, ERRPCT)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		insert(bf, items)
+	}
+}
+
+func BenchmarkInsertAllSerial(b *testing.B) {
+	benchmarkInsertAll(b, func(bf BloomFilter2, items [][]byte) {
+		for _, x := range items {
+			bf.Insert(x)
+		}
+	})
+}
+
+func BenchmarkInsertAllParallel(b *testing.B) {
+	benchmarkInsertAll(b, func(bf BloomFilter2, items [][]byte) { bf.InsertAllParallel(items, runtime.GOMAXPROCS(0)) })
+}
+
+func benchmarkMerge(b *testing.B, merge func(dst, src BloomFilter2)) {
+
+	dst := NewTestBloomFilter(1<<26, ERRPCT)
+	src := NewTestBloomFilter(1<<26, ERRPCT)
+
+	b.SetBytes(int64(4 * len(src.(*bloomFilter2).Filter)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		merge(dst, src)
+	}
+}
+
+func BenchmarkMergeSerial(b *testing.B) {
+	benchmarkMerge(b, func(dst, src BloomFilter2) { dst.Merge(src) })
+}
+
+func BenchmarkMergeParallel(b *testing.B) {
+	benchmarkMerge(b, func(dst, src BloomFilter2) { dst.MergeParallel(src, runtime.GOMAXPROCS(0)) })
+}
+
+func TestSizeBytes(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+
+	// 2^17 bits, 7 four byte salts with 24 byte slice headers
+	overhead := int(unsafe.Sizeof(bloomFilter2{}))
+	want := overhead + (1<<17)/8 + 7*(24+4)
+	if got := b.SizeBytes(); got != want {
+		t.Errorf("SizeBytes=%d, want %d", got, want)
+	}
+
+	b.Compress()
+	if got := b.SizeBytes(); got != want-(1<<16)/8 {
+		t.Errorf("SizeBytes after Compress=%d, want %d", got, want-(1<<16)/8)
+	}
+
+	h := NewBloomFilterWithHLL(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	if got := h.SizeBytes(); got != want+24+1<<hllPrecision {
+		t.Errorf("SizeBytes with HLL=%d, want %d", got, want+24+1<<hllPrecision)
+	}
+}
+
+func TestExistsHashes(t *testing.T) {
+
+	b := NewTestBloomFilter(CAPACITY, ERRPCT)
+
+	r := rand.New(rand.NewSource(1))
+	hashes := make([]uint64, 2000)
+	for i := range hashes {
+		hashes[i] = r.Uint64()
+		if i%2 == 0 {
+			b.InsertHash(hashes[i])
+		}
+	}
+
+	present := b.ExistsHashes(hashes)
+	if len(present) != len(hashes) {
+		t.Fatalf("got %d results for %d hashes", len(present), len(hashes))
+	}
+
+	fp := 0
+	for i, h := range hashes {
+		if present[i] != b.ExistsHash(h) {
+			t.Fatalf("ExistsHashes and ExistsHash differ for hash %d", i)
+		}
+		if i%2 == 0 && !present[i] {
+			t.Fatalf("inserted hash %d is missing", i)
+		}
+		if i%2 == 1 && present[i] {
+			fp++
+		}
+	}
+
+	if fp > 20 {
+		t.Errorf("%d of 1000 absent hashes are present", fp)
+	}
+}
+
+func TestLenSemantics(t *testing.T) {
+
+	salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+	fill := func(n int) BloomFilter2 {
+		b := NewBloomFilter2(CAPACITY, ERRPCT, salts)
+		for i := 0; i < n; i++ {
+			b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+		}
+		return b
+	}
+
+	b := fill(1000)
+	ratio := b.LoadRatio()
+	if err := b.Compress(); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 1000 || b.LoadRatio() != 2*ratio {
+		t.Errorf("after Compress: Len %d, LoadRatio %v, want 1000 and %v", b.Len(), b.LoadRatio(), 2*ratio)
+	}
+
+	b = fill(1000)
+	if err := b.Merge(fill(300)); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 1300 {
+		t.Errorf("after Merge: Len %d, want 1300", b.Len())
+	}
+	data, _ := fill(200).MarshalBinary()
+	if err := b.MergeBytes(data); err != nil || b.Len() != 1500 {
+		t.Errorf("after MergeBytes: Len %d (%v), want 1500", b.Len(), err)
+	}
+
+	big := fill(0)
+	big.(*bloomFilter2).Elements = math.MaxUint32 - 5
+	big.Merge(fill(10))
+	if big.Len() != math.MaxUint32 {
+		t.Errorf("overflowing Merge: Len %d, want math.MaxUint32", big.Len())
+	}
+
+	if err := b.Clear(); err != nil || b.Len() != 0 {
+		t.Errorf("after Clear: Len %d (%v), want 0", b.Len(), err)
+	}
+}
+
+func TestUnionWithOverlap(t *testing.T) {
+
+	salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+	fill := func(from, to int) BloomFilter2 {
+		b := NewBloomFilter2(CAPACITY, ERRPCT, salts)
+		for i := from; i < to; i++ {
+			b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+		}
+		return b
+	}
+
+	// 0-600 and 400-1000 share 200 keys
+	a, b := fill(0, 600), fill(400, 1000)
+	if err := a.UnionWithOverlap(b, 200); err != nil {
+		t.Fatal(err)
+	}
+	if a.Len() != 1000 {
+		t.Errorf("Len after union with overlap 200 = %d, want 1000", a.Len())
+	}
+	if !a.Equal(fill(0, 1000)) {
+		t.Error("union holds different bits from a filter of all the keys")
+	}
+	if est := a.EstimateCount(); est < 950 || est > 1050 {
+		t.Errorf("EstimateCount %v does not agree with Len %d", est, a.Len())
+	}
+
+	// an overlap larger than either set counts the smaller one as contained in the larger
+	a, b = fill(0, 600), fill(0, 100)
+	a.UnionWithOverlap(b, 5000)
+	if a.Len() != 600 {
+		t.Errorf("Len after union with an oversized overlap = %d, want 600", a.Len())
+	}
+
+	a = fill(0, 600)
+	if err := a.UnionWithOverlap(NewBloomFilter2(CAPACITY, ERRPCT, []uint32{8}), 0); !errors.Is(err, ErrIncompatible) || a.Len() != 600 {
+		t.Errorf("incompatible union: got %v with Len %d", err, a.Len())
+	}
+}
+
+func TestUnionWithStats(t *testing.T) {
+
+	salts := [][]byte{{1}, {2}, {3}}
+	const bits = 1024
+
+	// disjoint sources: evens, odds below 512, odds above
+	var evens, lowOdds, highOdds []uint64
+	for i := uint64(0); i < bits; i++ {
+		switch {
+		case i%2 == 0:
+			evens = append(evens, i)
+		case i < 512:
+			lowOdds = append(lowOdds, i)
+		default:
+			highOdds = append(highOdds, i)
+		}
+	}
+
+	var sources []BloomFilter2
+	for _, set := range [][]uint64{evens, lowOdds, highOdds, lowOdds} {
+		f, err := NewBloomFilterFromBits(bits, salts, set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, f)
+	}
+
+	union, added, err := UnionWithStats(sources...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{512, 256, 256, 0}; fmt.Sprint(added) != fmt.Sprint(want) {
+		t.Errorf("contributions %v, want %v", added, want)
+	}
+	if union.PopCount() != bits {
+		t.Errorf("union has %d bits set, want %d", union.PopCount(), bits)
+	}
+	if sources[0].PopCount() != 512 {
+		t.Errorf("union changed its first source")
+	}
+
+	other := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3})
+	if _, _, err := UnionWithStats(sources[0], other); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("incompatible sources: got %v, want ErrIncompatible", err)
+	}
+	if _, _, err := UnionWithStats(); err == nil {
+		t.Error("union of no filters succeeded")
+	}
+}
+
+func TestNewBloomFilterFromBits(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	for i := 0; i < 100; i++ {
+		b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	set := b.SetBits()
+	if uint64(len(set)) != b.PopCount() {
+		t.Fatalf("SetBits listed %d bits, PopCount is %d", len(set), b.PopCount())
+	}
+	for i := 1; i < len(set); i++ {
+		if set[i] <= set[i-1] {
+			t.Fatalf("SetBits out of order at %d", i)
+		}
+	}
+
+	bf := b.(*bloomFilter2)
+	c, err := NewBloomFilterFromBits(bf.Bits, bf.Salts, set)
+	if err != nil {
+		t.Fatalf("NewBloomFilterFromBits failed: %v", err)
+	}
+	if n, err := b.DiffCount(c); n != 0 || err != nil {
+		t.Errorf("reconstructed filter differs by %d bits (%v)", n, err)
+	}
+	for i := 0; i < 100; i++ {
+		if !c.Exists([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("key-%d missing from the reconstructed filter", i)
+		}
+	}
+
+	// with the counts that are not part of the representation restored, the two are Equal
+	cf := c.(*bloomFilter2)
+	cf.Capacity, cf.Elements, cf.FalsePositiveRate = bf.Capacity, bf.Elements, bf.FalsePositiveRate
+	if !c.Equal(b) {
+		t.Error("reconstructed filter is not Equal to the original")
+	}
+
+	if _, err := NewBloomFilterFromBits(bf.Bits, bf.Salts, []uint64{bf.Bits}); err == nil {
+		t.Error("out of range index accepted")
+	}
+	if _, err := NewBloomFilterFromBits(1000, bf.Salts, nil); err == nil {
+		t.Error("Bits that are not a power of two accepted")
+	}
+	if _, err := NewBloomFilterFromBits(bf.Bits, nil, nil); !errors.Is(err, ErrNoSalts) {
+		t.Errorf("no salts: got %v, want ErrNoSalts", err)
+	}
+}
+
+func TestStaleBits(t *testing.T) {
+
+	// the newer generation re-inserts half of the old keys and adds new ones
+	older := NewTestBloomFilter(CAPACITY, ERRPCT)
+	newer := NewTestBloomFilter(CAPACITY, ERRPCT)
+	for i := 0; i < 1000; i++ {
+		older.Insert([]byte(fmt.Sprintf("key-%d", i)))
+		newer.Insert([]byte(fmt.Sprintf("key-%d", i+500)))
+	}
+
+	stale, err := older.StaleBits(newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale == 0 {
+		t.Error("older generation with dropped keys has no stale bits")
+	}
+
+	// once the newer generation covers every old key nothing is stale
+	for i := 0; i < 500; i++ {
+		newer.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	if n, _ := older.StaleBits(newer); n != 0 {
+		t.Errorf("%d stale bits after the newer generation caught up", n)
+	}
+	if n, _ := newer.StaleBits(older); n == 0 {
+		t.Error("the newer generation has no bits the older lacks")
+	}
+
+	// known bits set only in the older generation
+	empty := NewTestBloomFilter(CAPACITY, ERRPCT)
+	old := EmptyLike(empty).(*bloomFilter2)
+	for _, bit := range []uint64{0, 31, 32, 4097} {
+		old.Filter.set(bit)
+	}
+	if n, _ := old.StaleBits(empty); n != 4 {
+		t.Errorf("StaleBits=%d, want 4", n)
+	}
+	if n, _ := empty.StaleBits(old); n != 0 {
+		t.Errorf("StaleBits of an empty filter=%d, want 0", n)
+	}
+
+	if _, err := older.StaleBits(NewTestBloomFilter(CAPACITY*4, ERRPCT)); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("incompatible StaleBits: got %v, want ErrIncompatible", err)
+	}
+}
+
+func TestDiffCount(t *testing.T) {
+
+	primary := NewTestBloomFilter(CAPACITY, ERRPCT)
+	replica := NewTestBloomFilter(CAPACITY, ERRPCT)
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		primary.Insert(key)
+		replica.Insert(key)
+	}
+
+	if n, err := primary.DiffCount(replica); n != 0 || err != nil {
+		t.Errorf("identical replicas differ by %d bits (%v)", n, err)
+	}
+
+	// flip known bits directly
+	p := primary.(*bloomFilter2)
+	flipped := 0
+	for _, bit := range []uint32{0, 1, 63, 1000, 4097} {
+		p.Filter[bit/32] ^= 1 << (bit % 32)
+		flipped++
+	}
+
+	if n, err := primary.DiffCount(replica); n != flipped || err != nil {
+		t.Errorf("DiffCount=%d (%v), want %d", n, err, flipped)
+	}
+	if n, _ := replica.DiffCount(primary); n != flipped {
+		t.Errorf("DiffCount is not symmetric: %d", n)
+	}
+
+	if _, err := primary.DiffCount(NewTestBloomFilter(CAPACITY*4, ERRPCT)); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("incompatible DiffCount: got %v, want ErrIncompatible", err)
+	}
+}
+
+func TestOnInsert(t *testing.T) {
+
+	b := NewTestBloomFilter(CAPACITY, ERRPCT)
+
+	var seen []string
+	var novelty []bool
+	b.OnInsert(func(key []byte, novel bool) {
+		seen = append(seen, string(key))
+		novelty = append(novelty, novel)
+	})
+
+	b.Insert([]byte("one"))
+	b.Insert([]byte("one"))
+	b.InsertNew([]byte("two"))
+	b.InsertNew([]byte("two"))
+
+	wantSeen := []string{"one", "one", "two", "two"}
+	wantNovel := []bool{true, false, true, false}
+	if len(seen) != len(wantSeen) {
+		t.Fatalf("observer fired %d times, want %d", len(seen), len(wantSeen))
+	}
+	for i := range wantSeen {
+		if seen[i] != wantSeen[i] || novelty[i] != wantNovel[i] {
+			t.Errorf("call %d: got (%s, %v), want (%s, %v)", i, seen[i], novelty[i], wantSeen[i], wantNovel[i])
+		}
+	}
+
+	if b.Len() != 3 {
+		t.Errorf("Len=%d with an observer, want 3", b.Len())
+	}
+
+	b.OnInsert(nil)
+	b.Insert([]byte("three"))
+	if len(seen) != len(wantSeen) {
+		t.Error("removed observer still fired")
+	}
+}
+
+func TestEmptyLike(t *testing.T) {
+
+	f := NewMixedBloomFilter2(CAPACITY, ERRPCT, []uint32{5, 6, 7, 8})
+	f.Insert([]byte("original"))
+
+	e := EmptyLike(f)
+	if e.Len() != 0 || e.PopCount() != 0 || e.Cap() != f.Cap() {
+		t.Errorf("EmptyLike has Len=%d, %d bits set, Cap=%d", e.Len(), e.PopCount(), e.Cap())
+	}
+
+	e.Insert([]byte("copy"))
+	if err := f.Merge(e); err != nil {
+		t.Fatalf("EmptyLike is not mergeable: %v", err)
+	}
+	if !f.Exists([]byte("original")) || !f.Exists([]byte("copy")) {
+		t.Error("merge with EmptyLike lost an element")
+	}
+
+	k, _ := NewKeyedBloomFilter(CAPACITY, ERRPCT, []byte("0123456789abcdef"))
+	if err := k.Merge(EmptyLike(k)); err != nil {
+		t.Errorf("EmptyLike of a keyed filter is not mergeable: %v", err)
+	}
+}
+
+func TestInsertStrict(t *testing.T) {
+
+	b := NewTestBloomFilter(CAPACITY, ERRPCT)
+
+	for _, key := range [][]byte{nil, {}} {
+		if _, err := b.InsertStrict(key); err != ErrEmptyKey {
+			t.Errorf("InsertStrict(%#v): got %v, want ErrEmptyKey", key, err)
+		}
+	}
+	if b.Len() != 0 || b.Exists(nil) {
+		t.Error("InsertStrict stored an empty key")
+	}
+
+	if ok, err := b.InsertStrict([]byte("real")); !ok || err != nil {
+		t.Errorf("InsertStrict of a real key: got (%v, %v)", ok, err)
+	}
+	if !b.Exists([]byte("real")) {
+		t.Error("InsertStrict lost a real key")
+	}
+
+	// the lenient Insert still stores empty keys
+	b.Insert(nil)
+	if !b.Exists([]byte{}) {
+		t.Error("Insert did not store an empty key")
+	}
+}
+
+func TestOptimal(t *testing.T) {
+
+	bits, k, salts := Optimal(CAPACITY, ERRPCT)
+
+	if k != len(salts) || k < 2 {
+		t.Fatalf("Optimal returned k=%d with %d salts", k, len(salts))
+	}
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, salts)
+	if b.(*bloomFilter2).Bits != bits {
+		t.Errorf("filter has %d bits, Optimal said %d", b.(*bloomFilter2).Bits, bits)
+	}
+
+	fpr := measureFPR(b, CAPACITY)
+	t.Log("false positive rate with optimal parameters:", fpr)
+	if fpr > 2*ERRPCT {
+		t.Errorf("false positive rate %f, want near %f", fpr, ERRPCT)
+	}
+}
+
+func TestExistsExact(t *testing.T) {
+
+	// a deliberately overfilled filter, so false positives are common
+	b := NewTestBloomFilter(100, 0.1)
+	set := make(map[string]struct{})
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		b.Insert([]byte(key))
+		set[key] = struct{}{}
+	}
+
+	lookups := 0
+	b.SetExactLookup(func(key []byte) bool {
+		lookups++
+		_, ok := set[string(key)]
+		return ok
+	})
+
+	fp := 0
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprintf("other-%d", i))
+		if b.Exists(key) {
+			fp++
+		}
+		if b.ExistsExact(key) {
+			t.Fatalf("ExistsExact reported absent %s present", key)
+		}
+	}
+	for key := range set {
+		if !b.ExistsExact([]byte(key)) {
+			t.Fatalf("ExistsExact lost %s", key)
+		}
+	}
+
+	t.Log(fp, "bloom false positives,", lookups, "exact lookups")
+	if fp == 0 {
+		t.Error("test filter produced no false positives to eliminate")
+	}
+	if lookups != fp+len(set) {
+		t.Errorf("%d exact lookups, want one per bloom positive (%d)", lookups, fp+len(set))
+	}
+}
+
+func TestWalk(t *testing.T) {
+
+	b := NewTestBloomFilter(CAPACITY, ERRPCT)
+	for i := 0; i < 1000; i++ {
+		b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	var n uint64
+	words := 0
+	b.Walk(func(i int, w uint32) bool {
+		if i != words {
+			t.Fatalf("Walk visited word %d out of order", i)
+		}
+		words++
+		for ; w != 0; w &= w - 1 {
+			n++
+		}
+		return true
+	})
+
+	if n != b.PopCount() || words != len(b.(*bloomFilter2).Filter) {
+		t.Errorf("Walk counted %d bits in %d words, PopCount=%d", n, words, b.PopCount())
+	}
+
+	visited := 0
+	b.Walk(func(i int, w uint32) bool {
+		visited++
+		return i < 9
+	})
+	if visited != 10 {
+		t.Errorf("Walk visited %d words after fn returned false, want 10", visited)
+	}
+}
+
+func TestNewBloomFilterFromScanner(t *testing.T) {
+
+	var input bytes.Buffer
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&input, "line-%d\n", i)
+	}
+
+	b, err := NewBloomFilterFromScanner(bufio.NewScanner(&input), 5000, ERRPCT)
+	if err != nil {
+		t.Fatalf("NewBloomFilterFromScanner failed: %v", err)
+	}
+
+	if b.Len() != 5000 {
+		t.Errorf("Len=%d, want 5000", b.Len())
+	}
+
+	fp := 0
+	for i := 0; i < 5000; i++ {
+		if !b.Exists([]byte(fmt.Sprintf("line-%d", i))) {
+			t.Fatalf("line-%d missing", i)
+		}
+		if b.Exists([]byte(fmt.Sprintf("line-%d\n", i))) {
+			fp++
+		}
+	}
+
+	if fp > 100 {
+		t.Errorf("%d of 5000 absent keys present", fp)
+	}
+
+	// scanner errors are returned
+	long := bufio.NewScanner(bytes.NewReader(bytes.Repeat([]byte("x"), bufio.MaxScanTokenSize+1)))
+	if _, err := NewBloomFilterFromScanner(long, 10, ERRPCT); err == nil {
+		t.Error("scanner error was not returned")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	for i := 0; i < 1000; i++ {
+		b.Insert([]byte(fmt.Sprintf("ro-%d", i)))
+	}
+
+	other := EmptyLike(b)
+	other.Insert([]byte("other"))
+
+	var buf bytes.Buffer
+	other.WriteTo(&buf)
+	data, _ := other.MarshalBinary()
+
+	b.Checkpoint()
+	var diff bytes.Buffer
+	b.SerializeDiff(&diff)
+
+	before, _ := b.MarshalBinary()
+
+	b.SetReadOnly(true)
+	if !b.ReadOnly() {
+		t.Fatal("ReadOnly is false after SetReadOnly(true)")
+	}
+
+	if b.Insert([]byte("x")) {
+		t.Error("Insert on read-only filter returned true")
+	}
+	if b.InsertNew([]byte("x")) {
+		t.Error("InsertNew on read-only filter returned true")
+	}
+	if b.InsertHash(42) {
+		t.Error("InsertHash on read-only filter returned true")
+	}
+	b.TouchAndMaybeInsert([]byte("x"), 1)
+
+	errs := map[string]error{
+		"Merge":         b.Merge(other),
+		"MergeFrom":     b.MergeFrom(&buf),
+		"MergeParallel": b.MergeParallel(other, 4),
+		"Compress":      b.Compress(),
+		"Clear":         b.Clear(),
+		"Rotate":        b.Rotate([]uint32{8, 9}),
+		"Repair":        b.Repair(),
+		"ApplyDiff":     b.ApplyDiff(&diff),
+		"Unmarshal":     b.UnmarshalBinary(data),
+		"SetKey":        b.SetKey(make([]byte, 16)),
+		"AppendSalt":    b.AppendSalt(8),
+	}
+	_, errs["InsertStrict"] = b.InsertStrict([]byte("x"))
+
+	for name, err := range errs {
+		if err != ErrReadOnly {
+			t.Errorf("%s on read-only filter: got %v, want ErrReadOnly", name, err)
+		}
+	}
+
+	if after, _ := b.MarshalBinary(); !bytes.Equal(before, after) {
+		t.Error("read-only filter was modified")
+	}
+
+	b.SetReadOnly(false)
+	if !b.Insert([]byte("x")) || !b.Exists([]byte("x")) {
+		t.Error("Insert failed after SetReadOnly(false)")
+	}
+	if err := b.Compress(); err != nil {
+		t.Errorf("Compress after SetReadOnly(false): %v", err)
+	}
+
+	// the frozen copy is read-only through its embedded filter too
+	f := b.Freeze()
+	if !f.bf.ReadOnly() {
+		t.Error("frozen filter is not read-only")
+	}
+	if err := f.bf.Clear(); err != ErrReadOnly {
+		t.Errorf("Clear on frozen filter: got %v, want ErrReadOnly", err)
+	}
+}
+
+func TestWideBloomFilter(t *testing.T) {
+
+	b := NewWideBloomFilter(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	for i := 0; i < CAPACITY; i++ {
+		b.Insert([]byte(fmt.Sprintf("wide-%d", i)))
+	}
+
+	for i := 0; i < CAPACITY; i++ {
+		if !b.Exists([]byte(fmt.Sprintf("wide-%d", i))) {
+			t.Fatalf("wide-%d missing", i)
+		}
+	}
+
+	if fpr := measureFPR(NewWideBloomFilter(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7}), CAPACITY); fpr > 2*ERRPCT {
+		t.Errorf("wide filter false positive rate %f, want about %f", fpr, ERRPCT)
+	}
+
+	data, _ := b.MarshalBinary()
+	var c bloomFilter2
+	if err := c.UnmarshalBinary(data); err != nil || !c.Wide || !b.Equal(&c) {
+		t.Errorf("binary round trip lost wide hashing: %v", err)
+	}
+
+	if err := b.Merge(NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("merging wide and narrow filters: got %v, want ErrIncompatible", err)
+	}
+}
+
+func TestWideBloomFilterHighRange(t *testing.T) {
+
+	// only the indices are computed, so the 128 GiB bit vector is never allocated
+	const Bits = 1 << 40
+	bf := &bloomFilter2{Bits: Bits, Wide: true}
+	for _, s := range []uint32{1, 2, 3, 4, 5, 6, 7, 8} {
+		bf.Salts = append(bf.Salts, uint32ToByteArray2(s))
+	}
+
+	const buckets = 16
+	var counts [buckets]int
+	high, n := 0, 0
+	for i := 0; i < 20000; i++ {
+		for _, x := range bf.Indices([]byte(fmt.Sprintf("key-%d", i))) {
+			if x >= Bits {
+				t.Fatalf("index %d out of range", x)
+			}
+			if x >= 1<<32 {
+				high++
+			}
+			counts[x/(Bits/buckets)]++
+			n++
+		}
+	}
+
+	// all but 1/256 of the range lies above 2^32
+	if frac := float64(high) / float64(n); frac < 0.99 {
+		t.Errorf("only %f of indices above 2^32", frac)
+	}
+
+	expected := float64(n) / buckets
+	chi := 0.0
+	for _, c := range counts {
+		d := float64(c) - expected
+		chi += d * d / expected
+	}
+
+	// 15 degrees of freedom; 37.7 is the 0.001 critical value
+	if chi > 37.7 {
+		t.Errorf("indices are not uniform over the bit vector: chi-squared %f, counts %v", chi, counts)
+	}
+}
+
+func TestOptimalHashesForCurrentSize(t *testing.T) {
+
+	// textbook optimal k = m/n ln 2
+	for _, tc := range []struct {
+		m    uint64
+		n    uint32
+		want int
+	}{
+		{8 << 10, 1 << 10, 6},
+		{10 << 10, 1 << 10, 7},
+		{16 << 10, 1 << 10, 11},
+		{1 << 20, 1 << 20, 1},
+	} {
+		bf := &bloomFilter2{Bits: tc.m, Capacity: tc.n}
+		if k := bf.OptimalHashesForCurrentSize(1e-9); k != tc.want {
+			t.Errorf("m=%d n=%d: k=%d, want %d", tc.m, tc.n, k, tc.want)
+		}
+	}
+
+	// a loose target needs fewer salts than the optimum
+	bf := &bloomFilter2{Bits: 16 << 10, Capacity: 1 << 10}
+	k := bf.OptimalHashesForCurrentSize(0.01)
+	if k >= 11 || expectedFPR(bf.Bits, bf.Capacity, k) > 0.01 || expectedFPR(bf.Bits, bf.Capacity, k-1) <= 0.01 {
+		t.Errorf("k=%d is not the fewest salts reaching 1%%", k)
+	}
+
+	// Compress halves Bits and Capacity together, so the answer does not change
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	before := b.OptimalHashesForCurrentSize(ERRPCT)
+	b.Compress()
+	if after := b.OptimalHashesForCurrentSize(ERRPCT); after != before {
+		t.Errorf("after Compress k=%d, want %d", after, before)
+	}
+}
+
+func TestMergeDifferentSalts(t *testing.T) {
+
+	var a, b [][]byte
+	for i := 0; i < 1000; i++ {
+		a = append(a, []byte(fmt.Sprintf("a-%d", i)))
+		b = append(b, []byte(fmt.Sprintf("b-%d", i)))
+	}
+
+	fa := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	fb := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3})
+	for i := range a {
+		fa.Insert(a[i])
+		fb.Insert(b[i])
+	}
+
+	before, _ := fa.MarshalBinary()
+	for name, err := range map[string]error{
+		"Merge":         fa.Merge(fb),
+		"MergeParallel": fa.MergeParallel(fb, 2),
+	} {
+		if !errors.Is(err, ErrIncompatible) || !strings.Contains(err.Error(), "7 salts != 3 salts") {
+			t.Errorf("%s of filters with 7 and 3 salts: got %v", name, err)
+		}
+	}
+	if after, _ := fa.MarshalBinary(); !bytes.Equal(before, after) {
+		t.Error("failed Merge changed the filter")
+	}
+
+	// the salt count is reported even when the dimensions differ too
+	small := NewBloomFilter2(100, ERRPCT, []uint32{1, 2})
+	if err := fa.Merge(small); err == nil || !strings.Contains(err.Error(), "salts") {
+		t.Errorf("Merge of filters with different sizes and salts: got %v", err)
+	}
+
+	u := MergeRebuild(ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7}, a, b)
+	if u.Cap() != 2000 || u.Len() != 2000 {
+		t.Errorf("rebuilt Cap=%d Len=%d, want 2000 and 2000", u.Cap(), u.Len())
+	}
+	for i := range a {
+		if !u.Exists(a[i]) || !u.Exists(b[i]) {
+			t.Fatalf("rebuilt filter lost element %d", i)
+		}
+	}
+}
+
+func TestInsertUint64(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	manual := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	wide := NewWideBloomFilter(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+
+	var buf [8]byte
+	for i := uint64(0); i < CAPACITY; i++ {
+		x := i * 0x9e3779b97f4a7c15
+		binary.BigEndian.PutUint64(buf[:], x)
+		if b.InsertUint64(x) != manual.Insert(buf[:]) {
+			t.Fatalf("InsertUint64(%d) result differs from Insert", x)
+		}
+		wide.InsertUint64(x)
+	}
+
+	if !b.Equal(manual) {
+		t.Error("InsertUint64 set different bits from Insert of the encoded key")
+	}
+
+	for i := uint64(0); i < CAPACITY; i++ {
+		x := i * 0x9e3779b97f4a7c15
+		binary.BigEndian.PutUint64(buf[:], x)
+		if !b.ExistsUint64(x) || !manual.Exists(buf[:]) || !wide.ExistsUint64(x) || !wide.Exists(buf[:]) {
+			t.Fatalf("%d missing", x)
+		}
+	}
+
+	if n := testing.AllocsPerRun(100, func() { b.InsertUint64(42); b.ExistsUint64(42) }); n != 0 {
+		t.Errorf("%f allocations per InsertUint64 and ExistsUint64", n)
+	}
+}
+
+func TestCompatibility(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4})
+
+	if diffs := b.Compatibility(EmptyLike(b)); len(diffs) != 0 {
+		t.Errorf("identical filters: %v", diffs)
+	}
+
+	other := NewMixedBloomFilter2(2*CAPACITY, ERRPCT, []uint32{1, 9, 3, 8, 5})
+	want := []string{
+		"4 salts != 5 salts",
+		fmt.Sprintf("Bits %d != %d", b.(*bloomFilter2).Bits, other.(*bloomFilter2).Bits),
+		"hash mixing differs",
+		"salt 1 differs",
+		"salt 3 differs",
+		fmt.Sprintf("Capacity %d != %d", CAPACITY, 2*CAPACITY),
+	}
+
+	diffs := b.Compatibility(other)
+	if len(diffs) != len(want) {
+		t.Fatalf("got %d differences %q, want %d", len(diffs), diffs, len(want))
+	}
+	for i := range want {
+		if !strings.HasPrefix(diffs[i], want[i]) {
+			t.Errorf("difference %d is %q, want %q", i, diffs[i], want[i])
+		}
+	}
+
+	// Merge reports the first of them
+	if err := b.Merge(other); err == nil || !strings.Contains(err.Error(), diffs[0]) {
+		t.Errorf("Merge error %v does not match %q", err, diffs[0])
+	}
+
+	// Capacity alone does not prevent merging
+	sameBits := NewBloomFilter2(CAPACITY+1, ERRPCT, []uint32{1, 2, 3, 4})
+	if diffs := b.Compatibility(sameBits); len(diffs) != 1 || b.Merge(sameBits) != nil {
+		t.Errorf("differing Capacity: %q, Merge %v", diffs, b.Merge(sameBits))
+	}
+
+	if diffs := b.Compatibility(nil); len(diffs) != 1 {
+		t.Errorf("nil filter: %q", diffs)
+	}
+}
+
+func TestAppendSalt(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3})
+	for _, s := range []uint32{4, 5, 6, 7} {
+		if err := b.AppendSalt(s); err != nil {
+			t.Fatalf("AppendSalt(%d) on empty filter: %v", s, err)
+		}
+	}
+
+	if !b.Equal(NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})) {
+		t.Error("appending salts differs from constructing with them")
+	}
+
+	b.Insert([]byte("data"))
+	if err := b.AppendSalt(8); err != ErrNotEmpty {
+		t.Errorf("AppendSalt on populated filter: got %v, want ErrNotEmpty", err)
+	}
+	if len(b.(*bloomFilter2).Salts) != 7 || !b.Exists([]byte("data")) {
+		t.Error("failed AppendSalt changed the filter")
+	}
+
+	full := NewBloomFilter2(CAPACITY, ERRPCT, nil)
+	for i := 0; i < MaxSalts; i++ {
+		if err := full.AppendSalt(uint32(i)); err != nil {
+			t.Fatalf("AppendSalt %d: %v", i, err)
+		}
+	}
+	if err := full.AppendSalt(MaxSalts); err == nil {
+		t.Error("AppendSalt grew the filter past MaxSalts")
+	}
+}
+
+func TestNewBloomFilterRawSalts(t *testing.T) {
+
+	Salts := [][]byte{[]byte("first salt"), []byte("second"), {0, 1, 2, 3, 4, 5, 6, 7, 8}, []byte("x")}
+
+	a := NewBloomFilterRawSalts(CAPACITY, ERRPCT, Salts)
+	b := NewBloomFilterRawSalts(CAPACITY, ERRPCT, Salts)
+	Salts[0][0] = 'F' // the constructor keeps its own copy
+
+	for i := 0; i < 1000; i++ {
+		a.Insert([]byte(fmt.Sprintf("a-%d", i)))
+		b.Insert([]byte(fmt.Sprintf("b-%d", i)))
+	}
+
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("Merge of filters with the same raw salts: %v", err)
+	}
+
+	data, _ := a.MarshalBinary()
+	var c bloomFilter2
+	if err := c.UnmarshalBinary(data); err != nil || !a.Equal(&c) || string(c.Salts[0]) != "first salt" {
+		t.Fatalf("binary round trip of raw salts: %v", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !c.Exists([]byte(fmt.Sprintf("a-%d", i))) || !c.Exists([]byte(fmt.Sprintf("b-%d", i))) {
+			t.Fatalf("element %d missing after merge and round trip", i)
+		}
+	}
+
+	if fpr := measureFPR(NewBloomFilterRawSalts(CAPACITY, ERRPCT, Salts), CAPACITY/2); fpr > ERRPCT {
+		t.Errorf("false positive rate %f with raw salts", fpr)
+	}
+
+	// four byte salts are the uint32 salts
+	raw := NewBloomFilterRawSalts(CAPACITY, ERRPCT, [][]byte{{0, 0, 0, 1}, {0, 0, 0, 2}})
+	if !raw.Equal(NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2})) {
+		t.Error("four byte raw salts differ from uint32 salts")
+	}
+}
+
+func TestRenderASCII(t *testing.T) {
+
+	b := NewBloomFilter2(10, ERRPCT, []uint32{1, 2, 3})
+	key := []byte("render")
+	b.Insert(key)
+
+	// 1024 bits fit one per character in 32 lines of 32
+	lines := strings.Split(strings.TrimSuffix(b.RenderASCII(32), "\n"), "\n")
+	if len(lines) != 32 {
+		t.Fatalf("got %d lines, want 32", len(lines))
+	}
+
+	set := map[uint64]bool{}
+	for _, x := range b.Indices(key) {
+		set[x] = true
+	}
+	for y, line := range lines {
+		if len(line) != 32 {
+			t.Fatalf("line %d is %d characters, want 32", y, len(line))
+		}
+		for x, c := range line {
+			if want := set[uint64(32*y+x)]; (c == '#') != want || (c != '#' && c != '.') {
+				t.Errorf("bit %d drawn %q, set=%v", 32*y+x, c, want)
+			}
+		}
+	}
+
+	// narrower output covers 4 bits per character
+	lines = strings.Split(strings.TrimSuffix(b.RenderASCII(16), "\n"), "\n")
+	if len(lines) != 16 || len(lines[0]) != 16 {
+		t.Fatalf("width 16: got %d lines of %d, want 16 of 16", len(lines), len(lines[0]))
+	}
+	for x := range set {
+		if c := lines[x/4/16][x/4%16]; c != ':' && c != 'o' {
+			t.Errorf("cell of bit %d drawn %q, want partly set", x, c)
+		}
+	}
+
+	for i := range b.(*bloomFilter2).Filter {
+		b.(*bloomFilter2).Filter[i] = ^uint32(0)
+	}
+	if strings.Trim(b.RenderASCII(16), "#\n") != "" {
+		t.Error("full filter not drawn all set")
+	}
+}
+
+func TestMergeFiles(t *testing.T) {
+
+	dir := t.TempDir()
+	Salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+
+	var inputs []string
+	for f := 0; f < 3; f++ {
+		b := NewBloomFilter2(CAPACITY, ERRPCT, Salts)
+		for i := 0; i < 1000; i++ {
+			b.Insert([]byte(fmt.Sprintf("file%d-%d", f, i)))
+		}
+
+		name := filepath.Join(dir, fmt.Sprintf("in%d", f))
+		if f == 2 {
+			// inputs may also be in the binary format
+			data, _ := b.MarshalBinary()
+			os.WriteFile(name, data, 0644)
+		} else if err := b.Serialization(name); err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, name)
+	}
+
+	out := filepath.Join(dir, "out")
+	if err := MergeFiles(out, inputs...); err != nil {
+		t.Fatalf("MergeFiles failed: %v", err)
+	}
+
+	u, err := UnSerialization(out)
+	if err != nil {
+		t.Fatalf("reading merged file: %v", err)
+	}
+	for f := 0; f < 3; f++ {
+		for i := 0; i < 1000; i++ {
+			if !u.Exists([]byte(fmt.Sprintf("file%d-%d", f, i))) {
+				t.Fatalf("merged filter lost file%d-%d", f, i)
+			}
+		}
+	}
+
+	// a single input is copied
+	if err := MergeFiles(filepath.Join(dir, "copy"), inputs[0]); err != nil {
+		t.Errorf("MergeFiles of one input: %v", err)
+	}
+	b0, _ := UnSerialization(inputs[0])
+	if c, err := UnSerialization(filepath.Join(dir, "copy")); err != nil || !c.Equal(b0) {
+		t.Errorf("single input was not copied: %v", err)
+	}
+
+	if err := MergeFiles(filepath.Join(dir, "none")); err == nil {
+		t.Error("MergeFiles accepted no inputs")
+	}
+
+	// an incompatible input fails without touching the output
+	other := filepath.Join(dir, "other")
+	NewBloomFilter2(CAPACITY, ERRPCT, []uint32{9}).Serialization(other)
+	before, _ := os.ReadFile(out)
+	if err := MergeFiles(out, inputs[0], other); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("merging an incompatible file: got %v, want ErrIncompatible", err)
+	}
+	if after, _ := os.ReadFile(out); !bytes.Equal(before, after) {
+		t.Error("failed MergeFiles changed the output")
+	}
+
+	// the output may be an input
+	if err := MergeFiles(inputs[0], inputs[0], inputs[1]); err != nil {
+		t.Errorf("merging into an input: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 6 {
+		t.Errorf("%d files in the directory, want 6 with no temporaries left", len(entries))
+	}
+}
+
+func TestMergeGzipFiles(t *testing.T) {
+
+	dir := t.TempDir()
+	Salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+
+	var inputs []string
+	want := NewBloomFilter2(CAPACITY, ERRPCT, Salts)
+	for f := 0; f < 3; f++ {
+		b := NewBloomFilter2(CAPACITY, ERRPCT, Salts)
+		for i := 0; i < 1000; i++ {
+			b.Insert([]byte(fmt.Sprintf("file%d-%d", f, i)))
+		}
+		want.Merge(b)
+
+		name := filepath.Join(dir, fmt.Sprintf("in%d", f))
+		if f == 2 {
+			// an uncompressed input among the compressed ones
+			data, _ := b.MarshalBinary()
+			os.WriteFile(name, data, 0644)
+		} else {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			b.WriteTo(zw)
+			zw.Close()
+			os.WriteFile(name, buf.Bytes(), 0644)
+		}
+		inputs = append(inputs, name)
+	}
+
+	out := filepath.Join(dir, "out.gz")
+	if err := MergeGzipFiles(out, inputs...); err != nil {
+		t.Fatalf("MergeGzipFiles failed: %v", err)
+	}
+
+	fp, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	zr, err := gzip.NewReader(fp)
+	if err != nil {
+		t.Fatalf("output is not gzip compressed: %v", err)
+	}
+	u, err := ReadFrom(zr)
+	if err != nil {
+		t.Fatalf("reading merged file: %v", err)
+	}
+	if !u.Equal(want) {
+		t.Error("merged filter differs from the union of the inputs")
+	}
+
+	// UnSerialization reads compressed files too
+	if v, err := UnSerialization(out); err != nil || !v.Equal(want) {
+		t.Errorf("UnSerialization of a gzip file: %v", err)
+	}
+
+	if err := MergeGzipFiles(filepath.Join(dir, "none")); err == nil {
+		t.Error("MergeGzipFiles accepted no inputs")
+	}
+}
+
+func TestFilesEquivalent(t *testing.T) {
+
+	dir := t.TempDir()
+	Salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+
+	write := func(name string, keys int, extra string, binary bool) string {
+		b := NewBloomFilter2(CAPACITY, ERRPCT, Salts)
+		for i := 0; i < keys; i++ {
+			b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+		}
+		if extra != "" {
+			b.Insert([]byte(extra))
+		}
+
+		file := filepath.Join(dir, name)
+		if binary {
+			data, _ := b.MarshalBinary()
+			os.WriteFile(file, data, 0644)
+		} else if err := b.Serialization(file); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	reference := write("reference", 1000, "", false)
+	regenerated := write("regenerated", 1000, "", true)
+	duplicated := write("duplicated", 1000, "key-3", false)
+	different := write("different", 1000, "one more key", false)
+
+	for _, tc := range []struct {
+		name string
+		file string
+		want bool
+	}{
+		{"regenerated in the binary format", regenerated, true},
+		{"with a duplicate insert", duplicated, true},
+		{"with one more key", different, false},
+	} {
+		if eq, err := FilesEquivalent(reference, tc.file); err != nil || eq != tc.want {
+			t.Errorf("%s: FilesEquivalent = %v, %v, want %v", tc.name, eq, err, tc.want)
+		}
+	}
+
+	other := filepath.Join(dir, "other")
+	NewBloomFilter2(CAPACITY, ERRPCT, []uint32{9}).Serialization(other)
+	if _, err := FilesEquivalent(reference, other); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("incompatible files: got %v, want ErrIncompatible", err)
+	}
+	if _, err := FilesEquivalent(reference, filepath.Join(dir, "missing")); err == nil {
+		t.Error("a missing file was equivalent")
+	}
+}
+
+func TestGenerations(t *testing.T) {
+
+	Salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+	var gens []BloomFilter2 // newest first
+
+	// each generation holds 100 keys; full ones are pushed down and a new one started
+	fp := 0
+	for i := 0; i < 350; i++ {
+		if len(gens) == 0 || gens[0].Len() == 100 {
+			gens = append([]BloomFilter2{NewBloomFilter2(100, ERRPCT, Salts)}, gens...)
+		}
+		key := []byte(fmt.Sprintf("gen-%d", i))
+		if ExistsAny(key, gens...) {
+			fp++
+		}
+		InsertIntoNewest(key, gens...)
+	}
+
+	if fp > 10 {
+		t.Errorf("%d of 350 new keys found before they were inserted", fp)
+	}
+
+	if len(gens) != 4 || gens[0].Len() != 50 {
+		t.Fatalf("%d generations, newest holding %d; want 4 and 50", len(gens), gens[0].Len())
+	}
+
+	for i := 0; i < 350; i++ {
+		key := []byte(fmt.Sprintf("gen-%d", i))
+		if !ExistsAny(key, gens...) {
+			t.Fatalf("%s missing", key)
+		}
+		// inserts went into the generation that was newest at the time
+		if g := len(gens) - 1 - i/100; !gens[g].Exists(key) {
+			t.Errorf("%s not in generation %d", key, g)
+		}
+	}
+
+	// dropping the oldest generation forgets its keys
+	if ExistsAny([]byte("gen-0"), gens[:3]...) && ExistsAny([]byte("gen-1"), gens[:3]...) {
+		t.Error("keys of the dropped generation still found")
+	}
+
+	if ExistsAny([]byte("x")) || InsertIntoNewest([]byte("x")) {
+		t.Error("empty generation set reported true")
+	}
+}
+
+func TestExistsPrescreen(t *testing.T) {
+
+	Salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+	keyed, _ := NewKeyedBloomFilter(CAPACITY, ERRPCT, []byte("0123456789abcdef"))
+
+	for name, b := range map[string]BloomFilter2{
+		"plain": NewBloomFilter2(CAPACITY, ERRPCT, Salts),
+		"keyed": keyed,
+		"wide":  NewWideBloomFilter(CAPACITY, ERRPCT, Salts),
+	} {
+		for i := 0; i < CAPACITY; i++ {
+			b.Insert([]byte(fmt.Sprintf("member-%d", i)))
+		}
+
+		for i := 0; i < CAPACITY; i++ {
+			if !b.ExistsPrescreen([]byte(fmt.Sprintf("member-%d", i)), 2) {
+				t.Fatalf("%s: prescreen rejected member-%d", name, i)
+			}
+		}
+
+		negatives, prev := 0, 0
+		for j := 0; j <= 8; j++ {
+			passed := 0
+			for i := 0; i < 20000; i++ {
+				key := []byte(fmt.Sprintf("other-%d", i))
+				pre := b.ExistsPrescreen(key, j)
+				if !pre && b.Exists(key) {
+					t.Fatalf("%s: prescreen of %d salts rejected %q, which Exists accepts", name, j, key)
+				}
+				if pre {
+					passed++
+				} else {
+					negatives++
+				}
+			}
+			// more salts reject more
+			if j > 0 && passed > prev {
+				t.Errorf("%s: %d salts passed %d keys, more than %d with fewer", name, j, passed, prev)
+			}
+			prev = passed
+		}
+
+		if negatives == 0 {
+			t.Errorf("%s: prescreen never rejected anything", name)
+		}
+	}
+}
+
+func TestExistsLimited(t *testing.T) {
+
+	b := NewTestBloomFilter(CAPACITY, ERRPCT)
+	for i := 0; i < CAPACITY; i++ {
+		b.Insert([]byte(fmt.Sprintf("member-%d", i)))
+	}
+
+	k := len(b.(*bloomFilter2).Salts)
+	prev := 0
+	for j := k; j >= 1; j-- {
+		for i := 0; i < CAPACITY; i++ {
+			if !b.ExistsLimited([]byte(fmt.Sprintf("member-%d", i)), j) {
+				t.Fatalf("%d salts rejected member-%d", j, i)
+			}
+		}
+
+		fp := 0
+		for i := 0; i < 20000; i++ {
+			if b.ExistsLimited([]byte(fmt.Sprintf("other-%d", i)), j) {
+				fp++
+			}
+		}
+		t.Logf("%d of %d salts: %d false positives in 20000", j, k, fp)
+		if fp < prev {
+			t.Errorf("%d salts gave %d false positives, fewer than %d with more salts", j, fp, prev)
+		}
+		prev = fp
+	}
+
+	// a lookup computes at most maxSalts indices
+	calls := 0
+	counted := NewBloomFilterWithIndex(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7}, func(data []byte, saltIndex int, bits uint64) uint64 {
+		calls++
+		return uint64(fnv32(uint32ToByteArray2(uint32(saltIndex)), data))
+	})
+	counted.Insert([]byte("member"))
+	for _, tc := range []struct{ j, want int }{{0, 0}, {1, 1}, {3, 3}, {7, 7}, {20, 7}} {
+		j, want := tc.j, tc.want
+		calls = 0
+		if !counted.ExistsLimited([]byte("member"), j) {
+			t.Errorf("%d salts rejected a member", j)
+		}
+		if calls != want {
+			t.Errorf("ExistsLimited with %d salts computed %d indices, want %d", j, calls, want)
+		}
+	}
+}
+
+func TestExistsDebug(t *testing.T) {
+
+	keyed, _ := NewKeyedBloomFilter(CAPACITY, ERRPCT, []byte("0123456789abcdef"))
+
+	for name, b := range map[string]BloomFilter2{
+		"plain": NewTestBloomFilter(CAPACITY, ERRPCT),
+		"keyed": keyed,
+		"wide":  NewWideBloomFilter(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7}),
+	} {
+		for i := 0; i < CAPACITY/2; i++ {
+			b.Insert([]byte(fmt.Sprintf("member-%d", i)))
+		}
+
+		if present, salt := b.ExistsDebug([]byte("member-7")); !present || salt != -1 {
+			t.Errorf("%s: ExistsDebug(member-7) = %v, %d", name, present, salt)
+		}
+
+		rejects := make(map[int]int)
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("other-%d", i))
+			present, salt := b.ExistsDebug(key)
+			if present != b.Exists(key) {
+				t.Fatalf("%s: ExistsDebug(%q) = %v, Exists disagrees", name, key, present)
+			}
+			if present {
+				continue
+			}
+
+			// the bits of all earlier salts are set, and that of the reported salt is not
+			filter := b.(*bloomFilter2).Filter
+			for j, x := range b.Indices(key)[:salt+1] {
+				if bit := filter.get(x) != 0; bit != (j < salt) {
+					t.Fatalf("%s: %q first fails at salt %d, but bit %d of salt %d is %v", name, key, salt, x, j, bit)
+				}
+			}
+			rejects[salt]++
+		}
+
+		if rejects[0] == 0 {
+			t.Errorf("%s: no key was rejected by the first salt: %v", name, rejects)
+		}
+	}
+}
+
+func TestSizeForQueryBudget(t *testing.T) {
+
+	for _, tc := range []struct {
+		n       uint32
+		queries uint64
+		budget  float64
+	}{
+		{CAPACITY, 1e6, 100},
+		{CAPACITY, 1e9, 1},
+		{1000, 1e4, 0.5},
+		{1 << 20, 1e12, 1000},
+		{CAPACITY, 10, 100},
+	} {
+		bits, k := SizeForQueryBudget(tc.n, tc.queries, tc.budget)
+		if bits&(bits-1) != 0 || k < 1 {
+			t.Errorf("%+v: bits=%d k=%d", tc, bits, k)
+			continue
+		}
+
+		if expected := expectedFPR(bits, tc.n, k) * float64(tc.queries); expected > tc.budget {
+			t.Errorf("%+v: %f expected false positives, over budget", tc, expected)
+		}
+
+		// half the size would not do
+		if bits > 1024 && expectedFPR(bits/2, tc.n, optimalSalts(bits/2, tc.n))*float64(tc.queries) <= tc.budget {
+			t.Errorf("%+v: %d bits is larger than needed", tc, bits)
+		}
+	}
+
+	if bits, k := SizeForQueryBudget(CAPACITY, 1e6, 0); bits != 0 || k != 0 {
+		t.Errorf("zero budget gave %d bits and %d salts", bits, k)
+	}
+}
+
+func TestStrategy(t *testing.T) {
+
+	for _, strategy := range []Strategy{StrategyPerSalt, StrategyDoubleHash} {
+		b, err := NewBloomFilterWithStrategy(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7}, strategy)
+		if err != nil {
+			t.Fatalf("%v: %v", strategy, err)
+		}
+		if b.Strategy() != strategy {
+			t.Errorf("filter built with %v reports %v", strategy, b.Strategy())
+		}
+
+		for i := 0; i < 1000; i++ {
+			b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+		}
+		for i := 0; i < 1000; i++ {
+			if !b.Exists([]byte(fmt.Sprintf("key-%d", i))) {
+				t.Fatalf("%v: key-%d missing", strategy, i)
+			}
+		}
+
+		data, _ := b.MarshalBinary()
+		var c bloomFilter2
+		if err := c.UnmarshalBinary(data); err != nil || c.Strategy() != strategy || !c.Exists([]byte("key-0")) {
+			t.Errorf("%v: binary round trip gave %v (%v)", strategy, c.Strategy(), err)
+		}
+
+		var buf bytes.Buffer
+		b.WriteTo(&buf)
+		if g, err := ReadFrom(&buf); err != nil || g.Strategy() != strategy || !g.Exists([]byte("key-0")) {
+			t.Errorf("%v: gob round trip lost the strategy (%v)", strategy, err)
+		}
+	}
+
+	if _, err := NewBloomFilterWithStrategy(CAPACITY, ERRPCT, []uint32{1}, Strategy(7)); err == nil {
+		t.Error("unknown strategy accepted")
+	}
+	if s := Strategy(7).String(); s != "Strategy(7)" {
+		t.Errorf("String of an unknown strategy = %q", s)
+	}
+}
+
+func TestByteOrder(t *testing.T) {
+
+	salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+	big, _ := NewBloomFilterWithByteOrder(CAPACITY, ERRPCT, salts, binary.BigEndian)
+	little, err := NewBloomFilterWithByteOrder(CAPACITY, ERRPCT, salts, binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !big.Equal(NewBloomFilter2(CAPACITY, ERRPCT, salts)) {
+		t.Error("big-endian filter differs from NewBloomFilter2")
+	}
+
+	for i := 0; i < 1000; i++ {
+		big.Insert([]byte(fmt.Sprintf("key-%d", i)))
+		little.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	for i := 0; i < 1000; i++ {
+		if !little.Exists([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("key-%d missing from little-endian filter", i)
+		}
+	}
+	if fmt.Sprint(big.SetBits()) == fmt.Sprint(little.SetBits()) {
+		t.Error("both byte orders set the same bits")
+	}
+	if err := big.Merge(little); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("merging byte orders: got %v, want ErrIncompatible", err)
+	}
+
+	data, _ := little.MarshalBinary()
+	var c bloomFilter2
+	if err := c.UnmarshalBinary(data); err != nil || c.SaltByteOrder() != binary.LittleEndian || !c.Equal(little) {
+		t.Errorf("binary round trip gave %v (%v)", c.SaltByteOrder(), err)
+	}
+
+	var buf bytes.Buffer
+	little.WriteTo(&buf)
+	g, err := ReadFrom(&buf)
+	if err != nil || g.SaltByteOrder() != binary.LittleEndian || !g.Equal(little) {
+		t.Errorf("gob round trip gave %v (%v)", g.SaltByteOrder(), err)
+	}
+
+	// salts added after loading follow the recorded order
+	g.Clear()
+	if err := g.AppendSalt(0x01020304); err != nil {
+		t.Fatal(err)
+	}
+	if s := g.(*bloomFilter2).Salts[len(salts)]; !bytes.Equal(s, []byte{4, 3, 2, 1}) {
+		t.Errorf("appended salt encoded as %x", s)
+	}
+
+	if _, err := NewBloomFilterWithByteOrder(CAPACITY, ERRPCT, salts, nil); err == nil {
+		t.Error("nil byte order accepted")
+	}
+}
+
+func TestBloomFilterWithIndex(t *testing.T) {
+
+	calls := 0
+	first := func(data []byte, saltIndex int, bits uint64) uint64 {
+		calls++
+		return uint64(data[0]) + 100*uint64(saltIndex)
+	}
+
+	b := NewBloomFilterWithIndex(CAPACITY, ERRPCT, []uint32{1, 2, 3}, first)
+	b.Insert([]byte("apple"))
+	if calls != 3 {
+		t.Errorf("Insert called the index function %d times, want 3", calls)
+	}
+	if set := b.SetBits(); fmt.Sprint(set) != "[97 197 297]" {
+		t.Errorf("Insert set bits %v, want [97 197 297]", set)
+	}
+
+	// only the first byte matters to this index function
+	if !b.Exists([]byte("apple")) || !b.Exists([]byte("avocado")) || b.Exists([]byte("banana")) {
+		t.Error("Exists does not use the index function")
+	}
+	if !b.ExistsUint64(0x61<<56) || !b.ExistsPrescreen([]byte("a"), 1) {
+		t.Error("ExistsUint64 and ExistsPrescreen do not use the index function")
+	}
+	if !NewQueryContext().Exists(b, []byte("a")) {
+		t.Error("QueryContext does not use the index function")
+	}
+
+	if err := b.Merge(NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3})); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("merging with a default filter: got %v, want ErrIncompatible", err)
+	}
+
+	if d := NewBloomFilterWithIndex(CAPACITY, ERRPCT, []uint32{1, 2, 3}, nil); !d.Equal(NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3})) {
+		t.Error("a nil index function differs from NewBloomFilter2")
+	}
+}
+
+func TestPartitionedBloomFilter(t *testing.T) {
+
+	salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+	items := make([][]byte, 1000)
+	for i := range items {
+		items[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	p := NewPartitionedBloomFilter(CAPACITY, ERRPCT, salts)
+	for _, b := range items {
+		p.Insert(b)
+	}
+
+	bf := p.(*bloomFilter2)
+	part := bf.Bits / uint64(len(salts))
+	for _, b := range items {
+		for i, x := range p.Indices(b) {
+			if x/part != uint64(i) {
+				t.Fatalf("salt %d of %q set bit %d outside its partition", i, b, x)
+			}
+		}
+		if !p.Exists(b) {
+			t.Fatalf("%q missing from partitioned filter", b)
+		}
+	}
+	p.InsertUint64(42)
+	if !p.Exists(binary.BigEndian.AppendUint64(nil, 42)) {
+		t.Error("InsertUint64 does not use the partitioned layout")
+	}
+
+	// the layout survives both serializations, so loads take the partitioned path
+	data, _ := p.MarshalBinary()
+	var c bloomFilter2
+	if err := c.UnmarshalBinary(data); err != nil || !c.Partitioned || !c.Equal(p) {
+		t.Errorf("binary round trip lost the layout (%v)", err)
+	}
+	var buf bytes.Buffer
+	p.WriteTo(&buf)
+	g, err := ReadFrom(&buf)
+	if err != nil || !g.(*bloomFilter2).Partitioned {
+		t.Fatalf("gob round trip lost the layout (%v)", err)
+	}
+	for _, b := range items {
+		if !c.Exists(b) || !g.Exists(b) {
+			t.Fatalf("%q missing after loading", b)
+		}
+	}
+
+	standard := NewBloomFilter2(CAPACITY, ERRPCT, salts)
+	if err := standard.Merge(p); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("merging layouts: got %v, want ErrIncompatible", err)
+	}
+
+	// converting rebuilds from the items
+	p = NewPartitionedBloomFilter(CAPACITY, ERRPCT, salts)
+	for _, b := range items {
+		p.Insert(b)
+	}
+	s := p.ToStandard(items)
+	for _, b := range items {
+		standard.Insert(b)
+	}
+	if !s.Equal(standard) {
+		t.Error("ToStandard differs from a standard filter of the same items")
+	}
+	if back := s.ToPartitioned(items); !back.Equal(p) {
+		t.Error("ToPartitioned differs from the original partitioned filter")
+	}
+}
+
+func TestCompressPartitioned(t *testing.T) {
+
+	b := NewPartitionedBloomFilter(2000, 0.01, []uint32{11, 22, 33})
+	for i := 0; i < 2000; i++ {
+		b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	if err := b.Compress(); err == nil {
+		t.Error("Compress of a partitioned filter succeeded")
+	}
+	if err := b.CompressBy(2); err == nil {
+		t.Error("CompressBy of a partitioned filter succeeded")
+	}
+	if n := b.MaxCompressions(1); n != 0 {
+		t.Errorf("MaxCompressions of a partitioned filter = %d", n)
+	}
+	if _, err := b.CompressVsRebuildAdvice(b.(*bloomFilter2).Bits / 2); err == nil {
+		t.Error("CompressVsRebuildAdvice advised compressing a partitioned filter")
+	}
+
+	// the refused compressions left every member in place
+	for i := 0; i < 2000; i++ {
+		if !b.Exists([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("key-%d lost", i)
+		}
+	}
+}
+
+func TestStrictBloomFilter(t *testing.T) {
+
+	Salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+
+	if _, err := NewStrictBloomFilter(CAPACITY, ERRPCT, []uint32{1, 2, 1}); !errors.Is(err, ErrDuplicateSalts) {
+		t.Errorf("duplicate salts: got %v, want ErrDuplicateSalts", err)
+	}
+
+	// sequential salts never collide on a power-of-two filter, since FNV is a bijection modulo 2^n;
+	// with mixing, 1024 bits and 7 salts a few percent of keys do
+	plain := NewMixedBloomFilter2(10, ERRPCT, Salts)
+	strict, err := NewStrictBloomFilter(10, ERRPCT, Salts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict.(*bloomFilter2).Mix = true
+
+	var colliding []byte
+	for i := 0; i < 10000 && colliding == nil; i++ {
+		if key := []byte(fmt.Sprintf("key-%d", i)); plain.SaltsCollide(key) {
+			colliding = key
+		}
+	}
+	if colliding == nil {
+		t.Fatal("no colliding key among 10000 candidates")
+	}
+
+	distinct := func(idx []uint64) int {
+		seen := map[uint64]bool{}
+		for _, x := range idx {
+			seen[x] = true
+		}
+		return len(seen)
+	}
+
+	if n := distinct(plain.Indices(colliding)); n >= len(Salts) {
+		t.Errorf("colliding key has %d distinct indices in a plain filter", n)
+	}
+	if n := distinct(strict.Indices(colliding)); n != len(Salts) {
+		t.Errorf("colliding key has %d distinct indices in a strict filter, want %d", n, len(Salts))
+	}
+
+	strict.Insert(colliding)
+	if !strict.Exists(colliding) || strict.PopCount() != uint64(len(Salts)) {
+		t.Errorf("strict insert of a colliding key set %d bits, want %d", strict.PopCount(), len(Salts))
+	}
+
+	// strictness survives serialization and blocks merging with plain filters
+	data, _ := strict.MarshalBinary()
+	var c bloomFilter2
+	if err := c.UnmarshalBinary(data); err != nil || !c.Strict || !c.Exists(colliding) {
+		t.Errorf("binary round trip lost strictness: %v", err)
+	}
+	if err := strict.Merge(plain); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("merging strict and plain filters: got %v, want ErrIncompatible", err)
+	}
+
+	if wide := NewWideBloomFilter(10, ERRPCT, Salts); wide.SaltsCollide(colliding) {
+		t.Error("wide filter reports a salt collision")
+	}
+}
+
+func TestCompressStrict(t *testing.T) {
+
+	Salts := []uint32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	b, err := NewStrictBloomFilter(100, 0.01, Salts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Insert([]byte("key"))
+
+	if err := b.CompressBy(4); err == nil {
+		t.Error("CompressBy of a strict filter succeeded")
+	}
+	if n := b.MaxCompressions(1); n != 0 {
+		t.Errorf("MaxCompressions of a strict filter = %d", n)
+	}
+	if !b.Exists([]byte("key")) {
+		t.Error("key lost by a refused compression")
+	}
+
+	// a Filter with the same salts that does not move collisions compresses without loss
+	plain := NewBloomFilter2(100, 0.01, Salts)
+	plain.Insert([]byte("key"))
+	if err := plain.CompressBy(4); err != nil || !plain.Exists([]byte("key")) {
+		t.Errorf("compressing the plain filter: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package dgobloom
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+)
+
+// maxRenderSide bounds the width and height of RenderPNG images
+const maxRenderSide = 1024
+
+// RenderPNG draws the bit vector as a square grayscale PNG image, one pixel per bit in row order with set bits black.
+// Filters too large for a 1024 by 1024 image have each pixel stand for a run of consecutive bits, shaded by the fraction set.
+func (bf *bloomFilter2) RenderPNG(w io.Writer) error {
+
+	side := uint64(math.Ceil(math.Sqrt(float64(bf.Bits))))
+	if side > maxRenderSide {
+		side = maxRenderSide
+	}
+	if side < 1 {
+		side = 1
+	}
+
+	span := (bf.Bits + side*side - 1) / (side * side)
+	if span < 1 {
+		span = 1
+	}
+
+	img := image.NewGray(image.Rect(0, 0, int(side), int(side)))
+	for y := uint64(0); y < side; y++ {
+		for x := uint64(0); x < side; x++ {
+			start := (y*side + x) * span
+			if start >= bf.Bits {
+				// unused pixels past the end of the bit vector
+				img.SetGray(int(x), int(y), color.Gray{Y: 128})
+				continue
+			}
+			size := span
+			if start+size > bf.Bits {
+				size = bf.Bits - start
+			}
+			img.SetGray(int(x), int(y), color.Gray{Y: uint8(255 - 255*bf.setInRange(start, span)/size)})
+		}
+	}
+
+	return png.Encode(w, img)
+}
@@ -0,0 +1,48 @@
+package dgobloom
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+)
+
+func TestRenderPNG(t *testing.T) {
+
+	b := NewBloomFilter2(10, ERRPCT, []uint32{1, 2, 3})
+	key := []byte("render")
+	b.Insert(key)
+
+	var buf bytes.Buffer
+	if err := b.RenderPNG(&buf); err != nil {
+		t.Fatalf("RenderPNG failed: %v", err)
+	}
+
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatalf("RenderPNG output is not a PNG: %v", err)
+	}
+
+	// 1024 bits make a 32 by 32 image
+	if r := img.Bounds(); r.Dx() != 32 || r.Dy() != 32 {
+		t.Fatalf("image is %dx%d, want 32x32", r.Dx(), r.Dy())
+	}
+
+	set := map[uint64]bool{}
+	for _, x := range b.Indices(key) {
+		set[x] = true
+	}
+	for i := uint64(0); i < 1024; i++ {
+		r, _, _, _ := img.At(int(i%32), int(i/32)).RGBA()
+		if black := r == 0; black != set[i] {
+			t.Errorf("pixel of bit %d black=%v, set=%v", i, black, set[i])
+		}
+	}
+
+	// large Filters are scaled down
+	big := NewBloomFilterMin(10, ERRPCT, []uint32{1}, 1<<22)
+	buf.Reset()
+	big.RenderPNG(&buf)
+	if cfg, err := png.DecodeConfig(&buf); err != nil || cfg.Width != maxRenderSide || cfg.Height != maxRenderSide {
+		t.Errorf("large filter image %dx%d (%v), want %d square", cfg.Width, cfg.Height, err, maxRenderSide)
+	}
+}
@@ -0,0 +1,109 @@
+package dgobloom
+
+import (
+	"hash"
+	"hash/fnv"
+)
+
+// QueryContext holds the hashers and scratch space used to insert into and query bloom Filters, so that hot loops can reuse them instead of allocating fresh ones on every call.
+// The Filters themselves keep no hashing state.  A QueryContext may be used with any number of Filters, but by only one goroutine at a time.
+type QueryContext struct {
+	fnv  hash.Hash32
+	sip  sipDigest
+	wide hash.Hash
+	sum  [16]byte
+}
+
+// NewQueryContext returns a new QueryContext.
+func NewQueryContext() *QueryContext {
+	return &QueryContext{fnv: fnv.New32(), wide: fnv.New128a()}
+}
+
+// Insert inserts the byte array b into bf, exactly as bf.Insert(b) does.
+func (ctx *QueryContext) Insert(bf BloomFilter2, b []byte) bool {
+
+	if bf2, ok := bf.(*bloomFilter2); ok {
+		return bf2.insert(ctx, b)
+	}
+
+	return bf.Insert(b)
+}
+
+// Exists checks bf for the byte array b, exactly as bf.Exists(b) does.
+func (ctx *QueryContext) Exists(bf BloomFilter2, b []byte) bool {
+
+	if bf2, ok := bf.(*bloomFilter2); ok {
+		return bf2.exists(ctx, b)
+	}
+
+	return bf.Exists(b)
+}
+
+// hash32 returns the per-salt hasher for bf, reusing the one in ctx unless ctx is nil
+func (ctx *QueryContext) hash32(bf *bloomFilter2) hash.Hash32 {
+
+	if ctx == nil {
+		return bf.newHash()
+	}
+
+	if bf.Keyed {
+		ctx.sip.k0, ctx.sip.k1 = bf.sipKey[0], bf.sipKey[1]
+		return &ctx.sip
+	}
+
+	return ctx.fnv
+}
+
+// hash128 returns a reset 128-bit hasher for wide Filters and a buffer for its sum, reusing those in ctx unless ctx is nil
+func (ctx *QueryContext) hash128() (hash.Hash, []byte) {
+
+	if ctx == nil {
+		return fnv.New128a(), make([]byte, 0, 16)
+	}
+
+	ctx.wide.Reset()
+	return ctx.wide, ctx.sum[:0]
+}
+
+// PrefixQuerier checks a bloom Filter for many elements that share a prefix, such as the completions of an autocomplete query.
+// Each salt's FNV state after the prefix is computed once, so every lookup hashes only its suffix.
+// Keyed, wide, strict, partitioned and custom-index Filters do not hash per salt with FNV; for them the prefix and suffix are joined and passed to Exists.
+// The PrefixQuerier reads the Filter on every call, so it sees later inserts, but it keeps the salts it was created with.
+type PrefixQuerier struct {
+	bf     *bloomFilter2
+	prefix []byte
+	states []uint32 // FNV state after salt and prefix, for each salt; nil when Exists is used
+}
+
+// PrefixQuerier returns a PrefixQuerier for elements starting with prefix.
+func (bf *bloomFilter2) PrefixQuerier(prefix []byte) *PrefixQuerier {
+
+	pq := &PrefixQuerier{bf: bf, prefix: append([]byte(nil), prefix...)}
+
+	if bf.Keyed || bf.Wide || bf.listsIndices() {
+		return pq
+	}
+
+	pq.states = make([]uint32, len(bf.Salts))
+	for i, s := range bf.Salts {
+		pq.states[i] = fnv32Add(fnv32Add(fnv32Offset, s), prefix)
+	}
+
+	return pq
+}
+
+// Exists checks the Filter for the prefix followed by suffix, as Exists of the whole element would.
+func (pq *PrefixQuerier) Exists(suffix []byte) bool {
+
+	if pq.states == nil {
+		return pq.bf.Exists(append(pq.prefix[:len(pq.prefix):len(pq.prefix)], suffix...))
+	}
+
+	for _, h := range pq.states {
+		if pq.bf.Filter.get(uint64(pq.bf.index(fnv32Add(h, suffix)))) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,188 @@
+package dgobloom
+
+import (
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"testing"
+)
+
+func TestQueryContext(t *testing.T) {
+
+	Salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+	keyed := func() BloomFilter2 {
+		b, _ := NewKeyedBloomFilter(CAPACITY, ERRPCT, []byte("0123456789abcdef"))
+		return b
+	}
+
+	for name, mk := range map[string]func() BloomFilter2{
+		"plain": func() BloomFilter2 { return NewBloomFilter2(CAPACITY, ERRPCT, Salts) },
+		"mixed": func() BloomFilter2 { return NewMixedBloomFilter2(CAPACITY, ERRPCT, Salts) },
+		"keyed": keyed,
+		"wide":  func() BloomFilter2 { return NewWideBloomFilter(CAPACITY, ERRPCT, Salts) },
+	} {
+		ctx := NewQueryContext()
+		plain, viaCtx := mk(), mk()
+
+		for i := 0; i < CAPACITY; i++ {
+			key := []byte(fmt.Sprintf("ctx-%d", i))
+			if plain.Insert(key) != ctx.Insert(viaCtx, key) {
+				t.Fatalf("%s: Insert results differ for %q", name, key)
+			}
+		}
+
+		if !plain.Equal(viaCtx) {
+			t.Errorf("%s: filters built with and without a context differ", name)
+		}
+
+		for i := 0; i < 2*CAPACITY; i++ {
+			key := []byte(fmt.Sprintf("ctx-%d", i))
+			if got, want := ctx.Exists(viaCtx, key), plain.Exists(key); got != want {
+				t.Fatalf("%s: Exists(%q)=%v, want %v", name, key, got, want)
+			}
+		}
+
+		key := []byte("ctx-0")
+		if n := testing.AllocsPerRun(100, func() { ctx.Insert(viaCtx, key); ctx.Exists(viaCtx, key) }); n != 0 {
+			t.Errorf("%s: %f allocations per Insert and Exists with a context", name, n)
+		}
+	}
+}
+
+func benchmarkInsertKeyed(b *testing.B, ctx *QueryContext) {
+
+	bf, _ := NewKeyedBloomFilter(CAPACITY, ERRPCT, []byte("0123456789abcdef"))
+	key := []byte("benchmark-key")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if ctx == nil {
+			bf.Insert(key)
+			bf.Exists(key)
+		} else {
+			ctx.Insert(bf, key)
+			ctx.Exists(bf, key)
+		}
+	}
+}
+
+func BenchmarkInsertExistsKeyed(b *testing.B) { benchmarkInsertKeyed(b, nil) }
+
+func BenchmarkInsertExistsKeyedContext(b *testing.B) { benchmarkInsertKeyed(b, NewQueryContext()) }
+
+// countingHash counts the elements hashed through it, one Reset each
+type countingHash struct {
+	hash.Hash
+	resets int
+}
+
+func (ch *countingHash) Reset() {
+	ch.resets++
+	ch.Hash.Reset()
+}
+
+func TestAnyPresent(t *testing.T) {
+
+	b := NewWideBloomFilter(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	b.Insert([]byte("needle"))
+
+	items := make([][]byte, 100000)
+	for i := range items {
+		items[i] = []byte(fmt.Sprintf("hay-%d", i))
+	}
+	items[500] = []byte("needle")
+
+	// a false positive among the hay before the needle would be found first
+	want := 500
+	for i, item := range items[:500] {
+		if b.Exists(item) {
+			want = i
+			break
+		}
+	}
+
+	if i, found := b.AnyPresent(items); !found || i != want {
+		t.Errorf("AnyPresent=%d, %v, want %d", i, found, want)
+	}
+
+	// the search stops at the match, one hash per item checked
+	counter := &countingHash{Hash: fnv.New128a()}
+	ctx := &QueryContext{fnv: fnv.New32(), wide: counter}
+	b.(*bloomFilter2).anyPresent(ctx, items)
+	if counter.resets != want+1 {
+		t.Errorf("AnyPresent hashed %d items, want %d", counter.resets, want+1)
+	}
+
+	if i, found := b.AnyPresent(items[501:1000]); found && !b.Exists(items[501+i]) {
+		t.Errorf("AnyPresent reported absent item %d", 501+i)
+	}
+	if i, found := b.AnyPresent(nil); found || i != -1 {
+		t.Errorf("AnyPresent of no items=%d, %v", i, found)
+	}
+}
+
+func TestQuery(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	for i := 0; i < 1000; i++ {
+		b.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	cached := NewCachedBloomFilter(b, 16)
+
+	for _, f := range []BloomFilter2{b, cached} {
+		for i := 0; i < 2000; i++ {
+			key := []byte(fmt.Sprintf("key-%d", i))
+			m := f.Query(key)
+			if (m == ProbablyYes) != f.Exists(key) || (m != ProbablyYes && m != DefinitelyNot) {
+				t.Fatalf("Query(%q)=%v, Exists=%v", key, m, f.Exists(key))
+			}
+			if i < 1000 && m != ProbablyYes {
+				t.Fatalf("Query(%q)=%v for an inserted key", key, m)
+			}
+		}
+	}
+
+	if DefinitelyNot.String() != "definitely not" || ProbablyYes.String() != "probably yes" || Membership(5).String() != "Membership(5)" {
+		t.Errorf("Membership strings %q, %q, %q", DefinitelyNot, ProbablyYes, Membership(5))
+	}
+}
+
+func TestPrefixQuerier(t *testing.T) {
+
+	Salts := []uint32{1, 2, 3, 4, 5, 6, 7}
+	keyed := func() BloomFilter2 {
+		b, _ := NewKeyedBloomFilter(CAPACITY, ERRPCT, []byte("0123456789abcdef"))
+		return b
+	}
+
+	for name, mk := range map[string]func() BloomFilter2{
+		"plain":       func() BloomFilter2 { return NewBloomFilter2(CAPACITY, ERRPCT, Salts) },
+		"mixed":       func() BloomFilter2 { return NewMixedBloomFilter2(CAPACITY, ERRPCT, Salts) },
+		"keyed":       keyed,
+		"wide":        func() BloomFilter2 { return NewWideBloomFilter(CAPACITY, ERRPCT, Salts) },
+		"partitioned": func() BloomFilter2 { return NewPartitionedBloomFilter(CAPACITY, ERRPCT, Salts) },
+	} {
+		b := mk()
+		for i := 0; i < 1000; i += 2 {
+			b.InsertString(fmt.Sprintf("user:%d", i))
+		}
+
+		pq := b.PrefixQuerier([]byte("user:"))
+		for i := 0; i < 1000; i++ {
+			suffix := fmt.Sprint(i)
+			if got, want := pq.Exists([]byte(suffix)), b.ExistsString("user:"+suffix); got != want {
+				t.Fatalf("%s: PrefixQuerier.Exists(%q)=%v, Exists of the full key %v", name, suffix, got, want)
+			}
+			if i%2 == 0 && !pq.Exists([]byte(suffix)) {
+				t.Fatalf("%s: user:%s missing", name, suffix)
+			}
+		}
+
+		// the querier sees inserts made after it was created
+		b.InsertString("user:late")
+		if !pq.Exists([]byte("late")) {
+			t.Errorf("%s: PrefixQuerier missed a later insert", name)
+		}
+	}
+}
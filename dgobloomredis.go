@@ -0,0 +1,302 @@
+package dgobloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+/*
+RedisBloom transfers a filter with BF.SCANDUMP and BF.LOADCHUNK as a header chunk followed by the raw bit arrays.
+The header is, with all integers little-endian and no padding:
+
+	size     uint64   elements in the whole chain
+	nfilters uint32   number of links in the chain
+	options  uint32   creation flags
+	growth   uint32   expansion factor of a scaling chain
+	links             for each link:
+		bytes   uint64   length of the bit array
+		bits    uint64   bits in the array, bytes*8
+		size    uint64   elements in this link
+		error   float64  false positive rate
+		bpe     float64  bits per entry, -ln(error)/ln(2)^2
+		hashes  uint32   number of bit positions per element
+		entries uint64   Capacity of this link
+		n2      uint8    log2 of the bit range when it is a power of two, otherwise 0
+
+An element maps to the bits (a + i*b) mod range for i < hashes, where a is MurmurHash64A of the element seeded with
+0xc6a4a7935bd1e995, b is MurmurHash64A seeded with a, and range is 1<<n2, or bits when n2 is 0.  Bit x is bit x%8 of byte x/8.
+*/
+
+// RedisBloom creation flags
+const (
+	redisOptNoRound = 1 << iota
+	redisOptEntsIsBits
+	redisOptForce64
+	redisOptNoScaling
+)
+
+// redisLn2Squared is ln(2)^2 as RedisBloom writes it; computing it here would change the bits per entry in the last place
+const redisLn2Squared = 0.480453013918201
+
+const redisHeaderSize = 20
+const redisLinkSize = 53
+
+// redisChunkSize is the largest bit array chunk returned by ScanDump, matching RedisBloom's limit for BF.SCANDUMP
+const redisChunkSize = 16 << 20
+
+// ErrRedisUnsupported is returned by LoadChunk for RedisBloom filters outside the fixed-size subset RedisBloomFilter covers.
+var ErrRedisUnsupported = errors.New("dgobloom: unsupported RedisBloom filter; only single-link filters with 64-bit hashing can be loaded")
+
+// RedisBloomFilter is a fixed-size bloom Filter that hashes and lays out its bits as a RedisBloom filter created with BF.RESERVE ... NONSCALING,
+// so it can be moved to and from a Redis server with BF.SCANDUMP and BF.LOADCHUNK.
+// RedisBloom hashes with MurmurHash64A instead of salted FNV, so a RedisBloomFilter cannot be merged or compared with the other Filters in this package.
+// Scaling chains of more than one link and filters from RedisBloom versions that used 32-bit hashes are not supported.
+type RedisBloomFilter struct {
+	capacity uint64
+	elements uint64
+	bits     uint64
+	hashes   uint32
+	n2       uint8
+	fpr      float64
+	bpe      float64
+	options  uint32
+	growth   uint32
+	bytes    uint64 // length of the bit array once loaded
+	filter   []byte
+}
+
+// NewRedisBloomFilter returns a new RedisBloom-compatible bloom Filter sized as BF.RESERVE key falsePositiveRate Capacity NONSCALING would size it.
+func NewRedisBloomFilter(Capacity uint64, falsePositiveRate float64) (*RedisBloomFilter, error) {
+
+	if Capacity < 1 || !(falsePositiveRate > 0 && falsePositiveRate < 1) {
+		return nil, fmt.Errorf("dgobloom: cannot size a RedisBloom filter for %d elements at rate %v", Capacity, falsePositiveRate)
+	}
+
+	rb := new(RedisBloomFilter)
+
+	rb.capacity = Capacity
+	rb.fpr = falsePositiveRate
+	rb.bpe = -math.Log(falsePositiveRate) / redisLn2Squared
+	rb.hashes = uint32(math.Ceil(math.Ln2 * rb.bpe))
+	rb.options = redisOptNoRound | redisOptForce64 | redisOptNoScaling
+	rb.growth = 2
+
+	// RedisBloom rounds the bit array up to whole 64-bit words
+	rb.bytes = (uint64(float64(Capacity)*rb.bpe) + 63) / 64 * 8
+	rb.bits = rb.bytes * 8
+	rb.filter = make([]byte, rb.bytes)
+
+	return rb, nil
+}
+
+// Len returns the number of Elements inserted.  As in RedisBloom, an insert that sets no new bits is not counted.
+func (rb *RedisBloomFilter) Len() uint64 { return rb.elements }
+
+// Cap returns the Capacity of the Filter.
+func (rb *RedisBloomFilter) Cap() uint64 { return rb.capacity }
+
+// loaded reports whether the whole bit array is present; a Filter being filled by LoadChunk is not yet usable
+func (rb *RedisBloomFilter) loaded() bool { return rb.bits > 0 && uint64(len(rb.filter)) == rb.bytes }
+
+// hash returns the double hashing pair RedisBloom derives from b
+func (rb *RedisBloomFilter) hash(b []byte) (uint64, uint64) {
+	a := murmur64a(b, 0xc6a4a7935bd1e995)
+	return a, murmur64a(b, a)
+}
+
+// index returns the i'th bit index for the hash pair a, b
+func (rb *RedisBloomFilter) index(a, b uint64, i uint32) uint64 {
+	if rb.n2 > 0 {
+		return (a + uint64(i)*b) % (1 << rb.n2)
+	}
+	return (a + uint64(i)*b) % rb.bits
+}
+
+// Insert inserts the byte array b into the Filter, as BF.ADD does.
+// If the function returns false, the Capacity of the Filter has been reached, or the Filter has not been completely loaded.
+func (rb *RedisBloomFilter) Insert(b []byte) bool {
+
+	if !rb.loaded() {
+		return false
+	}
+
+	a, h := rb.hash(b)
+
+	novel := false
+	for i := uint32(0); i < rb.hashes; i++ {
+		x := rb.index(a, h, i)
+		if mask := byte(1) << (x % 8); rb.filter[x/8]&mask == 0 {
+			rb.filter[x/8] |= mask
+			novel = true
+		}
+	}
+
+	if novel {
+		rb.elements++
+	}
+
+	return rb.elements < rb.capacity
+}
+
+// Exists checks the Filter for the byte array b, as BF.EXISTS does.  A Filter that has not been completely loaded holds nothing.
+func (rb *RedisBloomFilter) Exists(b []byte) bool {
+
+	if !rb.loaded() {
+		return false
+	}
+
+	a, h := rb.hash(b)
+
+	for i := uint32(0); i < rb.hashes; i++ {
+		x := rb.index(a, h, i)
+		if rb.filter[x/8]&(1<<(x%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ScanDump returns the chunk of the Filter at iter and the iterator for the next chunk, with the same protocol as BF.SCANDUMP:
+// iter 0 returns the header, every following call the next piece of the bit array, and an iterator of 0 with no data ends the dump.
+// Each pair can be passed to BF.LOADCHUNK to recreate the Filter in RedisBloom.
+func (rb *RedisBloomFilter) ScanDump(iter int64) (int64, []byte) {
+
+	if iter == 0 {
+		return 1, rb.header()
+	}
+
+	offset := uint64(iter - 1)
+	if iter < 1 || offset >= uint64(len(rb.filter)) {
+		return 0, nil
+	}
+
+	end := offset + redisChunkSize
+	if end > uint64(len(rb.filter)) {
+		end = uint64(len(rb.filter))
+	}
+
+	return iter + int64(end-offset), append([]byte(nil), rb.filter[offset:end]...)
+}
+
+// header encodes the RedisBloom header of the Filter, a chain of one link
+func (rb *RedisBloomFilter) header() []byte {
+
+	p := make([]byte, 0, redisHeaderSize+redisLinkSize)
+
+	p = binary.LittleEndian.AppendUint64(p, rb.elements)
+	p = binary.LittleEndian.AppendUint32(p, 1)
+	p = binary.LittleEndian.AppendUint32(p, rb.options)
+	p = binary.LittleEndian.AppendUint32(p, rb.growth)
+
+	p = binary.LittleEndian.AppendUint64(p, rb.bytes)
+	p = binary.LittleEndian.AppendUint64(p, rb.bits)
+	p = binary.LittleEndian.AppendUint64(p, rb.elements)
+	p = binary.LittleEndian.AppendUint64(p, math.Float64bits(rb.fpr))
+	p = binary.LittleEndian.AppendUint64(p, math.Float64bits(rb.bpe))
+	p = binary.LittleEndian.AppendUint32(p, rb.hashes)
+	p = binary.LittleEndian.AppendUint64(p, rb.capacity)
+	p = append(p, rb.n2)
+
+	return p
+}
+
+// LoadChunk loads one chunk produced by BF.SCANDUMP or ScanDump, replacing the contents of rb, with the same protocol as BF.LOADCHUNK.
+// The chunks must be loaded in the order they were dumped, starting with the header; the Filter is usable once the last one is loaded.
+// ErrRedisUnsupported is returned for filters that RedisBloomFilter cannot represent, and ErrBadFormat for malformed chunks.
+func (rb *RedisBloomFilter) LoadChunk(iter int64, data []byte) error {
+
+	if iter == 1 {
+		return rb.loadHeader(data)
+	}
+
+	// a data chunk is identified by the iterator following it
+	offset := iter - int64(len(data)) - 1
+	if rb.bits == 0 || offset != int64(len(rb.filter)) {
+		return fmt.Errorf("%w: RedisBloom chunk at %d is out of order", ErrBadFormat, offset)
+	}
+	if uint64(len(rb.filter))+uint64(len(data)) > rb.bytes {
+		return fmt.Errorf("%w: RedisBloom chunks are longer than the %d byte filter", ErrBadFormat, rb.bytes)
+	}
+
+	rb.filter = append(rb.filter, data...)
+
+	return nil
+}
+
+// loadHeader decodes a RedisBloom header chunk into rb, leaving the bit array empty until the data chunks arrive
+func (rb *RedisBloomFilter) loadHeader(p []byte) error {
+
+	if len(p) < redisHeaderSize {
+		return fmt.Errorf("%w: RedisBloom header is %d bytes", ErrBadFormat, len(p))
+	}
+
+	nfilters := binary.LittleEndian.Uint32(p[8:])
+	options := binary.LittleEndian.Uint32(p[12:])
+	if nfilters != 1 || options&redisOptForce64 == 0 {
+		return fmt.Errorf("%w: %d links, options %#x", ErrRedisUnsupported, nfilters, options)
+	}
+	if len(p) != redisHeaderSize+redisLinkSize {
+		return fmt.Errorf("%w: RedisBloom header is %d bytes, want %d", ErrBadFormat, len(p), redisHeaderSize+redisLinkSize)
+	}
+
+	link := p[redisHeaderSize:]
+	decoded := RedisBloomFilter{
+		elements: binary.LittleEndian.Uint64(link[16:]),
+		options:  options,
+		growth:   binary.LittleEndian.Uint32(p[16:]),
+		bytes:    binary.LittleEndian.Uint64(link[0:]),
+		bits:     binary.LittleEndian.Uint64(link[8:]),
+		fpr:      math.Float64frombits(binary.LittleEndian.Uint64(link[24:])),
+		bpe:      math.Float64frombits(binary.LittleEndian.Uint64(link[32:])),
+		hashes:   binary.LittleEndian.Uint32(link[40:]),
+		capacity: binary.LittleEndian.Uint64(link[44:]),
+		n2:       link[52],
+	}
+
+	if decoded.bits == 0 || decoded.bits/8 != decoded.bytes || decoded.bits%8 != 0 || decoded.n2 > 63 || (decoded.n2 > 0 && uint64(1)<<decoded.n2 > decoded.bits) {
+		return fmt.Errorf("%w: RedisBloom filter of %d bytes has %d bits and n2=%d", ErrBadFormat, decoded.bytes, decoded.bits, decoded.n2)
+	}
+	if decoded.hashes == 0 {
+		return fmt.Errorf("%w: RedisBloom filter has no hashes", ErrBadFormat)
+	}
+
+	*rb = decoded
+
+	return nil
+}
+
+// murmur64a returns MurmurHash64A of b with the given seed, reading the input as little-endian words as RedisBloom does on x86
+func murmur64a(b []byte, seed uint64) uint64 {
+	const (
+		m = 0xc6a4a7935bd1e995
+		r = 47
+	)
+
+	h := seed ^ (uint64(len(b)) * m)
+
+	for ; len(b) >= 8; b = b[8:] {
+		k := binary.LittleEndian.Uint64(b)
+		k *= m
+		k ^= k >> r
+		k *= m
+
+		h ^= k
+		h *= m
+	}
+
+	if len(b) > 0 {
+		for i := len(b) - 1; i >= 0; i-- {
+			h ^= uint64(b[i]) << (8 * i)
+		}
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+
+	return h
+}
@@ -0,0 +1,155 @@
+package dgobloom
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// The BF.SCANDUMP chunks of BF.RESERVE key 0.01 100 NONSCALING after adding key-0 through key-49,
+// generated with a C transcription of the sizing, hashing and dump code of RedisBloom's bloom.c and sb.c
+const (
+	redisDumpHeader = "3200000000000000010000000d000000020000007800000000000000c00300000000000032000000000000007b14ae47e17a843f88168ac58c2b234007000000640000000000000000"
+	redisDumpBits   = "3be0aa0378e12a8220c092001030581690c0214115a05c888120a709a88002080810681422f3000b2e3322c9201c82a04880000430042904856042822034040c000843ca86c1131015088203a0294c2532804400abc89eb00b43540ba10955e4da03867050b28ac69a644f0c03045d0918182131b31d7921"
+)
+
+func TestMurmur64a(t *testing.T) {
+
+	cases := []struct {
+		in   string
+		seed uint64
+		want uint64
+	}{
+		{"", 0, 0},
+		{"hello", 0xc6a4a7935bd1e995, 0x5ba5b8a59803e699},
+		{"hello world!", 0, 0x64db099bd1512951},
+	}
+
+	for _, c := range cases {
+		if got := murmur64a([]byte(c.in), c.seed); got != c.want {
+			t.Errorf("murmur64a(%q, %#x) = %#x, want %#x", c.in, c.seed, got, c.want)
+		}
+	}
+}
+
+func TestRedisBloomFilter(t *testing.T) {
+
+	header, _ := hex.DecodeString(redisDumpHeader)
+	bits, _ := hex.DecodeString(redisDumpBits)
+
+	// the dump loads and answers for the keys that were added
+	var loaded RedisBloomFilter
+	if err := loaded.LoadChunk(1, header); err != nil {
+		t.Fatalf("loading the header: %v", err)
+	}
+	if loaded.Exists([]byte("key-0")) {
+		t.Error("a partly loaded filter reports an element present")
+	}
+	if err := loaded.LoadChunk(int64(1+len(bits)), bits); err != nil {
+		t.Fatalf("loading the bits: %v", err)
+	}
+	if loaded.Len() != 50 || loaded.Cap() != 100 {
+		t.Errorf("loaded Len=%d Cap=%d, want 50 and 100", loaded.Len(), loaded.Cap())
+	}
+
+	fp := 0
+	for i := 0; i < 50; i++ {
+		if !loaded.Exists([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("key-%d missing from the loaded dump", i)
+		}
+		if loaded.Exists([]byte(fmt.Sprintf("absent-%d", i))) {
+			fp++
+		}
+	}
+	if fp > 3 {
+		t.Errorf("%d of 50 absent keys present", fp)
+	}
+
+	// a Filter built here dumps to the same bytes
+	rb, err := NewRedisBloomFilter(100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		rb.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	var chunks [][]byte
+	for iter, data := rb.ScanDump(0); iter != 0; iter, data = rb.ScanDump(iter) {
+		chunks = append(chunks, data)
+	}
+	if len(chunks) != 2 || !bytes.Equal(chunks[1], bits) {
+		t.Fatalf("bits differ from RedisBloom's: %x", chunks[1:])
+	}
+
+	// Go's math.Log and the C library may round differently in the last place, which shows in the bits per entry
+	const bpe = redisHeaderSize + 32
+	got, want := rb.bpe, loaded.bpe
+	if math.Abs(got-want) > 1e-12*want {
+		t.Errorf("bits per entry %v, RedisBloom has %v", got, want)
+	}
+	if !bytes.Equal(chunks[0][:bpe], header[:bpe]) || !bytes.Equal(chunks[0][bpe+8:], header[bpe+8:]) {
+		t.Errorf("header differs from RedisBloom's:\n%x\n%x", chunks[0], header)
+	}
+}
+
+func TestRedisBloomFilterLoadChunk(t *testing.T) {
+
+	rb, _ := NewRedisBloomFilter(10000, 0.001)
+	for i := 0; i < 1000; i++ {
+		rb.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	// round trip through the dump protocol
+	var c RedisBloomFilter
+	for iter, data := rb.ScanDump(0); iter != 0; iter, data = rb.ScanDump(iter) {
+		if err := c.LoadChunk(iter, data); err != nil {
+			t.Fatalf("LoadChunk(%d) failed: %v", iter, err)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if !c.Exists([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("key-%d lost in the round trip", i)
+		}
+	}
+	if c.Len() != rb.Len() {
+		t.Errorf("round trip Len=%d, want %d", c.Len(), rb.Len())
+	}
+
+	header, _ := hex.DecodeString(redisDumpHeader)
+
+	// a scaling chain of two links is out of scope
+	chain := append([]byte(nil), header...)
+	chain[8] = 2
+	if err := c.LoadChunk(1, chain); !errors.Is(err, ErrRedisUnsupported) {
+		t.Errorf("two links: got %v, want ErrRedisUnsupported", err)
+	}
+
+	// as are filters with 32-bit hashes
+	old := append([]byte(nil), header...)
+	old[12] &^= redisOptForce64
+	if err := c.LoadChunk(1, old); !errors.Is(err, ErrRedisUnsupported) {
+		t.Errorf("32-bit hashes: got %v, want ErrRedisUnsupported", err)
+	}
+
+	// a bit array longer than the header describes, or chunks out of order, are rejected
+	if err := c.LoadChunk(1, header); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LoadChunk(1+1000, make([]byte, 1000)); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("oversized chunk: got %v, want ErrBadFormat", err)
+	}
+	if err := c.LoadChunk(1+10+10, make([]byte, 10)); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("chunk out of order: got %v, want ErrBadFormat", err)
+	}
+	if err := c.LoadChunk(1, header[:30]); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("short header: got %v, want ErrBadFormat", err)
+	}
+
+	if _, err := NewRedisBloomFilter(0, 0.01); err == nil {
+		t.Error("NewRedisBloomFilter(0, 0.01) succeeded")
+	}
+}
@@ -0,0 +1,117 @@
+package dgobloom
+
+import (
+	"fmt"
+	"math"
+)
+
+// DefaultTighteningRatio and DefaultGrowthFactor are the stage parameters NewScalableBloomFilter uses when given zero.
+const (
+	DefaultTighteningRatio = 0.5
+	DefaultGrowthFactor    = 2
+)
+
+// ScalableBloomFilter is a bloom Filter that grows to hold any number of Elements, after Almeida et al., "Scalable Bloom Filters".
+// It is a chain of fixed-size stages: once the newest stage is at Capacity, a new one is added with its Capacity multiplied by the growth factor
+// and its false positive rate multiplied by the tightening ratio r.  The first stage is built for falsePositiveRate*(1-r), so the rates of all stages,
+// however many there are, add up to less than falsePositiveRate, which bounds the false positive rate of the chain.
+// A ratio closer to 1 uses fewer bits per element in later stages but spends more of the bound on the first; a larger growth factor adds fewer stages,
+// so queries check fewer Filters, at the cost of allocating more space ahead of need.
+type ScalableBloomFilter struct {
+	stages []BloomFilter2
+	fpr    float64 // false positive rate of the newest stage
+	ratio  float64
+	growth float64
+}
+
+// NewScalableBloomFilter returns a ScalableBloomFilter whose first stage holds Capacity Elements and whose false positive rate stays below falsePositiveRate.
+// ratio must be in (0, 1) and growth at least 1; zero selects DefaultTighteningRatio or DefaultGrowthFactor.
+func NewScalableBloomFilter(Capacity uint32, falsePositiveRate, ratio, growth float64) (*ScalableBloomFilter, error) {
+
+	if ratio == 0 {
+		ratio = DefaultTighteningRatio
+	}
+	if growth == 0 {
+		growth = DefaultGrowthFactor
+	}
+
+	if Capacity < 1 || !(falsePositiveRate > 0 && falsePositiveRate < 1) {
+		return nil, fmt.Errorf("dgobloom: cannot size a scalable filter for %d elements at rate %v", Capacity, falsePositiveRate)
+	}
+	if !(ratio > 0 && ratio < 1) || !(growth >= 1) || math.IsInf(growth, 1) {
+		return nil, fmt.Errorf("dgobloom: invalid scalable filter tightening ratio %v or growth factor %v", ratio, growth)
+	}
+
+	sbf := &ScalableBloomFilter{ratio: ratio, growth: growth}
+	sbf.addStage(Capacity, falsePositiveRate*(1-ratio))
+
+	return sbf, nil
+}
+
+// addStage appends an empty stage for Capacity Elements at falsePositiveRate
+func (sbf *ScalableBloomFilter) addStage(Capacity uint32, falsePositiveRate float64) {
+	Salts := ExtendSalts(nil, SaltsRequired2(Capacity, falsePositiveRate))
+	sbf.stages = append(sbf.stages, NewBloomFilter2(Capacity, falsePositiveRate, Salts))
+	sbf.fpr = falsePositiveRate
+}
+
+// Insert inserts the byte array b into the newest stage, adding a stage first if it is full.
+// An element that already tests present is not inserted again, so that duplicates do not grow the Filter; Insert then returns false.
+func (sbf *ScalableBloomFilter) Insert(b []byte) bool {
+
+	if sbf.Exists(b) {
+		return false
+	}
+
+	newest := sbf.stages[len(sbf.stages)-1]
+	if newest.Len() >= newest.Cap() {
+		next := math.Ceil(float64(newest.Cap()) * sbf.growth)
+		if next > math.MaxUint32 {
+			next = math.MaxUint32
+		}
+		sbf.addStage(uint32(next), sbf.fpr*sbf.ratio)
+		newest = sbf.stages[len(sbf.stages)-1]
+	}
+
+	newest.Insert(b)
+
+	return true
+}
+
+// Exists checks every stage of the Filter for the byte array b.
+func (sbf *ScalableBloomFilter) Exists(b []byte) bool {
+
+	for _, bf := range sbf.stages {
+		if bf.Exists(b) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Len returns the number of Elements inserted into all stages.
+func (sbf *ScalableBloomFilter) Len() uint64 {
+
+	n := uint64(0)
+	for _, bf := range sbf.stages {
+		n += uint64(bf.Len())
+	}
+
+	return n
+}
+
+// Stages returns the number of stages in the chain.
+func (sbf *ScalableBloomFilter) Stages() int { return len(sbf.stages) }
+
+// FalsePositiveBound returns the sum of the configured false positive rates of the stages so far, the bound on the false positive rate of the chain.
+// It stays below the falsePositiveRate the Filter was created with, however far it grows.
+func (sbf *ScalableBloomFilter) FalsePositiveBound() float64 {
+
+	p := 0.0
+	for _, bf := range sbf.stages {
+		p += bf.ConfiguredFPR()
+	}
+
+	return p
+}
@@ -0,0 +1,70 @@
+package dgobloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestScalableBloomFilter(t *testing.T) {
+
+	const (
+		initial = 1000
+		total   = 20 * initial
+		fpr     = 0.01
+	)
+
+	for _, tc := range []struct{ ratio, growth float64 }{
+		{0, 0},
+		{0.5, 1.5},
+		{0.8, 2},
+		{0.9, 4},
+	} {
+		sbf, err := NewScalableBloomFilter(initial, fpr, tc.ratio, tc.growth)
+		if err != nil {
+			t.Fatalf("ratio %v, growth %v: %v", tc.ratio, tc.growth, err)
+		}
+
+		for i := 0; i < total; i++ {
+			sbf.Insert([]byte(fmt.Sprintf("key-%d", i)))
+		}
+		// keys that were false positives when inserted are not counted
+		if sbf.Len() > total || sbf.Len() < total*(1-fpr) || sbf.Stages() < 2 {
+			t.Errorf("ratio %v, growth %v: %d elements in %d stages", tc.ratio, tc.growth, sbf.Len(), sbf.Stages())
+		}
+		for i := 0; i < total; i++ {
+			if !sbf.Exists([]byte(fmt.Sprintf("key-%d", i))) {
+				t.Fatalf("ratio %v, growth %v: key-%d missing", tc.ratio, tc.growth, i)
+			}
+		}
+
+		if b := sbf.FalsePositiveBound(); b >= fpr {
+			t.Errorf("ratio %v, growth %v: bound %v is not under %v", tc.ratio, tc.growth, b, fpr)
+		}
+
+		fp := 0
+		for i := 0; i < total; i++ {
+			if sbf.Exists([]byte(fmt.Sprintf("absent-%d", i))) {
+				fp++
+			}
+		}
+		// allow for sampling noise over the expected fpr*total false positives
+		if rate := float64(fp) / total; rate > fpr*1.3 {
+			t.Errorf("ratio %v, growth %v: measured false positive rate %v over the bound %v", tc.ratio, tc.growth, rate, fpr)
+		}
+	}
+
+	// duplicates do not grow the filter
+	sbf, _ := NewScalableBloomFilter(10, fpr, 0, 0)
+	for i := 0; i < 100; i++ {
+		sbf.Insert([]byte("same"))
+	}
+	if sbf.Len() != 1 || sbf.Stages() != 1 {
+		t.Errorf("a repeated key gave %d elements in %d stages", sbf.Len(), sbf.Stages())
+	}
+
+	for _, tc := range []struct{ ratio, growth float64 }{{1, 2}, {-0.5, 2}, {0.5, 0.5}} {
+		if _, err := NewScalableBloomFilter(initial, fpr, tc.ratio, tc.growth); err == nil {
+			t.Errorf("ratio %v, growth %v accepted", tc.ratio, tc.growth)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package dgobloom
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// sipDigest is a streaming SipHash-2-4, used as the hash function of keyed bloom Filters.
+// It implements hash.Hash32 by folding the 64-bit result.
+type sipDigest struct {
+	k0, k1         uint64
+	v0, v1, v2, v3 uint64
+	buf            [8]byte
+	nbuf           int
+	length         uint64
+}
+
+func newSipDigest(k0, k1 uint64) *sipDigest {
+	d := &sipDigest{k0: k0, k1: k1}
+	d.Reset()
+	return d
+}
+
+func (d *sipDigest) Reset() {
+	d.v0 = d.k0 ^ 0x736f6d6570736575
+	d.v1 = d.k1 ^ 0x646f72616e646f6d
+	d.v2 = d.k0 ^ 0x6c7967656e657261
+	d.v3 = d.k1 ^ 0x7465646279746573
+	d.nbuf = 0
+	d.length = 0
+}
+
+func (d *sipDigest) Size() int      { return 4 }
+func (d *sipDigest) BlockSize() int { return 8 }
+
+func (d *sipDigest) round() {
+	d.v0 += d.v1
+	d.v1 = bits.RotateLeft64(d.v1, 13)
+	d.v1 ^= d.v0
+	d.v0 = bits.RotateLeft64(d.v0, 32)
+	d.v2 += d.v3
+	d.v3 = bits.RotateLeft64(d.v3, 16)
+	d.v3 ^= d.v2
+	d.v0 += d.v3
+	d.v3 = bits.RotateLeft64(d.v3, 21)
+	d.v3 ^= d.v0
+	d.v2 += d.v1
+	d.v1 = bits.RotateLeft64(d.v1, 17)
+	d.v1 ^= d.v2
+	d.v2 = bits.RotateLeft64(d.v2, 32)
+}
+
+func (d *sipDigest) block(m uint64) {
+	d.v3 ^= m
+	d.round()
+	d.round()
+	d.v0 ^= m
+}
+
+func (d *sipDigest) Write(p []byte) (int, error) {
+	n := len(p)
+	d.length += uint64(n)
+
+	if d.nbuf > 0 {
+		c := copy(d.buf[d.nbuf:], p)
+		d.nbuf += c
+		p = p[c:]
+		if d.nbuf < 8 {
+			return n, nil
+		}
+		d.block(binary.LittleEndian.Uint64(d.buf[:]))
+		d.nbuf = 0
+	}
+
+	for len(p) >= 8 {
+		d.block(binary.LittleEndian.Uint64(p))
+		p = p[8:]
+	}
+
+	d.nbuf = copy(d.buf[:], p)
+
+	return n, nil
+}
+
+// Sum64 returns the SipHash-2-4 of the data written so far without changing the state.
+func (d *sipDigest) Sum64() uint64 {
+	s := *d
+
+	var last [8]byte
+	copy(last[:], s.buf[:s.nbuf])
+	last[7] = byte(s.length)
+	s.block(binary.LittleEndian.Uint64(last[:]))
+
+	s.v2 ^= 0xff
+	s.round()
+	s.round()
+	s.round()
+	s.round()
+
+	return s.v0 ^ s.v1 ^ s.v2 ^ s.v3
+}
+
+func (d *sipDigest) Sum32() uint32 {
+	v := d.Sum64()
+	return uint32(v) ^ uint32(v>>32)
+}
+
+func (d *sipDigest) Sum(b []byte) []byte {
+	v := d.Sum32()
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,49 @@
+package dgobloom
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestSipHash(t *testing.T) {
+
+	// reference vectors from the SipHash paper: key 00..0f, message 00..(n-1)
+	var key [16]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:])
+
+	msg := make([]byte, 15)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+
+	for _, tt := range []struct {
+		n    int
+		want uint64
+	}{
+		{0, 0x726fdb47dd0e0e31},
+		{15, 0xa129ca6149be45e5},
+	} {
+		d := newSipDigest(k0, k1)
+		d.Write(msg[:tt.n])
+		if got := d.Sum64(); got != tt.want {
+			t.Errorf("siphash of %d bytes = %x, want %x", tt.n, got, tt.want)
+		}
+
+		// the same message written in pieces
+		d.Reset()
+		for i := 0; i < tt.n; i += 3 {
+			end := i + 3
+			if end > tt.n {
+				end = tt.n
+			}
+			d.Write(msg[i:end])
+		}
+		if got := d.Sum64(); got != tt.want {
+			t.Errorf("streamed siphash of %d bytes = %x, want %x", tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package dgobloom
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// SpectralBloomFilter estimates how many times each element has been inserted.
+// Each bit of a bloom Filter is replaced by a counter; Count returns the minimum of an element's counters.
+// Collisions with other elements can only raise counters, so Count never under-estimates, and for a Filter within Capacity it is usually exact.
+// This is the conservative estimate used by count-min sketches.
+type SpectralBloomFilter struct {
+	capacity uint32
+	elements uint32
+	buckets  uint64   // number of counters
+	counters []uint32 // saturating counters
+	salts    [][]byte
+}
+
+// NewSpectralBloomFilter returns a new spectral bloom Filter sized like NewBloomFilter2, with one counter in place of each bit.
+func NewSpectralBloomFilter(Capacity uint32, falsePositiveRate float64, Salts []uint32) *SpectralBloomFilter {
+
+	sbf := new(SpectralBloomFilter)
+
+	sbf.capacity = Capacity
+	sbf.buckets = FilterBits2(Capacity, falsePositiveRate)
+	sbf.counters = make([]uint32, sbf.buckets)
+
+	sbf.salts = make([][]byte, len(Salts))
+	for i, s := range Salts {
+		sbf.salts[i] = uint32ToByteArray2(s)
+	}
+
+	return sbf
+}
+
+// Len returns the number of insertions, counting repeats.
+func (sbf *SpectralBloomFilter) Len() uint32 { return sbf.elements }
+
+// Insert increments the count for the byte array b.
+// If the function returns false, the Capacity of the Filter has been reached.
+func (sbf *SpectralBloomFilter) Insert(b []byte) bool {
+	h := fnv.New32()
+
+	sbf.elements++
+
+	for _, s := range sbf.salts {
+		h.Reset()
+		h.Write(s)
+		h.Write(b)
+		i := uint64(h.Sum32()) % sbf.buckets
+		if sbf.counters[i] < math.MaxUint32 {
+			sbf.counters[i]++
+		}
+	}
+
+	return sbf.elements < sbf.capacity
+}
+
+// Count returns the estimated number of times b has been inserted.
+// The estimate is never below the true count but may be above it.
+func (sbf *SpectralBloomFilter) Count(b []byte) uint32 {
+	h := fnv.New32()
+
+	min := uint32(math.MaxUint32)
+	for _, s := range sbf.salts {
+		h.Reset()
+		h.Write(s)
+		h.Write(b)
+		if c := sbf.counters[uint64(h.Sum32())%sbf.buckets]; c < min {
+			min = c
+		}
+	}
+
+	if len(sbf.salts) == 0 {
+		return 0
+	}
+
+	return min
+}
+
+// Exists checks the Filter for the byte array b.
+func (sbf *SpectralBloomFilter) Exists(b []byte) bool { return sbf.Count(b) > 0 }
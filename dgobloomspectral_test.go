@@ -0,0 +1,40 @@
+package dgobloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSpectralBloomFilter(t *testing.T) {
+
+	sbf := NewSpectralBloomFilter(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		for n := 0; n < i%10+1; n++ {
+			sbf.Insert(key)
+		}
+	}
+
+	over := 0
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		want := uint32(i%10 + 1)
+		got := sbf.Count(key)
+		if got < want {
+			t.Errorf("Count(%s)=%d, under-estimates %d", key, got, want)
+		}
+		if got > want {
+			over++
+		}
+	}
+
+	t.Log(over, "of 1000 counts over-estimated")
+	if over > 10 {
+		t.Errorf("%d counts over-estimated", over)
+	}
+
+	if sbf.Count([]byte("absent")) != 0 || sbf.Exists([]byte("absent")) {
+		t.Error("absent key has a count")
+	}
+}
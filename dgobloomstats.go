@@ -0,0 +1,167 @@
+package dgobloom
+
+import (
+	"expvar"
+	"math"
+	"math/bits"
+)
+
+// Stats is a snapshot of the size and fill of a bloom Filter, for monitoring.
+// The JSON field names follow metric naming conventions, so ExpvarVar output can be scraped as is.
+type Stats struct {
+	Capacity      uint32  `json:"capacity"`
+	Elements      uint32  `json:"elements"`
+	Bits          uint64  `json:"bits"`
+	Salts         int     `json:"salts"`
+	BitsSet       uint64  `json:"bits_set"`
+	Fill          float64 `json:"fill"`           // fraction of bits set
+	EstimatedFPR  float64 `json:"estimated_fpr"`  // false positive rate implied by Fill
+	ConfiguredFPR float64 `json:"configured_fpr"` // false positive rate at Capacity
+}
+
+// Stats returns a snapshot of the bloom Filter.
+// EstimatedFPR is Fill raised to the number of salts, the chance that every bit an absent element maps to is set; it tracks the real rate as the Filter fills, including past Capacity.
+func (bf *bloomFilter2) Stats() Stats {
+
+	st := Stats{
+		Capacity:      bf.Capacity,
+		Elements:      bf.Elements,
+		Bits:          bf.Bits,
+		Salts:         len(bf.Salts),
+		BitsSet:       bf.PopCount(),
+		ConfiguredFPR: bf.FalsePositiveRate,
+	}
+
+	if bf.Bits > 0 {
+		st.Fill = float64(st.BitsSet) / float64(bf.Bits)
+	}
+	st.EstimatedFPR = math.Pow(st.Fill, float64(st.Salts))
+
+	return st
+}
+
+// EstimatedFalsePositiveRate returns the false positive rate implied by the fraction of bits set, as Stats reports it.
+func (bf *bloomFilter2) EstimatedFalsePositiveRate() float64 { return bf.Stats().EstimatedFPR }
+
+// DegradationFactor returns EstimatedFalsePositiveRate as a multiple of ConfiguredFPR: about 1 for a Filter at Capacity, and growing quickly as inserts exceed it.
+// A Filter sized up to a power of two Bits starts out below 1.  Filters with no configured rate, such as those built by hand, return +Inf once any bit is set.
+func (bf *bloomFilter2) DegradationFactor() float64 {
+
+	est := bf.EstimatedFalsePositiveRate()
+	if est == 0 {
+		return 0
+	}
+
+	if bf.FalsePositiveRate == 0 {
+		return math.Inf(1)
+	}
+
+	return est / bf.FalsePositiveRate
+}
+
+// MeasureFPR returns the fraction of negatives, keys known not to have been inserted, that the bloom Filter reports present: the measured false positive rate.
+// Compare it with ConfiguredFPR to check a configuration empirically; with n negatives the measurement is good to about sqrt(rate/n).  No negatives measure 0.
+func (bf *bloomFilter2) MeasureFPR(negatives [][]byte) float64 {
+
+	if len(negatives) == 0 {
+		return 0
+	}
+
+	ctx := NewQueryContext()
+
+	fp := 0
+	for _, b := range negatives {
+		if bf.exists(ctx, b) {
+			fp++
+		}
+	}
+
+	return float64(fp) / float64(len(negatives))
+}
+
+// RecommendedRotateAt returns the number of Elements at which EstimatedFalsePositiveRate is expected to reach maxFPR, for triggering the rotation of a rolling Filter.
+// With k salts setting random bits in m, n Elements leave a fraction (1-1/m)^(kn) clear, so the rate reaches maxFPR at n = ln(1-maxFPR^(1/k)) / (k ln(1-1/m)).
+// The result depends only on the dimensions, not on what has been inserted; it is 0 for a maxFPR of 0 or less and math.MaxUint32 for 1 or more.
+func (bf *bloomFilter2) RecommendedRotateAt(maxFPR float64) uint32 {
+
+	if !(maxFPR > 0) || len(bf.Salts) == 0 {
+		return 0
+	}
+	if maxFPR >= 1 {
+		return math.MaxUint32
+	}
+
+	k := float64(len(bf.Salts))
+	n := math.Log1p(-math.Pow(maxFPR, 1/k)) / (k * math.Log1p(-1/float64(bf.Bits)))
+
+	if n >= math.MaxUint32 {
+		return math.MaxUint32
+	}
+
+	return uint32(n)
+}
+
+// RemainingCapacity returns how many more distinct Elements can be inserted before the false positive rate expected from Len and the dimensions,
+// (1-e^(-kn/m))^k for n Elements, k salts and m Bits, exceeds targetFPR, for admission control.  It is 0 once the Filter is already past the target.
+// Unlike RecommendedRotateAt it counts from what has been inserted; duplicates inserted with Insert use it up as well, since Len counts them.
+func (bf *bloomFilter2) RemainingCapacity(targetFPR float64) int {
+
+	if !(targetFPR > 0) || len(bf.Salts) == 0 {
+		return 0
+	}
+
+	limit := uint64(math.MaxUint32)
+	if targetFPR < 1 {
+		k := float64(len(bf.Salts))
+		n := -float64(bf.Bits) / k * math.Log1p(-math.Pow(targetFPR, 1/k))
+		if n < float64(limit) {
+			limit = uint64(n)
+		}
+
+		// settle rounding in the closed form against the rate itself
+		for limit < math.MaxUint32 && expectedFPR(bf.Bits, uint32(limit+1), len(bf.Salts)) <= targetFPR {
+			limit++
+		}
+		for limit > 0 && expectedFPR(bf.Bits, uint32(limit), len(bf.Salts)) > targetFPR {
+			limit--
+		}
+	}
+
+	if limit <= uint64(bf.Elements) {
+		return 0
+	}
+
+	return int(limit - uint64(bf.Elements))
+}
+
+// BitEntropy returns the Shannon entropy, in bits, of how the set bits are spread over the 64-bit blocks of the bit vector: the entropy of the distribution that gives each block the fraction of all set bits it holds.
+// Evenly spread bits reach the maximum, log2 of the number of blocks; a value well below it means set bits are clustered, pointing to poor salts or hashing.
+// A Filter with no bits set returns 0.
+func (bf *bloomFilter2) BitEntropy() float64 {
+
+	total := float64(bf.PopCount())
+	if total == 0 {
+		return 0
+	}
+
+	h := 0.0
+	for i := 0; i < len(bf.Filter); i += 2 {
+		n := bits.OnesCount32(bf.Filter[i])
+		if i+1 < len(bf.Filter) {
+			n += bits.OnesCount32(bf.Filter[i+1])
+		}
+		if n > 0 {
+			p := float64(n) / total
+			h -= p * math.Log2(p)
+		}
+	}
+
+	return h
+}
+
+// ExpvarVar returns an expvar.Var whose value is the current Stats of the bloom Filter as a JSON object, so the Filter can be published with expvar.Publish.
+// Stats are taken when the variable is read, which is not synchronized with writers; publish a Filter that is being written only if an occasionally torn snapshot is acceptable.
+// There is no Prometheus collector, to keep the package free of dependencies; one can be built on Stats.
+func (bf *bloomFilter2) ExpvarVar() expvar.Var {
+	return expvar.Func(func() any { return bf.Stats() })
+}
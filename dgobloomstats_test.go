@@ -0,0 +1,234 @@
+package dgobloom
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+
+	if st := b.Stats(); st.BitsSet != 0 || st.Fill != 0 || st.EstimatedFPR != 0 {
+		t.Errorf("empty filter stats %+v", st)
+	}
+
+	for i := 0; i < CAPACITY; i++ {
+		b.Insert([]byte(fmt.Sprintf("stats-%d", i)))
+	}
+
+	st := b.Stats()
+	if st.Capacity != CAPACITY || st.Elements != CAPACITY || st.Bits != b.(*bloomFilter2).Bits || st.Salts != 7 || st.ConfiguredFPR != ERRPCT {
+		t.Errorf("stats %+v do not match the filter", st)
+	}
+	if st.BitsSet != b.PopCount() || st.Fill != float64(st.BitsSet)/float64(st.Bits) {
+		t.Errorf("stats fill %+v does not match PopCount %d", st, b.PopCount())
+	}
+
+	// a Filter at Capacity is within its configured rate
+	if st.EstimatedFPR <= 0 || st.EstimatedFPR > ERRPCT {
+		t.Errorf("EstimatedFPR=%f at Capacity, want in (0, %f]", st.EstimatedFPR, ERRPCT)
+	}
+	if measured := measureFPR(NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7}), CAPACITY); math.Abs(measured-st.EstimatedFPR) > 0.005 {
+		t.Errorf("EstimatedFPR=%f, measured %f", st.EstimatedFPR, measured)
+	}
+}
+
+func TestExpvarVar(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3})
+	v := b.ExpvarVar()
+
+	for n := 0; n <= 100; n += 50 {
+		for i := b.Len(); i < uint32(n); i++ {
+			b.Insert([]byte(fmt.Sprintf("expvar-%d", i)))
+		}
+
+		var got Stats
+		if err := json.Unmarshal([]byte(v.String()), &got); err != nil {
+			t.Fatalf("expvar value %q is not JSON: %v", v.String(), err)
+		}
+		if got != b.Stats() {
+			t.Errorf("expvar value %+v, want %+v", got, b.Stats())
+		}
+		if got.Elements != uint32(n) {
+			t.Errorf("expvar elements=%d, want %d", got.Elements, n)
+		}
+	}
+}
+
+func TestDegradationFactor(t *testing.T) {
+
+	// 13670 Elements at 1% need just under 2^17 Bits, so the Filter is not oversized
+	const n = 13670
+	b := NewBloomFilter2(n, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+
+	if f := b.DegradationFactor(); f != 0 {
+		t.Errorf("empty filter degradation %f, want 0", f)
+	}
+
+	for i := 0; i < n; i++ {
+		b.Insert([]byte(fmt.Sprintf("degrade-%d", i)))
+	}
+
+	if f := b.DegradationFactor(); f < 0.7 || f > 1.3 {
+		t.Errorf("degradation at Capacity %f, want about 1", f)
+	}
+	if b.EstimatedFalsePositiveRate() != b.Stats().EstimatedFPR {
+		t.Error("EstimatedFalsePositiveRate differs from Stats")
+	}
+
+	prev := b.DegradationFactor()
+	for round := 2; round <= 3; round++ {
+		for i := (round - 1) * n; i < round*n; i++ {
+			b.Insert([]byte(fmt.Sprintf("degrade-%d", i)))
+		}
+		f := b.DegradationFactor()
+		if f < 2*prev {
+			t.Errorf("degradation at %dx Capacity %f, want well above %f", round, f, prev)
+		}
+		prev = f
+	}
+
+	if prev < 10 {
+		t.Errorf("degradation at 3x Capacity %f, want over 10", prev)
+	}
+}
+
+func TestMeasureFPR(t *testing.T) {
+
+	negatives := make([][]byte, 50000)
+	for i := range negatives {
+		negatives[i] = []byte(fmt.Sprintf("negative-%d", i))
+	}
+
+	b := NewMixedBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	if fpr := b.MeasureFPR(negatives); fpr != 0 {
+		t.Errorf("empty filter measured FPR %f", fpr)
+	}
+	if fpr := b.MeasureFPR(nil); fpr != 0 {
+		t.Errorf("no negatives measured FPR %f", fpr)
+	}
+
+	// FilterBits2 rounds up to a power of two, so fill to the capacity those bits hold at ERRPCT
+	n := int(float64(b.(*bloomFilter2).Bits) * math.Ln2 * math.Ln2 / -math.Log(ERRPCT))
+	for i := 0; i < n; i++ {
+		b.Insert([]byte(fmt.Sprintf("member-%d", i)))
+	}
+
+	if fpr := b.MeasureFPR(negatives); fpr < ERRPCT/2 || fpr > ERRPCT*2 {
+		t.Errorf("filter at capacity measured FPR %f, configured %f", fpr, ERRPCT)
+	}
+}
+
+func TestRecommendedRotateAt(t *testing.T) {
+
+	const maxFPR = 0.05
+
+	b := NewMixedBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	n := int(b.RecommendedRotateAt(maxFPR))
+	if n < CAPACITY {
+		t.Fatalf("RecommendedRotateAt(%v)=%d, below the capacity at %v", maxFPR, n, ERRPCT)
+	}
+
+	// the fill of a real filter scatters around the expected value by about 1% of the rate, so allow 3%
+	i := 0
+	for ; i < n; i++ {
+		b.Insert([]byte(fmt.Sprintf("member-%d", i)))
+	}
+	if fpr := b.EstimatedFalsePositiveRate(); fpr > maxFPR*1.03 {
+		t.Errorf("estimated FPR %v at the recommended %d elements, cap %v", fpr, n, maxFPR)
+	}
+	for ; i < n*103/100; i++ {
+		b.Insert([]byte(fmt.Sprintf("member-%d", i)))
+	}
+	if fpr := b.EstimatedFalsePositiveRate(); fpr <= maxFPR {
+		t.Errorf("estimated FPR %v still under the cap %v past the recommended %d elements", fpr, maxFPR, n)
+	}
+
+	// a tighter cap rotates sooner
+	if m := b.RecommendedRotateAt(ERRPCT); m >= uint32(n) {
+		t.Errorf("RecommendedRotateAt(%v)=%d, not before %d", ERRPCT, m, n)
+	}
+	if b.RecommendedRotateAt(0) != 0 || b.RecommendedRotateAt(1) != math.MaxUint32 {
+		t.Errorf("RecommendedRotateAt out of range: %d, %d", b.RecommendedRotateAt(0), b.RecommendedRotateAt(1))
+	}
+}
+
+func TestRemainingCapacity(t *testing.T) {
+
+	const target = 0.02
+
+	b := NewMixedBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	bf := b.(*bloomFilter2)
+	k := len(bf.Salts)
+
+	for i := 0; i < CAPACITY/2; i++ {
+		b.Insert([]byte(fmt.Sprintf("member-%d", i)))
+	}
+
+	r := b.RemainingCapacity(target)
+	if r <= CAPACITY/2 {
+		t.Fatalf("RemainingCapacity(%v)=%d with %d of %d inserted at %v", target, r, b.Len(), CAPACITY, ERRPCT)
+	}
+
+	// every admitted insert keeps the expected rate within the target, and one more crosses it
+	for i := 0; i < r; i++ {
+		b.Insert([]byte(fmt.Sprintf("more-%d", i)))
+	}
+	if fpr := expectedFPR(bf.Bits, b.Len(), k); fpr > target {
+		t.Errorf("expected FPR %v after %d more inserts, over the target %v", fpr, r, target)
+	}
+	if fpr := expectedFPR(bf.Bits, b.Len()+1, k); fpr <= target {
+		t.Errorf("expected FPR %v one insert past the remaining %d, still within the target %v", fpr, r, target)
+	}
+	if n := b.RemainingCapacity(target); n != 0 {
+		t.Errorf("RemainingCapacity=%d at the target", n)
+	}
+
+	// the fill of the real Filter agrees with the expectation, as for RecommendedRotateAt
+	if fpr := b.EstimatedFalsePositiveRate(); fpr > target*1.03 {
+		t.Errorf("estimated FPR %v at the target %v", fpr, target)
+	}
+
+	b.Insert([]byte("past"))
+	if n := b.RemainingCapacity(target); n != 0 {
+		t.Errorf("RemainingCapacity=%d past the target", n)
+	}
+	if n := b.RemainingCapacity(0); n != 0 {
+		t.Errorf("RemainingCapacity(0)=%d", n)
+	}
+	if n := b.RemainingCapacity(1); n != math.MaxUint32-int(b.Len()) {
+		t.Errorf("RemainingCapacity(1)=%d", n)
+	}
+}
+
+func TestBitEntropy(t *testing.T) {
+
+	b := NewBloomFilter2(CAPACITY, ERRPCT, []uint32{1, 2, 3, 4, 5, 6, 7})
+	if h := b.BitEntropy(); h != 0 {
+		t.Errorf("empty filter entropy %f, want 0", h)
+	}
+
+	for i := 0; i < CAPACITY; i++ {
+		b.Insert([]byte(fmt.Sprintf("entropy-%d", i)))
+	}
+
+	blocks := len(b.(*bloomFilter2).Filter) / 2
+	maxH := math.Log2(float64(blocks))
+	spread := b.BitEntropy()
+	if spread > maxH || spread < 0.98*maxH {
+		t.Errorf("well-distributed entropy %f, want close to the maximum %f", spread, maxH)
+	}
+
+	// the same number of bits crammed into the first eighth of the vector
+	c := EmptyLike(b).(*bloomFilter2)
+	for i := uint64(0); i < b.PopCount(); i++ {
+		c.Filter.set(i * 7 % (c.Bits / 8))
+	}
+	if clustered := c.BitEntropy(); clustered > maxH-2.5 {
+		t.Errorf("clustered entropy %f, want well below %f", clustered, spread)
+	}
+}
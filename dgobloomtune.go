@@ -0,0 +1,83 @@
+package dgobloom
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// lookup cost model measured by calibrate: an Exists costs overhead plus perSalt for each salt tested
+var (
+	calibrateOnce    sync.Once
+	lookupOverheadNs float64
+	lookupPerSaltNs  float64
+)
+
+// calibrate times lookups of a present key, which test every salt, in Filters with few and many salts
+func calibrate() {
+
+	const (
+		few, many = 1, 16
+		rounds    = 20000
+	)
+
+	timeLookups := func(k int) float64 {
+		Salts := make([]uint32, k)
+		for i := range Salts {
+			Salts[i] = uint32(i + 1)
+		}
+
+		bf := NewBloomFilter2(1<<16, 0.01, Salts)
+		keys := make([][]byte, 64)
+		for i := range keys {
+			keys[i] = []byte(fmt.Sprintf("calibrate-%d", i))
+			bf.Insert(keys[i])
+		}
+
+		// best of three, to discount interruptions
+		best := 0.0
+		for try := 0; try < 3; try++ {
+			start := time.Now()
+			for i := 0; i < rounds; i++ {
+				bf.Exists(keys[i%len(keys)])
+			}
+			if ns := float64(time.Since(start).Nanoseconds()) / rounds; try == 0 || ns < best {
+				best = ns
+			}
+		}
+		return best
+	}
+
+	tFew, tMany := timeLookups(few), timeLookups(many)
+
+	lookupPerSaltNs = (tMany - tFew) / (many - few)
+	if lookupPerSaltNs <= 0 {
+		// timer too coarse to tell them apart; assume the whole cost is per salt
+		lookupPerSaltNs = tMany / many
+	}
+	lookupOverheadNs = tFew - few*lookupPerSaltNs
+	if lookupOverheadNs < 0 {
+		lookupOverheadNs = 0
+	}
+}
+
+// Tune returns the largest number of salts, between 1 and MaxSalts, for which a lookup of a present key is expected to take at most targetNsPerOp nanoseconds on this machine.
+// More salts lower the false positive rate, up to the optimum SaltsRequired2 reports, and cost time on every Insert and on lookups of present keys.
+// The cost of a lookup is measured by a short calibration of a few milliseconds on first use and the result cached for the life of the process.
+// If even one salt does not fit the budget, or the budget is not positive or NaN, Tune returns 1; an infinite budget gets MaxSalts.
+// The result is an estimate: it varies between runs and with the load on the machine.
+func Tune(targetNsPerOp float64) (k int) {
+
+	calibrateOnce.Do(calibrate)
+
+	// clamp before converting, since huge or infinite salt counts do not convert to an int
+	salts := (targetNsPerOp - lookupOverheadNs) / lookupPerSaltNs
+	if !(targetNsPerOp > 0) || !(salts >= 1) {
+		return 1
+	}
+	if salts >= MaxSalts {
+		return MaxSalts
+	}
+
+	return int(salts)
+}
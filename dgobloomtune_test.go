@@ -0,0 +1,60 @@
+package dgobloom
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestTune(t *testing.T) {
+
+	prev := 0
+	for _, budget := range []float64{0, 1, 10, 50, 100, 200, 500, 1000, 1e6} {
+		k := Tune(budget)
+		if k < 1 || k > MaxSalts {
+			t.Errorf("Tune(%f)=%d, out of range", budget, k)
+		}
+		if k < prev {
+			t.Errorf("Tune(%f)=%d is less than %d for a smaller budget", budget, k, prev)
+		}
+		prev = k
+	}
+
+	for _, budget := range []float64{1e6, 1e300, math.MaxFloat64, math.Inf(1)} {
+		if k := Tune(budget); k != MaxSalts {
+			t.Errorf("Tune(%g)=%d, want %d", budget, k, MaxSalts)
+		}
+	}
+	for _, budget := range []float64{0, -1, math.Inf(-1), math.NaN()} {
+		if k := Tune(budget); k != 1 {
+			t.Errorf("Tune(%g)=%d, want 1", budget, k)
+		}
+	}
+
+	// the measured cost of an 8 salt lookup, with some slack, fits 8 salts but not 9
+	budget := lookupOverheadNs + 8.5*lookupPerSaltNs
+	if k := Tune(budget); k != 8 {
+		t.Errorf("Tune of the cost of 8 salts=%d, want 8", k)
+	}
+}
+
+func BenchmarkExistsSalts(b *testing.B) {
+
+	for _, k := range []int{1, 2, 4, 8, 16, 32} {
+		b.Run(fmt.Sprintf("k=%d", k), func(b *testing.B) {
+			Salts := make([]uint32, k)
+			for i := range Salts {
+				Salts[i] = uint32(i + 1)
+			}
+
+			bf := NewBloomFilter2(CAPACITY, ERRPCT, Salts)
+			key := []byte("benchmark-key")
+			bf.Insert(key)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				bf.Exists(key)
+			}
+		})
+	}
+}
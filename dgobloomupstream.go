@@ -0,0 +1,47 @@
+package dgobloom
+
+import "fmt"
+
+// upstreamProbes are hashed by ImportUpstream to check that an upstream Filter uses the hash of this package
+var upstreamProbes = [][]byte{nil, []byte("a"), []byte("dgobloom"), {0, 1, 2, 3, 0xff, 0xfe}}
+
+// ImportUpstream converts a BloomFilter of the original dgobloom package, built with NewBloomFilter, to a BloomFilter2 holding the same bits,
+// for migrating to this package.  The original package has no serialization and hashes with whatever hash.Hash32 it was given;
+// its bits only carry over if that hash is 32-bit FNV-1, fnv.New32, the hash of this package.  ImportUpstream hashes a few probes
+// with the Filter's hash and returns ErrIncompatible if they do not match, as for fnv.New32a; such a Filter must be rebuilt from its items.
+// The configured false positive rate, which the original package does not keep, is set to the expected rate at Capacity.
+func ImportUpstream(f BloomFilter) (BloomFilter2, error) {
+
+	up, ok := f.(*bloomFilter)
+	if !ok || up == nil || up.h == nil {
+		return nil, fmt.Errorf("%w: unsupported filter type %T", ErrIncompatible, f)
+	}
+
+	for _, p := range upstreamProbes {
+		up.h.Reset()
+		up.h.Write(p)
+		if up.h.Sum32() != fnv32(nil, p) {
+			return nil, fmt.Errorf("%w: the upstream filter does not hash with 32-bit FNV-1", ErrIncompatible)
+		}
+	}
+
+	bf := &bloomFilter2{
+		Capacity: up.capacity,
+		Elements: up.elements,
+		Bits:     up.bits,
+		Filter:   newBitvector2(len(up.filter)),
+		Salts:    make([][]byte, len(up.salts)),
+	}
+	copy(bf.Filter, up.filter)
+	for i, s := range up.salts {
+		bf.Salts[i] = append([]byte(nil), s...)
+	}
+
+	if err := bf.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: upstream filter: %v", ErrIncompatible, err)
+	}
+
+	bf.FalsePositiveRate = expectedFPR(bf.Bits, bf.Capacity, len(bf.Salts))
+
+	return bf, nil
+}
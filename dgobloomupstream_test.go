@@ -0,0 +1,72 @@
+package dgobloom
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"testing"
+)
+
+func TestImportUpstream(t *testing.T) {
+
+	salts := []uint32{0x12345678, 0x9abcdef0, 3, 4, 5, 6, 7}
+	up := NewBloomFilter(CAPACITY, ERRPCT, fnv.New32(), salts)
+	for i := 0; i < CAPACITY/2; i++ {
+		up.Insert([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	b, err := ImportUpstream(up)
+	if err != nil {
+		t.Fatalf("ImportUpstream failed: %v", err)
+	}
+
+	for i := 0; i < CAPACITY/2; i++ {
+		if !b.Exists([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("key-%d lost in the import", i)
+		}
+	}
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprintf("other-%d", i))
+		if b.Exists(key) != up.Exists(key) {
+			t.Fatalf("imported filter and upstream filter disagree on %q", key)
+		}
+	}
+
+	if b.Len() != up.Elements() || b.Cap() != CAPACITY {
+		t.Errorf("imported Len %d and Cap %d, want %d and %d", b.Len(), b.Cap(), up.Elements(), CAPACITY)
+	}
+	if fpr := b.ConfiguredFPR(); fpr <= 0 || fpr > ERRPCT {
+		t.Errorf("imported configured false positive rate %g", fpr)
+	}
+
+	// the import is a copy
+	up.Insert([]byte("after"))
+	if b.Exists([]byte("after")) {
+		t.Error("an insert into the upstream filter shows through the import")
+	}
+
+	// it is the filter this package builds from the same salts, ready to merge
+	native := NewBloomFilter2(CAPACITY, ERRPCT, salts)
+	if err := native.Merge(b); err != nil {
+		t.Fatalf("merge of the imported filter failed: %v", err)
+	}
+	if !native.Exists([]byte("key-7")) {
+		t.Error("merge of the imported filter lost key-7")
+	}
+
+	// a compressed upstream filter imports at its reduced size
+	up.Compress()
+	if c, err := ImportUpstream(up); err != nil || !c.Exists([]byte("key-7")) {
+		t.Errorf("import of a compressed upstream filter: %v", err)
+	}
+
+	// the upstream tests hash with FNV-1a, whose bits mean nothing here
+	fnv1a := NewBloomFilter(CAPACITY, ERRPCT, fnv.New32a(), salts)
+	fnv1a.Insert([]byte("key-7"))
+	if _, err := ImportUpstream(fnv1a); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("import of an FNV-1a filter: got %v, want ErrIncompatible", err)
+	}
+	if _, err := ImportUpstream(nil); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("import of nil: got %v, want ErrIncompatible", err)
+	}
+}